@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultAdminSocket is the path of the admin API socket, if --admin-socket is not set.
+// It is in the runtime directory of the user, or in /run for system services,
+// not in the world-writable temporary directory, where other users could take the path.
+var defaultAdminSocket = func() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "quic-router-go", "admin.sock")
+	}
+	return "/run/quic-router-go/admin.sock"
+}()
+
+// adminTarget is the router.Tenants of a config file, or a single router
+type adminTarget interface {
+	stoppable
+	// Router returns the router of the tenant, or nil if the tenant is unknown
+	Router(name string) *router.Router
+	Routers() []*router.Router
+}
+
+// singleRouter is the adminTarget of a router configured by flags
+type singleRouter struct {
+	r *router.Router
+}
+
+func (s singleRouter) Router(name string) *router.Router {
+	if name != s.r.Name() {
+		return nil
+	}
+	return s.r
+}
+
+func (s singleRouter) Routers() []*router.Router {
+	return []*router.Router{s.r}
+}
+
+func (s singleRouter) Stop(err error) {
+	s.r.Stop(err)
+}
+
+func (s singleRouter) Shutdown(ctx context.Context) {
+	s.r.Shutdown(ctx)
+}
+
+// adminServer serves the admin API on a Unix socket and optionally on TCP.
+// Requests over TCP must carry the token as bearer token,
+// access to the Unix socket is restricted by its file permissions.
+type adminServer struct {
+	target adminTarget
+	token  string
+	// captureDir is the directory captures are written to, empty disables captures
+	captureDir string
+	servers    []*http.Server
+	// socketPath is removed on close, empty if there is no Unix socket
+	socketPath string
+}
+
+// startAdminServer listens on the Unix socket and the TCP address, if not empty
+func startAdminServer(target adminTarget, socketPath string, addr string, token string, captureDir string) (*adminServer, error) {
+	if addr != "" && token == "" {
+		return nil, fmt.Errorf("admin API on TCP requires a token")
+	}
+	a := &adminServer{target: target, token: token, captureDir: captureDir}
+	if socketPath != "" {
+		ln, err := listenAdminSocket(socketPath)
+		if err != nil {
+			return nil, err
+		}
+		a.socketPath = socketPath
+		a.serve(ln, false)
+		fmt.Printf("admin API on %s\n", socketPath)
+	}
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			a.close()
+			return nil, fmt.Errorf("failed to serve admin API: %w", err)
+		}
+		a.serve(ln, true)
+		fmt.Printf("admin API on %s\n", ln.Addr())
+	}
+	return a, nil
+}
+
+// listenAdminSocket replaces the socket of a process that is gone.
+// A missing directory of the socket is created, accessible only by the user.
+func listenAdminSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create admin socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("admin socket %s is in use", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve admin API: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (a *adminServer) serve(ln net.Listener, authenticate bool) {
+	var handler http.Handler = a.mux()
+	if authenticate {
+		handler = a.authenticate(handler)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	a.servers = append(a.servers, server)
+	go func() {
+		_ = server.Serve(ln)
+	}()
+}
+
+func (a *adminServer) close() {
+	for _, s := range a.servers {
+		_ = s.Close()
+	}
+	if a.socketPath != "" {
+		_ = os.Remove(a.socketPath)
+	}
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// adminHandler handles a request to the router of the tenant parameter
+type adminHandler func(r *router.Router, req *http.Request) (any, error)
+
+// adminError is returned by handlers to answer with a status other than 400
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e *adminError) Error() string {
+	return e.err.Error()
+}
+
+func (a *adminServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenants", a.handleTenants)
+	a.handle(mux, "/backends", map[string]adminHandler{
+		http.MethodGet:    listBackends,
+		http.MethodPost:   addBackend,
+		http.MethodDelete: removeBackend,
+	})
+	a.handle(mux, "/backends/drain", map[string]adminHandler{http.MethodPost: drainBackend})
+	a.handle(mux, "/backends/undrain", map[string]adminHandler{http.MethodPost: undrainBackend})
+	a.handle(mux, "/keys/rotate", map[string]adminHandler{http.MethodPost: rotateKey})
+	a.handle(mux, "/keys/retire", map[string]adminHandler{http.MethodPost: retireKey})
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	a.handle(mux, "/debug", map[string]adminHandler{
+		http.MethodGet:  listDebugPrefixes,
+		http.MethodPost: setDebugLogging,
+	})
+	a.handle(mux, "/capture", map[string]adminHandler{
+		http.MethodPost:   a.startCapture,
+		http.MethodDelete: stopAdminCapture,
+	})
+	mux.HandleFunc("/shutdown", a.handleShutdown)
+	return mux
+}
+
+func (a *adminServer) handle(mux *http.ServeMux, path string, handlers map[string]adminHandler) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		handler, ok := handlers[req.Method]
+		if !ok {
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		r, err := a.router(req)
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		resp, err := handler(r, req)
+		var adminErr *adminError
+		switch {
+		case errors.As(err, &adminErr):
+			writeAdminError(w, adminErr.status, adminErr.err)
+		case err != nil:
+			writeAdminError(w, http.StatusBadRequest, err)
+		default:
+			writeAdminJSON(w, resp)
+		}
+	})
+}
+
+// router returns the router of the tenant parameter, which can be omitted if there is only one tenant
+func (a *adminServer) router(req *http.Request) (*router.Router, error) {
+	name := req.URL.Query().Get("tenant")
+	if name == "" {
+		if routers := a.target.Routers(); len(routers) == 1 {
+			return routers[0], nil
+		}
+	}
+	r := a.target.Router(name)
+	if r == nil {
+		return nil, fmt.Errorf("unknown tenant %q", name)
+	}
+	return r, nil
+}
+
+type tenantInfo struct {
+	Name          string           `json:"name"`
+	Listen        []netip.AddrPort `json:"listen"`
+	Backends      int              `json:"backends"`
+	PreviousKey   bool             `json:"previous_key"`
+	DebugPrefixes []netip.Prefix   `json:"debug_prefixes,omitempty"`
+}
+
+func (a *adminServer) handleTenants(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	tenants := []tenantInfo{}
+	for _, r := range a.target.Routers() {
+		tenants = append(tenants, tenantInfo{
+			Name:          r.Name(),
+			Listen:        r.ListenAddrs(),
+			Backends:      len(r.Backends()),
+			PreviousKey:   r.HasPreviousKey(),
+			DebugPrefixes: r.DebugPrefixes(),
+		})
+	}
+	writeAdminJSON(w, tenants)
+}
+
+type backendInfo struct {
+	Addr              netip.AddrPort `json:"addr"`
+	Pool              string         `json:"pool"`
+	State             string         `json:"state"`
+	Draining          bool           `json:"draining"`
+	DrainDeadline     *time.Time     `json:"drain_deadline,omitempty"`
+	Weight            uint32         `json:"weight"`
+	ActiveConnections *uint32        `json:"active_connections,omitempty"`
+	Utilization       *float64       `json:"utilization,omitempty"`
+	LastForwarded     *time.Time     `json:"last_forwarded,omitempty"`
+}
+
+func listBackends(r *router.Router, _ *http.Request) (any, error) {
+	backends := []backendInfo{}
+	for _, b := range r.Backends() {
+		info := backendInfo{
+			Addr:     b.Addr(),
+			Pool:     b.Pool(),
+			State:    b.State().String(),
+			Draining: b.Draining(),
+			Weight:   b.Weight(),
+		}
+		if deadline := b.DrainDeadline(); !deadline.IsZero() {
+			info.DrainDeadline = &deadline
+		}
+		if load := b.Load(); load != nil {
+			info.ActiveConnections = &load.ActiveConnections
+			info.Utilization = &load.Utilization
+		}
+		if last := b.LastForwarded(); !last.IsZero() {
+			info.LastForwarded = &last
+		}
+		backends = append(backends, info)
+	}
+	return backends, nil
+}
+
+// backendRequest is the body of requests that change a backend
+type backendRequest struct {
+	Addr netip.AddrPort `json:"addr"`
+	// Pool of an added backend, the default pool if empty
+	Pool string `json:"pool"`
+	// Timeout of a drained backend, e.g. 5m; no timeout if empty
+	Timeout string `json:"timeout"`
+}
+
+func decodeBackendRequest(req *http.Request) (*backendRequest, error) {
+	var body backendRequest
+	if err := decodeAdminRequest(req, &body); err != nil {
+		return nil, err
+	}
+	if !body.Addr.IsValid() {
+		return nil, fmt.Errorf("missing backend address")
+	}
+	return &body, nil
+}
+
+func addBackend(r *router.Router, req *http.Request) (any, error) {
+	body, err := decodeBackendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	pool := body.Pool
+	if pool == "" {
+		pool = router.DefaultPool
+	}
+	return nil, r.AddBackendToPool(body.Addr, pool)
+}
+
+func removeBackend(r *router.Router, req *http.Request) (any, error) {
+	addr, err := netip.ParseAddrPort(req.URL.Query().Get("addr"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backend address: %s", err)
+	}
+	if !r.RemoveBackend(addr) {
+		return nil, &adminError{status: http.StatusNotFound, err: fmt.Errorf("unknown backend %s", addr)}
+	}
+	return nil, nil
+}
+
+func drainBackend(r *router.Router, req *http.Request) (any, error) {
+	body, err := decodeBackendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if body.Timeout != "" {
+		timeout, err := time.ParseDuration(body.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timeout: %s", err)
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	return nil, r.DrainBackend(body.Addr, deadline)
+}
+
+func undrainBackend(r *router.Router, req *http.Request) (any, error) {
+	body, err := decodeBackendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return nil, r.UndrainBackend(body.Addr)
+}
+
+type keyRequest struct {
+	// Key is base64 encoded, a random key is generated if empty
+	Key string `json:"key"`
+}
+
+type keyResponse struct {
+	Key string `json:"key"`
+}
+
+func rotateKey(r *router.Router, req *http.Request) (any, error) {
+	var body keyRequest
+	if err := decodeAdminRequest(req, &body); err != nil {
+		return nil, err
+	}
+	key := generateKey()
+	if body.Key != "" {
+		var err error
+		key, err = parseKey(body.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := r.RotateKey(*key); err != nil {
+		return nil, err
+	}
+	return keyResponse{Key: base64.StdEncoding.EncodeToString(key[:])}, nil
+}
+
+func retireKey(r *router.Router, _ *http.Request) (any, error) {
+	if !r.RetirePreviousKey() {
+		return nil, &adminError{status: http.StatusConflict, err: fmt.Errorf("no previous key")}
+	}
+	return nil, nil
+}
+
+func (a *adminServer) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	r, err := a.router(req)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = fmt.Fprintln(w, r.Metrics().String())
+}
+
+func listDebugPrefixes(r *router.Router, _ *http.Request) (any, error) {
+	prefixes := r.DebugPrefixes()
+	if prefixes == nil {
+		prefixes = []netip.Prefix{}
+	}
+	return prefixes, nil
+}
+
+type debugRequest struct {
+	Prefix  netip.Prefix `json:"prefix"`
+	Enabled bool         `json:"enabled"`
+}
+
+func setDebugLogging(r *router.Router, req *http.Request) (any, error) {
+	var body debugRequest
+	if err := decodeAdminRequest(req, &body); err != nil {
+		return nil, err
+	}
+	if !body.Prefix.IsValid() {
+		return nil, fmt.Errorf("missing client prefix")
+	}
+	r.SetDebugLogging(body.Prefix, body.Enabled)
+	return nil, nil
+}
+
+type captureRequest struct {
+	// File the capture is written to by the router, a name in the capture directory
+	File string `json:"file"`
+	// Filter is a router.CaptureFilter, all datagrams are captured if empty
+	Filter string `json:"filter"`
+	// Duration after which the capture is stopped, e.g. 30s; the capture runs until it is stopped if empty
+	Duration string `json:"duration"`
+}
+
+type captureResponse struct {
+	Packets uint64 `json:"packets"`
+}
+
+// startCapture writes the capture to the capture directory only,
+// so clients of the admin API cannot overwrite other files of the router's user
+func (a *adminServer) startCapture(r *router.Router, req *http.Request) (any, error) {
+	if a.captureDir == "" {
+		return nil, &adminError{status: http.StatusForbidden, err: fmt.Errorf("captures are disabled, see --capture-dir")}
+	}
+	var body captureRequest
+	if err := decodeAdminRequest(req, &body); err != nil {
+		return nil, err
+	}
+	if body.File == "" {
+		return nil, fmt.Errorf("missing capture file")
+	}
+	if !filepath.IsLocal(body.File) {
+		return nil, fmt.Errorf("capture file must be a name in the capture directory")
+	}
+	var duration time.Duration
+	if body.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(body.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration: %s", err)
+		}
+	}
+	c, err := startCapture([]*router.Router{r}, filepath.Join(a.captureDir, body.File), body.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if duration != 0 {
+		// closed captures are replaced by the next capture
+		time.AfterFunc(duration, func() {
+			_ = c.Close()
+		})
+	}
+	return nil, nil
+}
+
+func stopAdminCapture(r *router.Router, _ *http.Request) (any, error) {
+	c := r.StopCapture()
+	if c == nil {
+		return nil, &adminError{status: http.StatusConflict, err: fmt.Errorf("no capture running")}
+	}
+	if err := c.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write capture: %s", err)
+	}
+	return captureResponse{Packets: c.Packets()}, nil
+}
+
+type shutdownRequest struct {
+	// Grace is the time established connections are still forwarded, e.g. 30s; 0 or empty stops immediately
+	Grace string `json:"grace"`
+}
+
+// handleShutdown shuts all tenants down, the response is sent before
+func (a *adminServer) handleShutdown(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	var body shutdownRequest
+	if err := decodeAdminRequest(req, &body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	var grace time.Duration
+	if body.Grace != "" {
+		var err error
+		grace, err = time.ParseDuration(body.Grace)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("failed to parse grace period: %s", err))
+			return
+		}
+	}
+	writeAdminJSON(w, nil)
+	go func() {
+		if grace == 0 {
+			a.target.Stop(nil)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		a.target.Shutdown(ctx)
+	}()
+}
+
+// decodeAdminRequest decodes the JSON body, an empty body leaves v unchanged
+func decodeAdminRequest(req *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, req.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse request: %s", err)
+	}
+	return nil
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(adminErrorResponse{Error: err.Error()})
+}
+
+// writeAdminJSON answers with the value, or with an empty object if v is nil
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	if v == nil {
+		v = struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
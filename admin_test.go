@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAdminServer(t *testing.T, captureDir string) *adminServer {
+	tenants, err := router.NewTenants([]router.TenantConfig{{
+		Listen: []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:0")},
+		Config: &router.Config{Name: "web", Backends: []netip.AddrPort{netip.MustParseAddrPort("192.168.0.2:4433")}},
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		tenants.Stop(nil)
+		<-tenants.Closed()
+	})
+	return &adminServer{target: tenants, token: "secret", captureDir: captureDir}
+}
+
+// serveAdmin sends the request to the admin API and returns the status and the body
+func serveAdmin(handler http.Handler, method string, target string, body string) (int, string) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAdminAuthenticate(t *testing.T) {
+	a := newTestAdminServer(t, "")
+	handler := a.authenticate(a.mux())
+	for _, authorization := range []string{"", "secret", "Bearer wrong", "Bearer secret2"} {
+		req := httptest.NewRequest(http.MethodGet, "/tenants", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, authorization)
+		assert.JSONEq(t, `{"error": "invalid token"}`, rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/tenants", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var tenants []tenantInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tenants))
+	require.Len(t, tenants, 1)
+	assert.Equal(t, "web", tenants[0].Name)
+}
+
+func TestAdminBackends(t *testing.T) {
+	handler := newTestAdminServer(t, "").mux()
+	listBackends := func() []backendInfo {
+		status, body := serveAdmin(handler, http.MethodGet, "/backends", "")
+		require.Equal(t, http.StatusOK, status, body)
+		var backends []backendInfo
+		require.NoError(t, json.Unmarshal([]byte(body), &backends))
+		return backends
+	}
+	require.Len(t, listBackends(), 1)
+
+	status, body := serveAdmin(handler, http.MethodPost, "/backends", `{"addr": "192.168.0.3:4433"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	require.Len(t, listBackends(), 2)
+	status, body = serveAdmin(handler, http.MethodPost, "/backends/drain", `{"addr": "192.168.0.3:4433", "timeout": "5m"}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	for _, b := range listBackends() {
+		if b.Addr == netip.MustParseAddrPort("192.168.0.3:4433") {
+			assert.True(t, b.Draining)
+			assert.NotNil(t, b.DrainDeadline)
+		}
+	}
+	status, _ = serveAdmin(handler, http.MethodDelete, "/backends?addr=192.168.0.3:4433", "")
+	assert.Equal(t, http.StatusOK, status)
+	require.Len(t, listBackends(), 1)
+
+	status, body = serveAdmin(handler, http.MethodDelete, "/backends?addr=192.168.0.3:4433", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error": "unknown backend 192.168.0.3:4433"}`, body)
+	status, _ = serveAdmin(handler, http.MethodPost, "/backends", `{"address": "192.168.0.3:4433"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = serveAdmin(handler, http.MethodPost, "/backends", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = serveAdmin(handler, http.MethodPut, "/backends", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	status, body = serveAdmin(handler, http.MethodGet, "/backends?tenant=api", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error": "unknown tenant \"api\""}`, body)
+}
+
+func TestAdminKeys(t *testing.T) {
+	handler := newTestAdminServer(t, "").mux()
+	status, _ := serveAdmin(handler, http.MethodPost, "/keys/retire", "")
+	assert.Equal(t, http.StatusConflict, status)
+	status, body := serveAdmin(handler, http.MethodPost, "/keys/rotate", "")
+	require.Equal(t, http.StatusOK, status, body)
+	var resp keyResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	_, err := parseKey(resp.Key)
+	assert.NoError(t, err)
+	status, _ = serveAdmin(handler, http.MethodPost, "/keys/rotate", `{"key": "`+resp.Key+`"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = serveAdmin(handler, http.MethodPost, "/keys/retire", "")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestAdminCapture(t *testing.T) {
+	status, body := serveAdmin(newTestAdminServer(t, "").mux(), http.MethodPost, "/capture", `{"file": "capture.pcapng"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, "captures are disabled")
+
+	dir := t.TempDir()
+	handler := newTestAdminServer(t, dir).mux()
+	for _, file := range []string{"", "../capture.pcapng", "/tmp/capture.pcapng"} {
+		status, _ = serveAdmin(handler, http.MethodPost, "/capture", `{"file": "`+file+`"}`)
+		assert.Equal(t, http.StatusBadRequest, status, file)
+	}
+	status, body = serveAdmin(handler, http.MethodPost, "/capture", `{"file": "capture.pcapng"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	_, err := os.Stat(filepath.Join(dir, "capture.pcapng"))
+	assert.NoError(t, err)
+	status, body = serveAdmin(handler, http.MethodDelete, "/capture", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"packets": 0}`, body)
+	status, _ = serveAdmin(handler, http.MethodDelete, "/capture", "")
+	assert.Equal(t, http.StatusConflict, status)
+}
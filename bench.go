@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	socketoob "github.com/birneee/go-socket-oob"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/urfave/cli/v2"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchKind is the kind of traffic of a bench datagram
+type benchKind byte
+
+const (
+	benchInitial benchKind = iota
+	benchShortHeader
+	benchReturn
+	numBenchKinds
+)
+
+func (k benchKind) String() string {
+	switch k {
+	case benchInitial:
+		return "initial"
+	case benchShortHeader:
+		return "short header"
+	default:
+		return "return"
+	}
+}
+
+const (
+	// benchTrailerLen is the length of the trailer of every bench datagram: kind (1) | client (2) | send time (8).
+	// The trailer ends the datagram, so it is found behind the extension header of the router.
+	benchTrailerLen = 11
+	// benchDrainTime is the time the receivers wait for datagrams after the clients stopped sending
+	benchDrainTime = 500 * time.Millisecond
+	// benchSocketBuffer is the receive buffer size of the bench sockets and the in-process router
+	benchSocketBuffer = 8 << 20
+	// benchMaxBatch is the maximum number of segments of a GSO write
+	benchMaxBatch = 64
+)
+
+var benchPadding [router.MTU]byte
+
+var benchCommand = &cli.Command{
+	Name:  "bench",
+	Usage: "measure the throughput and latency of a router with synthesized traffic: Initials from many source ports, short header packets to fake backends and their return traffic",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "router",
+			Usage: "address of a running router, e.g. 127.0.0.1:18080; its backends must be the --backend addresses; an in-process router is benchmarked if not set",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "key of the running router; value must be 32 byte and base64 encoded",
+		},
+		cipherSuiteFlag(),
+		&cli.StringSliceFlag{
+			Name:  "backend",
+			Usage: "address of a backend of the running router, the bench listens on it as fake backend; can be repeated",
+		},
+		&cli.IntFlag{
+			Name:  "backends",
+			Usage: "number of fake backends of the in-process router",
+			Value: 4,
+		},
+		&cli.IntFlag{
+			Name:  "clients",
+			Usage: "number of clients, each sending from its own source port",
+			Value: 16,
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "time the clients send per run",
+			Value: 10 * time.Second,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "datagrams per second sent by all clients together; 0 sends as fast as possible",
+		},
+		&cli.IntFlag{
+			Name:  "size",
+			Usage: "UDP payload size of the datagrams of the clients and backends, without extension header",
+			Value: 1200,
+		},
+		&cli.Float64Flag{
+			Name:  "initial-share",
+			Usage: "share of Initials in the datagrams of the clients, the others are short header packets that the backends answer",
+			Value: 0.1,
+		},
+		&cli.StringFlag{
+			Name:  "offload",
+			Usage: "UDP segmentation offload (GSO) of the senders and receive offload (GRO) of the fake clients and backends; one of on, off, both",
+			Value: "both",
+		},
+		&cli.IntFlag{
+			Name:  "batch",
+			Usage: "datagrams per GSO write, at most 64",
+			Value: 16,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		b, err := newBench(ctx)
+		if err != nil {
+			return err
+		}
+		defer b.close()
+		var offloads []bool
+		switch ctx.String("offload") {
+		case "off":
+			offloads = []bool{false}
+		case "on":
+			offloads = []bool{true}
+		case "both":
+			// GRO cannot be disabled on the backends after the run with offload
+			offloads = []bool{false, true}
+		default:
+			return fmt.Errorf("unknown offload %q", ctx.String("offload"))
+		}
+		if b.router != nil {
+			fmt.Printf("in-process router on %s", b.routerAddr)
+		} else {
+			fmt.Printf("router on %s", b.routerAddr)
+		}
+		fmt.Printf(", %d backends, %d clients, %d byte datagrams\n", len(b.backends), b.clients, b.size)
+		for _, offload := range offloads {
+			result, err := b.run(offload)
+			if err != nil {
+				return err
+			}
+			result.print(os.Stdout, offload)
+		}
+		return nil
+	},
+}
+
+// bench sends synthesized traffic through a router
+type bench struct {
+	routerAddr netip.AddrPort
+	// router is the in-process router, nil if a running router is benchmarked
+	router       *router.Router
+	backends     []*benchBackend
+	clients      int
+	duration     time.Duration
+	rate         float64
+	size         int
+	initialShare float64
+	batch        int
+	// connIDs of every backend, the clients send short header packets to all backends
+	connIDs [][]byte
+	// start is the reference of the send times in the trailers
+	start time.Time
+}
+
+// benchBackend answers the short header packets with return traffic through the router
+type benchBackend struct {
+	conn   *net.UDPConn
+	packer router.NonQuicPrefixClientIDExtHdrPacker
+}
+
+func newBench(ctx *cli.Context) (*bench, error) {
+	b := &bench{
+		clients:      ctx.Int("clients"),
+		duration:     ctx.Duration("duration"),
+		rate:         ctx.Float64("rate"),
+		size:         ctx.Int("size"),
+		initialShare: ctx.Float64("initial-share"),
+		batch:        ctx.Int("batch"),
+		start:        time.Now(),
+	}
+	switch {
+	case b.clients < 1 || b.clients > math.MaxUint16:
+		return nil, fmt.Errorf("--clients must be between 1 and %d", math.MaxUint16)
+	case b.size < 64 || b.size > router.MaxQUICPacketLen:
+		return nil, fmt.Errorf("--size must be between 64 and %d", router.MaxQUICPacketLen)
+	case b.initialShare < 0 || b.initialShare > 1:
+		return nil, fmt.Errorf("--initial-share must be between 0 and 1")
+	case b.batch < 1 || b.batch > benchMaxBatch:
+		return nil, fmt.Errorf("--batch must be between 1 and %d", benchMaxBatch)
+	case b.rate < 0:
+		return nil, fmt.Errorf("--rate must not be negative")
+	}
+	suite, err := router.ParseCipherSuite(ctx.String("cipher-suite"))
+	if err != nil {
+		return nil, err
+	}
+	var secret [32]byte
+	var backendAddrs []netip.AddrPort
+	if ctx.IsSet("router") {
+		if !ctx.IsSet("key") || !ctx.IsSet("backend") {
+			return nil, fmt.Errorf("--router requires --key and --backend")
+		}
+		b.routerAddr, err = netip.ParseAddrPort(ctx.String("router"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse router address: %s", err)
+		}
+		key, err := parseKey(ctx.String("key"))
+		if err != nil {
+			return nil, err
+		}
+		secret = *key
+		for _, s := range ctx.StringSlice("backend") {
+			addr, err := netip.ParseAddrPort(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse backend address: %s", err)
+			}
+			backendAddrs = append(backendAddrs, addr)
+		}
+	} else {
+		if ctx.Int("backends") < 1 {
+			return nil, fmt.Errorf("--backends must be at least 1")
+		}
+		secret = *generateKey()
+		for i := 0; i < ctx.Int("backends"); i++ {
+			backendAddrs = append(backendAddrs, netip.MustParseAddrPort("127.0.0.1:0"))
+		}
+	}
+	for _, addr := range backendAddrs {
+		conn, err := listenBench(addr)
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		addr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		backend := &benchBackend{conn: conn}
+		b.backends = append(b.backends, backend)
+		serverKey, err := router.DeriveServerKeyFromAddr(secret, addr, suite)
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		backend.packer, err = router.NewNonQuicPrefixClientIDExtHdrPacker(serverKey.Secret, serverKey.CipherSuite)
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	if !ctx.IsSet("router") {
+		conn, err := listenBench(netip.MustParseAddrPort("127.0.0.1:0"))
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		b.routerAddr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		addrs := make([]netip.AddrPort, 0, len(b.backends))
+		for _, backend := range b.backends {
+			addrs = append(addrs, backend.conn.LocalAddr().(*net.UDPAddr).AddrPort())
+		}
+		b.router, err = router.NewRouter(conn, secret, addrs[0], &router.Config{
+			CipherSuite: suite,
+			Backends:    addrs[1:],
+			Logger:      log.New(io.Discard, "", 0),
+		})
+		if err != nil {
+			_ = conn.Close()
+			b.close()
+			return nil, err
+		}
+	}
+	protector, err := router.NewConnIDProtector(secret, suite)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	for _, backend := range b.backends {
+		addr := backend.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		generator, err := router.NewConnIDGeneratorFromAddr(protector, addr, rand.Reader)
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		connID, err := generator.GenerateConnectionID()
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		b.connIDs = append(b.connIDs, connID.Bytes())
+	}
+	return b, nil
+}
+
+func listenBench(addr netip.AddrPort) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadBuffer(benchSocketBuffer)
+	return conn, nil
+}
+
+func (b *bench) close() {
+	if b.router != nil {
+		b.router.Stop(nil)
+		<-b.router.Closed()
+	}
+	for _, backend := range b.backends {
+		_ = backend.conn.Close()
+	}
+}
+
+// run sends from new clients for the duration and waits for the remaining datagrams
+func (b *bench) run(offload bool) (*benchResult, error) {
+	// the clients listen on the address the router sends to
+	probe, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(b.routerAddr))
+	if err != nil {
+		return nil, err
+	}
+	localAddr := probe.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	_ = probe.Close()
+	var clients []*net.UDPConn
+	defer func() {
+		for _, conn := range clients {
+			_ = conn.Close()
+		}
+	}()
+	var clientAddrs []netip.AddrPort
+	for i := 0; i < b.clients; i++ {
+		conn, err := listenBench(netip.AddrPortFrom(localAddr, 0))
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, conn)
+		clientAddrs = append(clientAddrs, conn.LocalAddr().(*net.UDPAddr).AddrPort())
+	}
+	conns := clients
+	for _, backend := range b.backends {
+		conns = append(conns, backend.conn)
+	}
+	if offload {
+		if !socketoob.IsGSOSupported(clients[0]) || !socketoob.IsGROSupported(clients[0]) {
+			return nil, fmt.Errorf("GSO or GRO is not supported")
+		}
+		for _, conn := range conns {
+			if err := socketoob.EnableGRO(conn); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := &benchResult{}
+	var receivers sync.WaitGroup
+	for _, conn := range clients {
+		receivers.Add(1)
+		go func(conn *net.UDPConn) {
+			defer receivers.Done()
+			b.receive(conn, nil, nil, offload, result)
+		}(conn)
+	}
+	for _, backend := range b.backends {
+		receivers.Add(1)
+		go func(backend *benchBackend) {
+			defer receivers.Done()
+			b.receive(backend.conn, backend, clientAddrs, offload, result)
+		}(backend)
+	}
+	start := time.Now()
+	deadline := start.Add(b.duration)
+	var senders sync.WaitGroup
+	for i, conn := range clients {
+		senders.Add(1)
+		go func(client int, conn *net.UDPConn) {
+			defer senders.Done()
+			b.send(conn, uint16(client), offload, deadline, result)
+		}(i, conn)
+	}
+	senders.Wait()
+	result.elapsed = time.Since(start)
+	time.Sleep(benchDrainTime)
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	receivers.Wait()
+	for _, backend := range b.backends {
+		_ = backend.conn.SetReadDeadline(time.Time{})
+	}
+	return result, result.err
+}
+
+// send sends Initials and short header packets to the router until the deadline
+func (b *bench) send(conn *net.UDPConn, client uint16, offload bool, deadline time.Time, result *benchResult) {
+	rng := mathrand.New(mathrand.NewSource(int64(client)))
+	batch := 1
+	if offload {
+		batch = b.batch
+	}
+	var interval time.Duration
+	if b.rate != 0 {
+		interval = time.Duration(float64(time.Second) * float64(batch*b.clients) / b.rate)
+	}
+	buf := make([]byte, 0, batch*b.size)
+	var counts benchCounts
+	var seq uint64
+	next := time.Now()
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		if interval != 0 {
+			if now.Before(next) {
+				time.Sleep(next.Sub(now))
+			}
+			next = next.Add(interval)
+		}
+		buf = buf[:0]
+		for i := 0; i < batch; i++ {
+			kind := benchShortHeader
+			if rng.Float64() < b.initialShare {
+				kind = benchInitial
+			}
+			buf = b.appendDatagram(buf, kind, client, seq)
+			counts.sent[kind]++
+			seq++
+		}
+		var err error
+		if batch == 1 {
+			_, err = conn.WriteToUDPAddrPort(buf, b.routerAddr)
+		} else {
+			_, _, err = socketoob.WriteGSO(conn, buf, uint16(b.size), b.routerAddr, nil)
+		}
+		if err != nil {
+			counts.err = err
+			break
+		}
+	}
+	result.add(&counts)
+}
+
+// appendDatagram appends a datagram of the configured size.
+// Initials have unique destination connection IDs, so they are spread over the backends like new connections.
+func (b *bench) appendDatagram(buf []byte, kind benchKind, client uint16, seq uint64) []byte {
+	start := len(buf)
+	switch kind {
+	case benchInitial:
+		connID := uint64(client)<<48 | seq
+		buf = append(buf, 0xc0) // long header, Initial
+		buf = binary.BigEndian.AppendUint32(buf, router.Version1)
+		buf = append(buf, 8)
+		buf = binary.BigEndian.AppendUint64(buf, connID)
+		buf = append(buf, 8)
+		buf = binary.BigEndian.AppendUint64(buf, connID)
+		buf = append(buf, 0) // no token
+		buf = quicvarint.AppendWithLen(buf, uint64(b.size-(len(buf)-start)-2), 2)
+	case benchShortHeader:
+		buf = append(buf, 0x40)
+		buf = append(buf, b.connIDs[seq%uint64(len(b.connIDs))]...)
+	case benchReturn:
+		// the connection ID of the client is not checked
+		buf = append(buf, 0x40)
+		buf = append(buf, benchPadding[:router.ConnIDLen]...)
+	}
+	buf = append(buf, benchPadding[:b.size-(len(buf)-start)-benchTrailerLen]...)
+	buf = append(buf, byte(kind))
+	buf = binary.BigEndian.AppendUint16(buf, client)
+	return binary.BigEndian.AppendUint64(buf, uint64(time.Since(b.start)))
+}
+
+// receive counts the datagrams until the read deadline.
+// Backends answer short header packets with a return packet to the client.
+func (b *bench) receive(conn *net.UDPConn, backend *benchBackend, clientAddrs []netip.AddrPort, offload bool, result *benchResult) {
+	gro := socketoob.IsGROEnabled(conn)
+	buf := make([]byte, socketoob.MaxGSOBufSize)
+	var counts benchCounts
+	// answers are sent in batches of datagrams of the same size
+	var answers []byte
+	var numAnswers, answerLen int
+	flush := func() {
+		if numAnswers == 0 {
+			return
+		}
+		var err error
+		if offload && numAnswers > 1 {
+			_, _, err = socketoob.WriteGSO(conn, answers, uint16(answerLen), b.routerAddr, nil)
+		} else {
+			for i := 0; i < numAnswers && err == nil; i++ {
+				_, err = conn.WriteToUDPAddrPort(answers[i*answerLen:(i+1)*answerLen], b.routerAddr)
+			}
+		}
+		if err != nil && counts.err == nil {
+			counts.err = err
+		}
+		answers, numAnswers = answers[:0], 0
+	}
+	handle := func(datagram []byte) {
+		if len(datagram) < benchTrailerLen {
+			return
+		}
+		trailer := datagram[len(datagram)-benchTrailerLen:]
+		kind, client := benchKind(trailer[0]), binary.BigEndian.Uint16(trailer[1:])
+		if kind >= numBenchKinds {
+			return
+		}
+		latency := time.Since(b.start) - time.Duration(binary.BigEndian.Uint64(trailer[3:]))
+		counts.received[kind]++
+		counts.latencies[kind] = append(counts.latencies[kind], uint32(min(latency, math.MaxUint32)))
+		if backend == nil || kind != benchShortHeader || int(client) >= len(clientAddrs) {
+			return
+		}
+		var packet [router.MTU]byte
+		answer, err := backend.packer.AddHdr(b.appendDatagram(packet[:0], benchReturn, client, 0), clientAddrs[client])
+		if err != nil {
+			if counts.err == nil {
+				counts.err = err
+			}
+			return
+		}
+		answers = append(answers, answer...)
+		answerLen = len(answer)
+		numAnswers++
+		counts.sent[benchReturn]++
+		if !offload || numAnswers == b.batch {
+			flush()
+		}
+	}
+	for {
+		if gro {
+			segments, _, _, _, err := socketoob.ReadGRO(conn, buf, nil)
+			if err != nil {
+				break
+			}
+			it := segments.Iterator()
+			for it.HasNext() {
+				handle(it.Next())
+			}
+		} else {
+			n, _, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				break
+			}
+			handle(buf[:n])
+		}
+		flush()
+	}
+	result.add(&counts)
+}
+
+// benchCounts are counted by one sender or receiver
+type benchCounts struct {
+	sent     [numBenchKinds]uint64
+	received [numBenchKinds]uint64
+	// latencies in nanoseconds
+	latencies [numBenchKinds][]uint32
+	err       error
+}
+
+type benchResult struct {
+	mu sync.Mutex
+	benchCounts
+	// elapsed is the send time of the clients
+	elapsed time.Duration
+}
+
+func (r *benchResult) add(c *benchCounts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for kind := range c.sent {
+		r.sent[kind] += c.sent[kind]
+		r.received[kind] += c.received[kind]
+		r.latencies[kind] = append(r.latencies[kind], c.latencies[kind]...)
+	}
+	if r.err == nil {
+		r.err = c.err
+	}
+}
+
+func (r *benchResult) print(w io.Writer, offload bool) {
+	state := "off"
+	if offload {
+		state = "on"
+	}
+	clientSent := r.sent[benchInitial] + r.sent[benchShortHeader]
+	fmt.Fprintf(w, "\noffload %s: clients sent %d datagrams in %s (%.0f/s)\n", state, clientSent, r.elapsed.Round(time.Millisecond), float64(clientSent)/r.elapsed.Seconds())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "traffic\tsent\treceived\tdropped\treceived/s\tp50\tp90\tp99\tp99.9\tmax\t")
+	for kind := benchKind(0); kind < numBenchKinds; kind++ {
+		latencies := r.latencies[kind]
+		slices.Sort(latencies)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.0f\t%s\t%s\t%s\t%s\t%s\t\n", kind, r.sent[kind], r.received[kind], r.sent[kind]-min(r.received[kind], r.sent[kind]),
+			float64(r.received[kind])/r.elapsed.Seconds(),
+			benchPercentile(latencies, 0.5), benchPercentile(latencies, 0.9), benchPercentile(latencies, 0.99), benchPercentile(latencies, 0.999), benchPercentile(latencies, 1))
+	}
+	_ = tw.Flush()
+}
+
+// benchPercentile of the sorted latencies
+func benchPercentile(latencies []uint32, p float64) string {
+	if len(latencies) == 0 {
+		return "-"
+	}
+	i := int(math.Ceil(p*float64(len(latencies)))) - 1
+	return time.Duration(latencies[max(i, 0)]).Round(100 * time.Nanosecond).String()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"testing"
+	"time"
+)
+
+func TestBenchAppendDatagram(t *testing.T) {
+	connIDs := [][]byte{make([]byte, router.ConnIDLen), make([]byte, router.ConnIDLen)}
+	connIDs[1][0] = 1
+	b := &bench{size: 1200, connIDs: connIDs, start: time.Now()}
+	for kind := benchKind(0); kind < numBenchKinds; kind++ {
+		datagram := b.appendDatagram([]byte{0xff}, kind, 7, 3)[1:]
+		require.Len(t, datagram, b.size, kind)
+		trailer := datagram[len(datagram)-benchTrailerLen:]
+		assert.Equal(t, kind, benchKind(trailer[0]))
+		assert.Equal(t, uint16(7), binary.BigEndian.Uint16(trailer[1:]))
+		switch kind {
+		case benchInitial:
+			assert.Equal(t, byte(0xc0), datagram[0])
+			assert.Equal(t, router.Version1, binary.BigEndian.Uint32(datagram[1:]))
+			destConnID := datagram[6 : 6+datagram[5]]
+			assert.Equal(t, uint64(7)<<48|3, binary.BigEndian.Uint64(destConnID))
+			rest := datagram[6+len(destConnID):]
+			rest = rest[1+rest[0]:] // source connection ID
+			require.Zero(t, rest[0], "token length")
+			r := bytes.NewReader(rest[1:])
+			length, err := quicvarint.Read(r)
+			require.NoError(t, err)
+			// the packet fills the datagram
+			assert.Equal(t, r.Len(), int(length))
+		case benchShortHeader:
+			assert.Equal(t, byte(0x40), datagram[0])
+			assert.Equal(t, connIDs[1], datagram[1:1+router.ConnIDLen])
+		case benchReturn:
+			assert.Equal(t, byte(0x40), datagram[0])
+			assert.Equal(t, make([]byte, router.ConnIDLen), datagram[1:1+router.ConnIDLen])
+		}
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	assert.Equal(t, "-", benchPercentile(nil, 0.5))
+	latencies := []uint32{1000, 2000, 3000, 4000, 5000, 6000, 7000, 8000, 9000, 10000}
+	assert.Equal(t, "1µs", benchPercentile(latencies, 0))
+	assert.Equal(t, "5µs", benchPercentile(latencies, 0.5))
+	assert.Equal(t, "9µs", benchPercentile(latencies, 0.9))
+	assert.Equal(t, "10µs", benchPercentile(latencies, 0.99))
+	assert.Equal(t, "10µs", benchPercentile(latencies, 1))
+	assert.Equal(t, "1.2µs", benchPercentile([]uint32{1234}, 0.5))
+}
+
+func TestBenchInProcess(t *testing.T) {
+	var result *benchResult
+	app := &cli.App{Name: "quic-router-go", Commands: []*cli.Command{{
+		Name:  "bench",
+		Flags: benchCommand.Flags,
+		Action: func(ctx *cli.Context) error {
+			b, err := newBench(ctx)
+			if err != nil {
+				return err
+			}
+			defer b.close()
+			result, err = b.run(false)
+			return err
+		},
+	}}}
+	require.NoError(t, app.Run([]string{"quic-router-go", "bench", "--duration", "100ms", "--offload", "off", "--rate", "2000", "--clients", "4", "--backends", "2", "--initial-share", "0.5"}))
+	require.NotNil(t, result)
+	for kind := benchKind(0); kind < numBenchKinds; kind++ {
+		assert.NotZero(t, result.received[kind], kind)
+		assert.Equal(t, result.sent[kind], result.received[kind], kind)
+		assert.Len(t, result.latencies[kind], int(result.received[kind]))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"os"
+)
+
+// startCapture captures the datagrams of the routers to a pcapng file,
+// filterExpr is a router.CaptureFilter, all datagrams are captured if it is empty
+func startCapture(routers []*router.Router, path string, filterExpr string) (*router.Capture, error) {
+	var filter *router.CaptureFilter
+	if filterExpr != "" {
+		var err error
+		filter, err = router.ParseCaptureFilter(filterExpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c, err := router.NewCapture(f, filter)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	for i, r := range routers {
+		if err := r.StartCapture(c); err != nil {
+			for _, started := range routers[:i] {
+				started.StopCapture()
+			}
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// stopCaptures stops and closes the captures of the routers
+func stopCaptures(routers []*router.Router) {
+	for _, r := range routers {
+		if c := r.StopCapture(); c != nil {
+			if err := c.Close(); err != nil {
+				fmt.Printf("failed to write capture: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configFile is the schema of the YAML config file, unknown fields are rejected.
+//
+//	metrics:
+//	  addr: 127.0.0.1:9090
+//	logging:
+//	  file: /var/log/quic-router.log
+//	  timestamps: true
+//	tenants:
+//	  - name: web
+//	    key_file: /etc/quic-router/web.key
+//	    listen: ["192.0.2.1:443"]
+//	    backends: ["10.0.0.1:4433", "10.0.0.2:4433"]
+//	    pools:
+//	      api:
+//	        backends: ["10.0.1.1:4433"]
+//	        selection: least-loaded
+//	    rules:
+//	      - server_name: api.example.com
+//	        pool: api
+//	    health_check:
+//	      interval: 1s
+//	    limits:
+//	      stateless_reset_rate: 100
+//	      rate_limit:
+//	        prefix_rate: 50
+//	        initial_rate: 10000
+//	        action: retry
+//	        retry_rate: 1000
+//	      abuse_detection:
+//	        invalid_conn_id_rate: 100
+//	        block_duration: 5m
+type configFile struct {
+	Metrics metricsConfig  `yaml:"metrics"`
+	Logging loggingConfig  `yaml:"logging"`
+	Tenants []tenantConfig `yaml:"tenants"`
+}
+
+type metricsConfig struct {
+	// Addr serves the metrics via HTTP, empty disables it
+	Addr string `yaml:"addr"`
+}
+
+type loggingConfig struct {
+	// File the log is appended to, empty logs to stdout
+	File       string `yaml:"file"`
+	Timestamps bool   `yaml:"timestamps"`
+}
+
+type tenantConfig struct {
+	// Name may only be empty if there is a single tenant
+	Name string `yaml:"name"`
+	// Key or KeyFile is required, the file contains the base64 encoded key
+	Key          *keyValue                `yaml:"key"`
+	KeyFile      string                   `yaml:"key_file"`
+	CipherSuite  *cipherSuiteValue        `yaml:"cipher_suite"`
+	Listen       []addrPortValue          `yaml:"listen"`
+	QUICVersions []uint32                 `yaml:"quic_versions"`
+	Backends     []addrPortValue          `yaml:"backends"`
+	Selection    selectionValue           `yaml:"selection"`
+	Weights      map[addrPortValue]uint32 `yaml:"weights"`
+	SlowStart    time.Duration            `yaml:"slow_start"`
+	Mirror       *mirrorConfig            `yaml:"mirror"`
+	Pools        map[string]poolConfig    `yaml:"pools"`
+	Splits       []splitConfig            `yaml:"splits"`
+	Rules        []ruleConfig             `yaml:"rules"`
+	HealthCheck  *healthCheckConfig       `yaml:"health_check"`
+	Retry        *retryConfig             `yaml:"retry"`
+	Limits       limitsConfig             `yaml:"limits"`
+}
+
+type poolConfig struct {
+	Backends  []addrPortValue `yaml:"backends"`
+	Selection selectionValue  `yaml:"selection"`
+	Mirror    *mirrorConfig   `yaml:"mirror"`
+}
+
+type mirrorConfig struct {
+	Shadow   addrPortValue `yaml:"shadow"`
+	Fraction float64       `yaml:"fraction"`
+}
+
+type splitConfig struct {
+	Pool     string  `yaml:"pool"`
+	Canary   string  `yaml:"canary"`
+	Fraction float64 `yaml:"fraction"`
+}
+
+type ruleConfig struct {
+	Source      []prefixValue      `yaml:"source"`
+	Destination addrPortValue      `yaml:"destination"`
+	Versions    []uint32           `yaml:"versions"`
+	ServerName  string             `yaml:"server_name"`
+	ALPN        string             `yaml:"alpn"`
+	Action      routingActionValue `yaml:"action"`
+	Pool        string             `yaml:"pool"`
+}
+
+type healthCheckConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Rise     int           `yaml:"rise"`
+	Fall     int           `yaml:"fall"`
+}
+
+type retryConfig struct {
+	Always               bool          `yaml:"always"`
+	InitialRateThreshold uint64        `yaml:"initial_rate_threshold"`
+	TokenLifetime        time.Duration `yaml:"token_lifetime"`
+}
+
+type limitsConfig struct {
+	StatelessResetRate float64          `yaml:"stateless_reset_rate"`
+	RateLimit          *rateLimitConfig `yaml:"rate_limit"`
+	AbuseDetection     *abuseConfig     `yaml:"abuse_detection"`
+}
+
+type abuseConfig struct {
+	InvalidConnIDRate float64       `yaml:"invalid_conn_id_rate"`
+	InvalidExtHdrRate float64       `yaml:"invalid_ext_hdr_rate"`
+	IPv4PrefixLen     int           `yaml:"ipv4_prefix_len"`
+	IPv6PrefixLen     int           `yaml:"ipv6_prefix_len"`
+	BlockDuration     time.Duration `yaml:"block_duration"`
+	MaxBlocked        int           `yaml:"max_blocked"`
+}
+
+type rateLimitConfig struct {
+	PrefixRate    float64              `yaml:"prefix_rate"`
+	PrefixBurst   float64              `yaml:"prefix_burst"`
+	IPv4PrefixLen int                  `yaml:"ipv4_prefix_len"`
+	IPv6PrefixLen int                  `yaml:"ipv6_prefix_len"`
+	InitialRate   float64              `yaml:"initial_rate"`
+	InitialBurst  float64              `yaml:"initial_burst"`
+	Action        rateLimitActionValue `yaml:"action"`
+	RetryRate     float64              `yaml:"retry_rate"`
+}
+
+// decodeScalar parses a scalar value, errors name the line of the value
+func decodeScalar[T any](value *yaml.Node, parse func(string) (T, error)) (T, error) {
+	var zero T
+	if value.Kind != yaml.ScalarNode {
+		return zero, fmt.Errorf("line %d: expected a single value", value.Line)
+	}
+	v, err := parse(value.Value)
+	if err != nil {
+		return zero, fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	return v, nil
+}
+
+type addrPortValue struct{ netip.AddrPort }
+
+func (v *addrPortValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.AddrPort, err = decodeScalar(value, netip.ParseAddrPort)
+	return err
+}
+
+type prefixValue struct{ netip.Prefix }
+
+func (v *prefixValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.Prefix, err = decodeScalar(value, netip.ParsePrefix)
+	return err
+}
+
+type keyValue struct{ key [32]byte }
+
+func (v *keyValue) UnmarshalYAML(value *yaml.Node) error {
+	key, err := decodeScalar(value, parseKey)
+	if err != nil {
+		return err
+	}
+	v.key = *key
+	return nil
+}
+
+type cipherSuiteValue struct{ router.CipherSuite }
+
+func (v *cipherSuiteValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.CipherSuite, err = decodeScalar(value, router.ParseCipherSuite)
+	return err
+}
+
+type selectionValue struct{ router.SelectionStrategy }
+
+func (v *selectionValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.SelectionStrategy, err = decodeScalar(value, router.ParseSelectionStrategy)
+	return err
+}
+
+type routingActionValue struct{ router.RoutingAction }
+
+func (v *routingActionValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.RoutingAction, err = decodeScalar(value, router.ParseRoutingAction)
+	return err
+}
+
+type rateLimitActionValue struct{ router.RateLimitAction }
+
+func (v *rateLimitActionValue) UnmarshalYAML(value *yaml.Node) (err error) {
+	v.RateLimitAction, err = decodeScalar(value, router.ParseRateLimitAction)
+	return err
+}
+
+// loadedConfig is a validated config file
+type loadedConfig struct {
+	tenants     []router.TenantConfig
+	metricsAddr string
+	// logFile is nil if the log is written to stdout
+	logFile *os.File
+	// logger writes the messages of the process, e.g. about reloads, to the log of the config
+	logger *log.Logger
+}
+
+// close closes the log file
+func (c *loadedConfig) close() {
+	if c.logFile != nil {
+		_ = c.logFile.Close()
+	}
+}
+
+// readConfigFile parses the config file without opening the log file
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f configFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&f); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: empty config", path)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(f.Tenants) == 0 {
+		return nil, fmt.Errorf("%s: no tenants", path)
+	}
+	return &f, nil
+}
+
+// loadConfigFile reads and validates the config file.
+// The routers of the tenants are validated when they are created.
+func loadConfigFile(path string) (*loadedConfig, error) {
+	f, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &loadedConfig{metricsAddr: f.Metrics.Addr}
+	var logWriter io.Writer = os.Stdout
+	if f.Logging.File != "" {
+		c.logFile, err = os.OpenFile(f.Logging.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("%s: logging: %w", path, err)
+		}
+		logWriter = c.logFile
+	}
+	logFlags := 0
+	if f.Logging.Timestamps {
+		logFlags = log.LstdFlags
+	}
+	c.logger = log.New(logWriter, "", logFlags)
+	for i, t := range f.Tenants {
+		if t.Name == "" && len(f.Tenants) > 1 {
+			c.close()
+			return nil, fmt.Errorf("%s: tenant %d: name is required with several tenants", path, i+1)
+		}
+		tenant, err := t.toTenantConfig()
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("%s: tenant %q: %w", path, t.Name, err)
+		}
+		prefix := ""
+		if t.Name != "" {
+			prefix = t.Name + ": "
+		}
+		tenant.Config.Logger = log.New(logWriter, prefix, logFlags)
+		c.tenants = append(c.tenants, tenant)
+	}
+	return c, nil
+}
+
+func (t *tenantConfig) toTenantConfig() (router.TenantConfig, error) {
+	var c router.TenantConfig
+	switch {
+	case t.Key != nil && t.KeyFile != "":
+		return c, fmt.Errorf("key and key_file are exclusive")
+	case t.Key != nil:
+		c.Secret = t.Key.key
+	case t.KeyFile != "":
+		data, err := os.ReadFile(t.KeyFile)
+		if err != nil {
+			return c, err
+		}
+		key, err := parseKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", t.KeyFile, err)
+		}
+		c.Secret = *key
+	default:
+		return c, fmt.Errorf("key or key_file is required")
+	}
+	for _, addr := range t.Listen {
+		c.Listen = append(c.Listen, addr.AddrPort)
+	}
+	if len(c.Listen) == 0 {
+		c.Listen = []netip.AddrPort{netip.AddrPortFrom(netip.IPv6Unspecified(), DefaultPort)}
+	}
+	config := &router.Config{
+		Name:               t.Name,
+		SupportedVersions:  t.QUICVersions,
+		Backends:           addrPorts(t.Backends),
+		Selection:          t.Selection.SelectionStrategy,
+		Mirror:             t.Mirror.toMirrorConfig(),
+		SlowStart:          t.SlowStart,
+		StatelessResetRate: t.Limits.StatelessResetRate,
+	}
+	if t.CipherSuite != nil {
+		config.CipherSuite = t.CipherSuite.CipherSuite
+	}
+	if len(t.Weights) != 0 {
+		config.BackendWeights = map[netip.AddrPort]uint32{}
+		for addr, weight := range t.Weights {
+			config.BackendWeights[addr.AddrPort] = weight
+		}
+	}
+	if len(t.Pools) != 0 {
+		config.Pools = map[string]router.PoolConfig{}
+		for name, p := range t.Pools {
+			if name == router.DefaultPool {
+				return c, fmt.Errorf("pool name must not be empty")
+			}
+			config.Pools[name] = router.PoolConfig{
+				Backends:  addrPorts(p.Backends),
+				Selection: p.Selection.SelectionStrategy,
+				Mirror:    p.Mirror.toMirrorConfig(),
+			}
+		}
+	}
+	for _, s := range t.Splits {
+		config.Splits = append(config.Splits, router.SplitRule{Pool: s.Pool, Canary: s.Canary, Fraction: s.Fraction})
+	}
+	for _, r := range t.Rules {
+		rule := router.RoutingRule{
+			Destination: r.Destination.AddrPort,
+			Versions:    r.Versions,
+			ServerName:  r.ServerName,
+			ALPN:        r.ALPN,
+			Action:      r.Action.RoutingAction,
+			Pool:        r.Pool,
+		}
+		for _, prefix := range r.Source {
+			rule.SourcePrefixes = append(rule.SourcePrefixes, prefix.Prefix)
+		}
+		config.RoutingRules = append(config.RoutingRules, rule)
+	}
+	if t.HealthCheck != nil {
+		config.HealthCheck = &router.HealthCheckConfig{
+			Interval: t.HealthCheck.Interval,
+			Rise:     t.HealthCheck.Rise,
+			Fall:     t.HealthCheck.Fall,
+		}
+	}
+	if t.Retry != nil {
+		config.Retry = &router.RetryConfig{
+			Always:               t.Retry.Always,
+			InitialRateThreshold: t.Retry.InitialRateThreshold,
+			TokenLifetime:        t.Retry.TokenLifetime,
+		}
+	}
+	if l := t.Limits.RateLimit; l != nil {
+		config.RateLimit = &router.RateLimitConfig{
+			PrefixRate:    l.PrefixRate,
+			PrefixBurst:   l.PrefixBurst,
+			IPv4PrefixLen: l.IPv4PrefixLen,
+			IPv6PrefixLen: l.IPv6PrefixLen,
+			InitialRate:   l.InitialRate,
+			InitialBurst:  l.InitialBurst,
+			Action:        l.Action.RateLimitAction,
+			RetryRate:     l.RetryRate,
+		}
+	}
+	if a := t.Limits.AbuseDetection; a != nil {
+		config.AbuseDetection = &router.AbuseDetectionConfig{
+			InvalidConnIDRate: a.InvalidConnIDRate,
+			InvalidExtHdrRate: a.InvalidExtHdrRate,
+			IPv4PrefixLen:     a.IPv4PrefixLen,
+			IPv6PrefixLen:     a.IPv6PrefixLen,
+			BlockDuration:     a.BlockDuration,
+			MaxBlocked:        a.MaxBlocked,
+		}
+	}
+	c.Config = config
+	return c, nil
+}
+
+func (m *mirrorConfig) toMirrorConfig() *router.MirrorConfig {
+	if m == nil {
+		return nil
+	}
+	return &router.MirrorConfig{Shadow: m.Shadow.AddrPort, Fraction: m.Fraction}
+}
+
+func addrPorts(values []addrPortValue) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(values))
+	for _, v := range values {
+		addrs = append(addrs, v.AddrPort)
+	}
+	return addrs
+}
+
+// configPollInterval is the interval the config file is checked for changes
+const configPollInterval = time.Second
+
+// runConfigFile runs the tenants of the config file until they are stopped.
+// The config file is reloaded on SIGHUP and when it changes.
+// Invalid configs are rejected and the current config remains in use.
+func runConfigFile(ctx *cli.Context, path string) error {
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	metrics := &metricsServer{}
+	ln, err := metrics.listen(config.metricsAddr)
+	if err != nil {
+		config.close()
+		return fmt.Errorf("failed to serve metrics: %w", err)
+	}
+	tenants, err := router.NewTenants(config.tenants)
+	if err != nil {
+		config.close()
+		if ln != nil {
+			_ = ln.Close()
+		}
+		return err
+	}
+	if ctx.IsSet("capture") {
+		_, err = startCapture(tenants.Routers(), ctx.String("capture"), ctx.String("capture-filter"))
+	}
+	var admin *adminServer
+	if err == nil {
+		admin, err = startAdminServer(tenants, ctx.String("admin-socket"), ctx.String("admin-addr"), ctx.String("admin-token"), ctx.String("capture-dir"))
+	}
+	if err != nil {
+		tenants.Stop(nil)
+		<-tenants.Closed()
+		stopCaptures(tenants.Routers())
+		config.close()
+		if ln != nil {
+			_ = ln.Close()
+		}
+		return err
+	}
+	defer admin.close()
+	// routers of later configs take over the capture
+	defer func() { stopCaptures(tenants.Routers()) }()
+	printListeners(config)
+	expvar.Publish("tenants", tenants.Metrics())
+	metrics.serve(config.metricsAddr, ln)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		lastStat, _ := os.Stat(path)
+		for {
+			select {
+			case <-tenants.Closed():
+				metrics.close()
+				config.close()
+				return
+			case <-hup:
+			case <-ticker.C:
+				stat, err := os.Stat(path)
+				if err != nil || (lastStat != nil && stat.ModTime().Equal(lastStat.ModTime()) && stat.Size() == lastStat.Size()) {
+					continue
+				}
+			}
+			lastStat, _ = os.Stat(path)
+			newConfig, err := reloadConfigFile(path, tenants, metrics)
+			if err != nil {
+				config.logger.Printf("rejected config: %s; keeping the current config\n", err)
+				continue
+			}
+			config.close()
+			config = newConfig
+			printListeners(config)
+			config.logger.Printf("reloaded config %s\n", path)
+		}
+	}()
+	handleStopSignals(tenants, ctx.Duration("shutdown-grace-period"))
+	<-tenants.Closed()
+	<-done
+	return nil
+}
+
+// reloadConfigFile applies the config file, or returns an error if the config is invalid
+func reloadConfigFile(path string, tenants *router.Tenants, metrics *metricsServer) (*loadedConfig, error) {
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := metrics.listen(config.metricsAddr)
+	if err != nil {
+		config.close()
+		return nil, fmt.Errorf("failed to serve metrics: %w", err)
+	}
+	if err := tenants.Reload(config.tenants); err != nil {
+		config.close()
+		if ln != nil {
+			_ = ln.Close()
+		}
+		return nil, err
+	}
+	metrics.serve(config.metricsAddr, ln)
+	return config, nil
+}
+
+func printListeners(config *loadedConfig) {
+	for _, t := range config.tenants {
+		for _, addr := range t.Listen {
+			if t.Config.Name == "" {
+				fmt.Printf("listen on %s\n", addr)
+			} else {
+				fmt.Printf("tenant %q listens on %s\n", t.Config.Name, addr)
+			}
+		}
+	}
+}
+
+// metricsServer serves the published metrics, its address can change on reload
+type metricsServer struct {
+	addr   string
+	server *http.Server
+}
+
+// listen binds the address, if it is not empty and differs from the current address
+func (m *metricsServer) listen(addr string) (net.Listener, error) {
+	if addr == m.addr || addr == "" {
+		return nil, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve replaces the server if the address changed, ln is returned by listen
+func (m *metricsServer) serve(addr string, ln net.Listener) {
+	if addr == m.addr {
+		return
+	}
+	m.close()
+	m.addr = addr
+	if ln == nil {
+		return
+	}
+	m.server = &http.Server{}
+	go func(server *http.Server) {
+		_ = server.Serve(ln)
+	}(m.server)
+}
+
+func (m *metricsServer) close() {
+	if m.server != nil {
+		_ = m.server.Close()
+		m.server = nil
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+// writeConfigFile writes the config to a file of the test and returns its path
+func writeConfigFile(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey+"\n"), 0600))
+	tests := []struct {
+		name   string
+		config string
+		// err is contained in the error, empty if the config is valid
+		err string
+	}{
+		{
+			name: "valid",
+			config: `
+tenants:
+  - key: ` + testKey + `
+    listen: [127.0.0.1:4433]
+    backends: [192.168.0.2:4433]
+    limits:
+      rate_limit:
+        initial_rate: 100
+        action: retry
+        retry_rate: 10
+`,
+		},
+		{
+			name: "key file",
+			config: `
+tenants:
+  - key_file: ` + keyFile + `
+`,
+		},
+		{
+			name:   "empty",
+			config: "",
+			err:    "empty config",
+		},
+		{
+			name:   "no tenants",
+			config: "tenants: []\n",
+			err:    "no tenants",
+		},
+		{
+			name: "unknown field",
+			config: `
+tenants:
+  - key: ` + testKey + `
+    backend: [192.168.0.2:4433]
+`,
+			err: "line 4: field backend not found",
+		},
+		{
+			name: "invalid address",
+			config: `
+tenants:
+  - key: ` + testKey + `
+    backends:
+      - 192.168.0.2:4433
+      - 192.168.0.3
+`,
+			err: "line 6: ",
+		},
+		{
+			name: "invalid action",
+			config: `
+tenants:
+  - key: ` + testKey + `
+    limits:
+      rate_limit:
+        action: reject
+`,
+			err: `line 6: unknown rate limit action "reject"`,
+		},
+		{
+			name: "key and key file",
+			config: `
+tenants:
+  - key: ` + testKey + `
+    key_file: ` + keyFile + `
+`,
+			err: "key and key_file are exclusive",
+		},
+		{
+			name: "no key",
+			config: `
+tenants:
+  - listen: [127.0.0.1:4433]
+`,
+			err: "key or key_file is required",
+		},
+		{
+			name: "unnamed tenants",
+			config: `
+tenants:
+  - key: ` + testKey + `
+  - key: ` + testKey + `
+`,
+			err: "tenant 1: name is required with several tenants",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := loadConfigFile(writeConfigFile(t, test.config))
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			config.close()
+			assert.NotNil(t, config.logger)
+			require.Len(t, config.tenants, 1)
+			assert.Equal(t, [32]byte{}, config.tenants[0].Secret)
+		})
+	}
+}
+
+func TestToTenantConfig(t *testing.T) {
+	config, err := loadConfigFile(writeConfigFile(t, `
+tenants:
+  - name: web
+    key: `+testKey+`
+    listen: [127.0.0.1:4433]
+    backends: [192.168.0.2:4433]
+    weights:
+      192.168.0.2:4433: 3
+    slow_start: 30s
+    pools:
+      api:
+        backends: [192.168.0.3:4433]
+        selection: least-loaded
+    splits:
+      - pool: api
+        canary: canary
+        fraction: 0.1
+    rules:
+      - source: [192.0.2.0/24]
+        action: drop
+    limits:
+      stateless_reset_rate: 100
+      rate_limit:
+        prefix_rate: 50
+        action: retry
+        retry_rate: 10
+      abuse_detection:
+        invalid_conn_id_rate: 100
+        block_duration: 5m
+`))
+	require.NoError(t, err)
+	defer config.close()
+	require.Len(t, config.tenants, 1)
+	tenant := config.tenants[0]
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:4433")}, tenant.Listen)
+	c := tenant.Config
+	assert.Equal(t, "web", c.Name)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("192.168.0.2:4433")}, c.Backends)
+	assert.Equal(t, map[netip.AddrPort]uint32{netip.MustParseAddrPort("192.168.0.2:4433"): 3}, c.BackendWeights)
+	assert.Equal(t, 30*time.Second, c.SlowStart)
+	assert.Equal(t, router.SelectionLeastLoaded, c.Pools["api"].Selection)
+	assert.Equal(t, []router.SplitRule{{Pool: "api", Canary: "canary", Fraction: 0.1}}, c.Splits)
+	require.Len(t, c.RoutingRules, 1)
+	assert.Equal(t, router.RouteDrop, c.RoutingRules[0].Action)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, c.RoutingRules[0].SourcePrefixes)
+	assert.Equal(t, float64(100), c.StatelessResetRate)
+	assert.Equal(t, &router.RateLimitConfig{PrefixRate: 50, Action: router.RateLimitRetry, RetryRate: 10}, c.RateLimit)
+	assert.Equal(t, &router.AbuseDetectionConfig{InvalidConnIDRate: 100, BlockDuration: 5 * time.Minute}, c.AbuseDetection)
+	assert.NotNil(t, c.Logger)
+	// the default listen address
+	var empty tenantConfig
+	empty.Key = &keyValue{}
+	tenantConfig, err := empty.toTenantConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.AddrPortFrom(netip.IPv6Unspecified(), DefaultPort)}, tenantConfig.Listen)
+}
+
+func TestReloadConfigFileRejectsInvalidConfig(t *testing.T) {
+	valid := func(backend string) string {
+		return `
+tenants:
+  - key: ` + testKey + `
+    listen: [127.0.0.1:0]
+    backends: [` + backend + `]
+`
+	}
+	path := writeConfigFile(t, valid("192.168.0.2:4433"))
+	config, err := loadConfigFile(path)
+	require.NoError(t, err)
+	defer config.close()
+	tenants, err := router.NewTenants(config.tenants)
+	require.NoError(t, err)
+	defer func() {
+		tenants.Stop(nil)
+		<-tenants.Closed()
+	}()
+	metrics := &metricsServer{}
+	backends := func() []netip.AddrPort {
+		var addrs []netip.AddrPort
+		for _, b := range tenants.Routers()[0].Backends() {
+			addrs = append(addrs, b.Addr())
+		}
+		return addrs
+	}
+	require.Contains(t, backends(), netip.MustParseAddrPort("192.168.0.2:4433"))
+
+	for _, invalid := range []string{
+		// invalid YAML
+		strings.Replace(valid("192.168.0.3:4433"), "backends:", "backend:", 1),
+		// valid YAML, but the router rejects it
+		valid("192.168.0.3:4433") + "    splits: [{pool: '', canary: unknown, fraction: 1}]\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(invalid), 0600))
+		_, err = reloadConfigFile(path, tenants, metrics)
+		assert.Error(t, err)
+		// the current config remains in use
+		assert.Contains(t, backends(), netip.MustParseAddrPort("192.168.0.2:4433"))
+		assert.NotContains(t, backends(), netip.MustParseAddrPort("192.168.0.3:4433"))
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(valid("192.168.0.3:4433")), 0600))
+	newConfig, err := reloadConfigFile(path, tenants, metrics)
+	require.NoError(t, err)
+	defer newConfig.close()
+	assert.Contains(t, backends(), netip.MustParseAddrPort("192.168.0.3:4433"))
+	assert.NotContains(t, backends(), netip.MustParseAddrPort("192.168.0.2:4433"))
+}
+
+func TestConfigFileLogger(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "router.log")
+	config, err := loadConfigFile(writeConfigFile(t, `
+logging:
+  file: `+logFile+`
+tenants:
+  - key: `+testKey+`
+`))
+	require.NoError(t, err)
+	// messages about reloads are written to the configured log, not to stdout
+	config.logger.Printf("reloaded config\n")
+	config.close()
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Equal(t, "reloaded config\n", string(data))
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// adminClient sends requests to the admin API of a running router
+type adminClient struct {
+	client  *http.Client
+	baseURL string
+	token   string
+	tenant  string
+}
+
+func newAdminClient(ctx *cli.Context) *adminClient {
+	c := &adminClient{
+		client: &http.Client{},
+		token:  ctx.String("token"),
+		tenant: ctx.String("tenant"),
+	}
+	if ctx.IsSet("addr") {
+		c.baseURL = "http://" + ctx.String("addr")
+		return c
+	}
+	socketPath := ctx.String("socket")
+	c.baseURL = "http://admin"
+	c.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return c
+}
+
+// do sends the body as JSON and prints the JSON response
+func (c *adminClient) do(method string, path string, query url.Values, body any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.tenant != "" {
+		query.Set("tenant", c.tenant)
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path+"?"+query.Encode(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp adminErrorResponse
+		if json.Unmarshal(respBody, &errResp) == nil && errResp.Error != "" {
+			return fmt.Errorf("%s", errResp.Error)
+		}
+		return fmt.Errorf("admin API answered %s", resp.Status)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, respBody, "", "  "); err != nil {
+		return fmt.Errorf("failed to parse response: %s", err)
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// ctlArg returns the only argument of the command
+func ctlArg(ctx *cli.Context, name string) (string, error) {
+	if ctx.NArg() != 1 {
+		return "", fmt.Errorf("expected %s", name)
+	}
+	return ctx.Args().First(), nil
+}
+
+// ctlCommand talks to the admin API of a running router
+var ctlCommand = &cli.Command{
+	Name:  "ctl",
+	Usage: "inspect and control a running router using its admin API",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "socket",
+			Usage: "Unix socket of the admin API",
+			Value: defaultAdminSocket,
+		},
+		&cli.StringFlag{
+			Name:  "addr",
+			Usage: "TCP address of the admin API, e.g. 127.0.0.1:9091; overrides --socket",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "bearer token of the admin API on TCP",
+			EnvVars: []string{"QUIC_ROUTER_ADMIN_TOKEN"},
+		},
+		&cli.StringFlag{
+			Name:  "tenant",
+			Usage: "name of the tenant; can be omitted if there is only one tenant",
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "tenants",
+			Usage: "list the tenants and their listeners",
+			Action: func(ctx *cli.Context) error {
+				return newAdminClient(ctx).do(http.MethodGet, "/tenants", nil, nil)
+			},
+		},
+		{
+			Name:  "backends",
+			Usage: "list backends with their health and drain state",
+			Action: func(ctx *cli.Context) error {
+				return newAdminClient(ctx).do(http.MethodGet, "/backends", nil, nil)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add a backend",
+					ArgsUsage: "ADDRESS",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "pool",
+							Usage: "pool of the backend; the default pool if not set",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						addr, err := ctlArg(ctx, "backend address")
+						if err != nil {
+							return err
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/backends", nil, map[string]string{"addr": addr, "pool": ctx.String("pool")})
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a backend; its clients receive Stateless Resets, if enabled",
+					ArgsUsage: "ADDRESS",
+					Action: func(ctx *cli.Context) error {
+						addr, err := ctlArg(ctx, "backend address")
+						if err != nil {
+							return err
+						}
+						return newAdminClient(ctx).do(http.MethodDelete, "/backends", url.Values{"addr": {addr}}, nil)
+					},
+				},
+				{
+					Name:      "drain",
+					Usage:     "route no new connections to a backend",
+					ArgsUsage: "ADDRESS",
+					Flags: []cli.Flag{
+						&cli.DurationFlag{
+							Name:  "timeout",
+							Usage: "time after which packets of established connections are no longer forwarded; 0 means no timeout",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						addr, err := ctlArg(ctx, "backend address")
+						if err != nil {
+							return err
+						}
+						body := map[string]string{"addr": addr}
+						if ctx.Duration("timeout") != 0 {
+							body["timeout"] = ctx.Duration("timeout").String()
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/backends/drain", nil, body)
+					},
+				},
+				{
+					Name:      "undrain",
+					Usage:     "route new connections to a drained backend again",
+					ArgsUsage: "ADDRESS",
+					Action: func(ctx *cli.Context) error {
+						addr, err := ctlArg(ctx, "backend address")
+						if err != nil {
+							return err
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/backends/undrain", nil, map[string]string{"addr": addr})
+					},
+				},
+			},
+		},
+		{
+			Name:  "keys",
+			Usage: "rotate the key of connection IDs and extension headers",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "rotate",
+					Usage: "make a new key current; connections of the previous key continue until it is retired; prints the new key",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "key",
+							Usage: "new key; value must be 32 byte and base64 encoded; if not set a random key is generated",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						return newAdminClient(ctx).do(http.MethodPost, "/keys/rotate", nil, map[string]string{"key": ctx.String("key")})
+					},
+				},
+				{
+					Name:  "retire",
+					Usage: "stop accepting the previous key",
+					Action: func(ctx *cli.Context) error {
+						return newAdminClient(ctx).do(http.MethodPost, "/keys/retire", nil, nil)
+					},
+				},
+			},
+		},
+		{
+			Name:  "metrics",
+			Usage: "print the counters of the tenant",
+			Action: func(ctx *cli.Context) error {
+				return newAdminClient(ctx).do(http.MethodGet, "/metrics", nil, nil)
+			},
+		},
+		{
+			Name:  "debug",
+			Usage: "list the client prefixes whose packets are logged",
+			Action: func(ctx *cli.Context) error {
+				return newAdminClient(ctx).do(http.MethodGet, "/debug", nil, nil)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:      "enable",
+					Usage:     "log the routing decisions of packets of clients in the prefix",
+					ArgsUsage: "PREFIX",
+					Action: func(ctx *cli.Context) error {
+						prefix, err := ctlArg(ctx, "client prefix")
+						if err != nil {
+							return err
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/debug", nil, map[string]any{"prefix": prefix, "enabled": true})
+					},
+				},
+				{
+					Name:      "disable",
+					Usage:     "stop logging packets of clients in the prefix",
+					ArgsUsage: "PREFIX",
+					Action: func(ctx *cli.Context) error {
+						prefix, err := ctlArg(ctx, "client prefix")
+						if err != nil {
+							return err
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/debug", nil, map[string]any{"prefix": prefix, "enabled": false})
+					},
+				},
+			},
+		},
+		{
+			Name:  "capture",
+			Usage: "capture datagrams to a pcapng file annotated with the routing decisions",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "start",
+					Usage:     "start a capture, the file is written by the router to its --capture-dir",
+					ArgsUsage: "FILE",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "filter",
+							Usage: "capture only matching datagrams, e.g. \"client 192.0.2.0/24 or server 192.168.0.2:4433\"",
+						},
+						&cli.DurationFlag{
+							Name:  "duration",
+							Usage: "stop the capture after the duration; 0 captures until stop",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						file, err := ctlArg(ctx, "capture file")
+						if err != nil {
+							return err
+						}
+						body := map[string]string{"file": file, "filter": ctx.String("filter")}
+						if ctx.Duration("duration") != 0 {
+							body["duration"] = ctx.Duration("duration").String()
+						}
+						return newAdminClient(ctx).do(http.MethodPost, "/capture", nil, body)
+					},
+				},
+				{
+					Name:  "stop",
+					Usage: "stop the capture and print the number of captured datagrams",
+					Action: func(ctx *cli.Context) error {
+						return newAdminClient(ctx).do(http.MethodDelete, "/capture", nil, nil)
+					},
+				},
+			},
+		},
+		{
+			Name:  "shutdown",
+			Usage: "shut all tenants down",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "grace",
+					Usage: "time packets of established connections are still forwarded, while new connections are dropped; 0 stops immediately",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				body := map[string]string{}
+				if ctx.Duration("grace") != 0 {
+					body["grace"] = ctx.Duration("grace").String()
+				}
+				return newAdminClient(ctx).do(http.MethodPost, "/shutdown", nil, body)
+			},
+		},
+	},
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// applyDrainFile drains the backends listed in the file.
+// Every line contains a backend address and an optional timeout, e.g. "192.168.0.2:4433 5m",
+// after which packets of established connections are no longer forwarded.
+// Backends that are not listed are no longer drained, unless they announced that they are draining.
+// Backends that are already drained by an operator keep their deadline.
+// Empty lines and lines starting with # are ignored.
+func applyDrainFile(r *router.Router, path string, defaultTimeout time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	deadlines := map[netip.AddrPort]time.Time{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return fmt.Errorf("%s:%d: unexpected fields", path, lineNum)
+		}
+		addr, err := netip.ParseAddrPort(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineNum, err)
+		}
+		timeout := defaultTimeout
+		if len(fields) == 2 {
+			timeout, err = time.ParseDuration(fields[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, lineNum, err)
+			}
+		}
+		var deadline time.Time
+		if timeout != 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		deadlines[addr] = deadline
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, b := range r.Backends() {
+		deadline, drain := deadlines[b.Addr()]
+		if !drain {
+			if b.DrainedByOperator() {
+				_ = r.UndrainBackend(b.Addr())
+			}
+			continue
+		}
+		delete(deadlines, b.Addr())
+		if b.DrainedByOperator() {
+			continue // keep the deadline of the first drain when the file is applied again
+		}
+		if err := r.DrainBackend(b.Addr(), deadline); err != nil {
+			return err
+		}
+	}
+	for addr := range deadlines {
+		fmt.Printf("cannot drain unknown backend %s\n", addr)
+	}
+	return nil
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"expvar"
 	"fmt"
 	"github.com/birneee/quic-router-go/router"
 	"github.com/urfave/cli/v2"
 	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const DefaultPort = 18080
@@ -19,9 +25,6 @@ const DefaultPort = 18080
 func main() {
 	var doOnStop []func()
 
-	var secret *[32]byte
-	var defaultServerAddr netip.AddrPort
-
 	app := &cli.App{
 		Name:  "quic-router-go",
 		Usage: "A QUIC router",
@@ -45,51 +48,238 @@ func main() {
 					return nil
 				},
 			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "YAML config file of the tenants, replaces the other router flags; reloaded on SIGHUP and when the file changes",
+			},
 			&cli.StringFlag{
 				Name:  "key",
 				Usage: "key for connection ID and extension header protection; value must be 32 byte and base64 encoded; if not set a random key is generated",
 				Value: "",
-				Action: func(ctx *cli.Context, s string) error {
-					key, err := base64.StdEncoding.DecodeString(s)
-					if err != nil {
-						return fmt.Errorf("failed to parse key: %s", err)
-					}
-					if len(key) != 32 {
-						return fmt.Errorf("failed to parse key: must be 32 byte")
-					}
-					secret = (*[32]byte)(key)
-					return nil
-				},
+			},
+			&cli.StringFlag{
+				Name:  "cipher-suite",
+				Usage: "cipher suite for connection ID and extension header protection; one of aes-256-gcm, aes-128-gcm, chacha20-poly1305",
+				Value: router.CipherSuiteAES256GCM.String(),
 			},
 			&cli.UintFlag{
 				Name:  "port",
 				Usage: "port to listen on",
 				Value: DefaultPort,
 			},
+			&cli.StringSliceFlag{
+				Name:  "listen",
+				Usage: "address and port to listen on, e.g. a virtual IP address; can be repeated; overrides --port",
+			},
+			&cli.StringSliceFlag{
+				Name:  "quic-versions",
+				Usage: "QUIC versions supported by the backends, e.g. 0x00000001; other versions are answered with Version Negotiation; if not set all versions are forwarded",
+			},
+			&cli.StringSliceFlag{
+				Name:  "backend",
+				Usage: "IPv4 address and port of a backend",
+			},
+			&cli.StringSliceFlag{
+				Name:  "route",
+				Usage: "route new connections to a pool by TLS server name and optional ALPN, e.g. *.example.com/h3=web; the first matching route applies; other connections use the default pool",
+			},
+			&cli.StringSliceFlag{
+				Name:  "rule",
+				Usage: "routing rule for new connections, e.g. \"source=192.0.2.0/24 action=drop\" or \"sni=*.example.com alpn=h3 pool=web\"; keys are source, destination, version, sni, alpn, action (pool, drop, retry) and pool; evaluated after --route",
+			},
+			&cli.StringSliceFlag{
+				Name:  "split",
+				Usage: "route a fraction of the new connections of a pool to a canary pool, e.g. canary=0.01 for the default pool or web:web-canary=0.05",
+			},
+			&cli.StringSliceFlag{
+				Name:  "mirror",
+				Usage: "copy the packets of a fraction of the connections of a pool to a shadow backend, e.g. 192.168.0.9:4433=0.01 for the default pool or web:192.168.0.9:4433=0.01",
+			},
+			&cli.StringSliceFlag{
+				Name:  "backend-weight",
+				Usage: "weight of a backend for new connections, e.g. 192.168.0.2:4433=3; the default weight is 1",
+			},
+			&cli.StringFlag{
+				Name:  "selection",
+				Usage: "selection strategy of new connections in the default pool; one of consistent-hash, least-loaded",
+				Value: router.SelectionConsistentHash.String(),
+			},
+			&cli.StringSliceFlag{
+				Name:  "pool-backend",
+				Usage: "backend of a named pool, e.g. canary=192.168.0.3:4433",
+			},
+			&cli.StringSliceFlag{
+				Name:  "pool-selection",
+				Usage: "selection strategy of a named pool, e.g. canary=least-loaded",
+			},
+			&cli.DurationFlag{
+				Name:  "slow-start",
+				Usage: "time over which the weight of a backend ramps up after it becomes up; 0 disables slow start",
+			},
+			&cli.DurationFlag{
+				Name:  "health-check-interval",
+				Usage: "interval of backend health checks; 0 disables health checks",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "address to serve metrics on at /debug/vars, e.g. 127.0.0.1:9090; if not set metrics are not served",
+			},
+			&cli.StringFlag{
+				Name:  "drain-file",
+				Usage: "file listing backends to drain, one address and optional timeout per line, e.g. 192.168.0.2:4433 5m; reloaded on SIGUSR1",
+			},
+			&cli.DurationFlag{
+				Name:  "drain-timeout",
+				Usage: "time after which packets of established connections are no longer forwarded to a drained backend; 0 means no timeout",
+			},
+			&cli.Float64Flag{
+				Name:  "stateless-reset-rate",
+				Usage: "maximum Stateless Resets per second sent for connections of unavailable backends; 0 disables Stateless Resets",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown-grace-period",
+				Usage: "time packets of established connections are still forwarded after SIGTERM, while new connections are dropped; 0 stops immediately",
+			},
+			&cli.BoolFlag{
+				Name:  "retry",
+				Usage: "answer every Initial without valid token with a Retry",
+			},
+			&cli.Uint64Flag{
+				Name:  "retry-threshold",
+				Usage: "answer Initials without valid token with a Retry when more Initials per second are received; 0 disables",
+			},
+			&cli.Float64Flag{
+				Name:  "rate-limit-prefix",
+				Usage: "maximum long header packets per second of a source prefix (/24 for IPv4, /48 for IPv6); 0 disables",
+			},
+			&cli.Float64Flag{
+				Name:  "rate-limit-initials",
+				Usage: "maximum Initials per second of all sources together; 0 disables",
+			},
+			&cli.StringFlag{
+				Name:  "rate-limit-action",
+				Usage: "action for packets exceeding a rate limit; drop, or retry to answer Initials without valid token with a Retry",
+				Value: "drop",
+			},
+			&cli.Float64Flag{
+				Name:  "rate-limit-retries",
+				Usage: "maximum Retries per second sent to rate limited Initials with --rate-limit-action retry",
+				Value: router.DefaultRateLimitRetryRate,
+			},
+			&cli.Float64Flag{
+				Name:  "block-invalid-rate",
+				Usage: "block a source (/32 for IPv4, /64 for IPv6) sending more packets per second with invalid connection IDs or extension headers; 0 disables",
+			},
+			&cli.DurationFlag{
+				Name:  "block-duration",
+				Usage: "time a source is blocked for sending invalid packets",
+				Value: router.DefaultAbuseBlockDuration,
+			},
+			&cli.StringFlag{
+				Name:  "capture",
+				Usage: "pcapng file to capture the datagrams of the router to, annotated with the routing decisions; the admin API can start captures at runtime, see --capture-dir",
+			},
+			&cli.StringFlag{
+				Name:  "capture-dir",
+				Usage: "directory the admin API writes captures to; empty disables captures by the admin API",
+			},
+			&cli.StringFlag{
+				Name:  "capture-filter",
+				Usage: "capture only matching datagrams, e.g. \"client 192.0.2.0/24 or server 192.168.0.2:4433\"; terms can be combined with and, or and not",
+			},
+			&cli.StringFlag{
+				Name:  "admin-socket",
+				Usage: "Unix socket of the admin API, see the ctl command; empty disables the socket",
+				Value: defaultAdminSocket,
+			},
+			&cli.StringFlag{
+				Name:  "admin-addr",
+				Usage: "TCP address to serve the admin API on, e.g. 127.0.0.1:9091; requires --admin-token",
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "bearer token of the admin API on TCP",
+				EnvVars: []string{"QUIC_ROUTER_ADMIN_TOKEN"},
+			},
+		},
+		Commands: []*cli.Command{
+			ctlCommand,
+			keygenCommand,
+			cidCommand,
+			exthdrCommand,
+			replayCommand,
+			benchCommand,
 		},
 		Action: func(ctx *cli.Context) error {
-			addr := netip.AddrPortFrom(netip.MustParseAddr("::"), uint16(ctx.Uint("port")))
-			conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+			if ctx.IsSet("config") {
+				return runConfigFile(ctx, ctx.String("config"))
+			}
+			tenant, err := tenantConfigFromFlags(ctx)
 			if err != nil {
 				return err
 			}
-			fmt.Printf("listen on %s\n", addr.String())
-			if secret == nil {
-				secret = (*[32]byte)(make([]byte, 32))
-				rand.Read(secret[:])
-				fmt.Printf("generated key: %s\n", base64.StdEncoding.EncodeToString(secret[:]))
+			var conns []*net.UDPConn
+			for _, addr := range tenant.Listen {
+				conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+				if err != nil {
+					for _, c := range conns {
+						_ = c.Close()
+					}
+					return err
+				}
+				conns = append(conns, conn)
+				fmt.Printf("listen on %s\n", addr.String())
+			}
+			if !ctx.IsSet("key") {
+				tenant.Secret = *generateKey()
+				fmt.Printf("generated key: %s\n", base64.StdEncoding.EncodeToString(tenant.Secret[:]))
 			}
-			r, err := router.NewRouter(conn, *secret, defaultServerAddr, &router.Config{})
+			r, err := router.NewRouterWithListeners(conns, tenant.Secret, tenant.DefaultServerAddr, tenant.Config)
 			if err != nil {
 				return err
 			}
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
-			go func() {
-				<-c
+			if ctx.IsSet("metrics-addr") {
+				expvar.Publish("router", r.Metrics())
+				go func() {
+					err := http.ListenAndServe(ctx.String("metrics-addr"), nil)
+					if err != nil {
+						r.Stop(fmt.Errorf("failed to serve metrics: %w", err))
+					}
+				}()
+			}
+			if ctx.IsSet("drain-file") {
+				drainFile, drainTimeout := ctx.String("drain-file"), ctx.Duration("drain-timeout")
+				err := applyDrainFile(r, drainFile, drainTimeout)
+				if err != nil {
+					r.Stop(nil)
+					return err
+				}
+				usr1 := make(chan os.Signal, 1)
+				signal.Notify(usr1, syscall.SIGUSR1)
+				go func() {
+					for range usr1 {
+						err := applyDrainFile(r, drainFile, drainTimeout)
+						if err != nil {
+							fmt.Printf("failed to apply drain file: %s\n", err)
+						}
+					}
+				}()
+			}
+			if ctx.IsSet("capture") {
+				if _, err := startCapture([]*router.Router{r}, ctx.String("capture"), ctx.String("capture-filter")); err != nil {
+					r.Stop(nil)
+					return err
+				}
+			}
+			defer stopCaptures([]*router.Router{r})
+			admin, err := startAdminServer(singleRouter{r}, ctx.String("admin-socket"), ctx.String("admin-addr"), ctx.String("admin-token"), ctx.String("capture-dir"))
+			if err != nil {
 				r.Stop(nil)
-			}()
-			<-r.Context().Done()
+				return err
+			}
+			defer admin.close()
+			handleStopSignals(r, ctx.Duration("shutdown-grace-period"))
+			<-r.Closed()
 			return nil
 		},
 	}
@@ -102,3 +292,255 @@ func main() {
 		d()
 	}
 }
+
+// tenantConfigFromFlags configures a router by the flags of the app, the secret is only set if --key is set
+func tenantConfigFromFlags(ctx *cli.Context) (router.TenantConfig, error) {
+	var c router.TenantConfig
+	c.Listen = []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("::"), uint16(ctx.Uint("port")))}
+	if ctx.IsSet("listen") {
+		c.Listen = nil
+		for _, s := range ctx.StringSlice("listen") {
+			addr, err := netip.ParseAddrPort(s)
+			if err != nil {
+				return c, fmt.Errorf("failed to parse listen address: %s", err)
+			}
+			c.Listen = append(c.Listen, addr)
+		}
+	}
+	if ctx.IsSet("key") {
+		secret, err := parseKey(ctx.String("key"))
+		if err != nil {
+			return c, err
+		}
+		c.Secret = *secret
+	}
+	cipherSuite, err := router.ParseCipherSuite(ctx.String("cipher-suite"))
+	if err != nil {
+		return c, err
+	}
+	config := &router.Config{
+		CipherSuite:        cipherSuite,
+		StatelessResetRate: ctx.Float64("stateless-reset-rate"),
+		SlowStart:          ctx.Duration("slow-start"),
+	}
+	if ctx.Duration("health-check-interval") != 0 {
+		config.HealthCheck = &router.HealthCheckConfig{
+			Interval: ctx.Duration("health-check-interval"),
+		}
+	}
+	for i, s := range ctx.StringSlice("backend") {
+		backendAddr, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse backend address: %s", err)
+		}
+		if i == 0 {
+			c.DefaultServerAddr = backendAddr
+		} else {
+			config.Backends = append(config.Backends, backendAddr)
+		}
+	}
+	config.Selection, err = router.ParseSelectionStrategy(ctx.String("selection"))
+	if err != nil {
+		return c, err
+	}
+	for _, s := range ctx.StringSlice("pool-backend") {
+		name, addrString, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return c, fmt.Errorf("failed to parse pool backend: expected name=address")
+		}
+		backendAddr, err := netip.ParseAddrPort(addrString)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse pool backend: %s", err)
+		}
+		if config.Pools == nil {
+			config.Pools = map[string]router.PoolConfig{}
+		}
+		pool := config.Pools[name]
+		pool.Backends = append(pool.Backends, backendAddr)
+		config.Pools[name] = pool
+	}
+	for _, s := range ctx.StringSlice("pool-selection") {
+		name, strategy, ok := strings.Cut(s, "=")
+		if !ok {
+			return c, fmt.Errorf("failed to parse pool selection: expected name=strategy")
+		}
+		pool, ok := config.Pools[name]
+		if !ok {
+			return c, fmt.Errorf("failed to parse pool selection: pool %q has no backends", name)
+		}
+		pool.Selection, err = router.ParseSelectionStrategy(strategy)
+		if err != nil {
+			return c, err
+		}
+		config.Pools[name] = pool
+	}
+	for _, s := range ctx.StringSlice("route") {
+		match, pool, ok := strings.Cut(s, "=")
+		if !ok {
+			return c, fmt.Errorf("failed to parse route: expected server-name[/alpn]=pool")
+		}
+		serverName, alpn, _ := strings.Cut(match, "/")
+		config.RoutingRules = append(config.RoutingRules, router.RoutingRule{
+			ServerName: serverName,
+			ALPN:       alpn,
+			Pool:       pool,
+		})
+	}
+	for _, s := range ctx.StringSlice("rule") {
+		rule, err := parseRoutingRule(s)
+		if err != nil {
+			return c, err
+		}
+		config.RoutingRules = append(config.RoutingRules, rule)
+	}
+	for _, s := range ctx.StringSlice("mirror") {
+		target, fractionString, ok := strings.Cut(s, "=")
+		if !ok {
+			return c, fmt.Errorf("failed to parse mirror: expected [pool:]shadow=fraction")
+		}
+		pool := router.DefaultPool
+		shadow, err := netip.ParseAddrPort(target)
+		if err != nil {
+			var shadowString string
+			pool, shadowString, _ = strings.Cut(target, ":")
+			shadow, err = netip.ParseAddrPort(shadowString)
+			if err != nil {
+				return c, fmt.Errorf("failed to parse mirror: %s", err)
+			}
+		}
+		fraction, err := strconv.ParseFloat(fractionString, 64)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse mirror: %s", err)
+		}
+		mirror := &router.MirrorConfig{Shadow: shadow, Fraction: fraction}
+		if pool == router.DefaultPool {
+			config.Mirror = mirror
+			continue
+		}
+		poolConfig, ok := config.Pools[pool]
+		if !ok {
+			return c, fmt.Errorf("failed to parse mirror: pool %q has no backends", pool)
+		}
+		poolConfig.Mirror = mirror
+		config.Pools[pool] = poolConfig
+	}
+	for _, s := range ctx.StringSlice("split") {
+		pools, fractionString, ok := strings.Cut(s, "=")
+		if !ok {
+			return c, fmt.Errorf("failed to parse split: expected [pool:]canary=fraction")
+		}
+		pool, canary, ok := strings.Cut(pools, ":")
+		if !ok {
+			pool, canary = router.DefaultPool, pools
+		}
+		fraction, err := strconv.ParseFloat(fractionString, 64)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse split: %s", err)
+		}
+		config.Splits = append(config.Splits, router.SplitRule{
+			Pool:     pool,
+			Canary:   canary,
+			Fraction: fraction,
+		})
+	}
+	for _, s := range ctx.StringSlice("backend-weight") {
+		addrString, weightString, ok := strings.Cut(s, "=")
+		if !ok {
+			return c, fmt.Errorf("failed to parse backend weight: missing =")
+		}
+		backendAddr, err := netip.ParseAddrPort(addrString)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse backend weight: %s", err)
+		}
+		weight, err := strconv.ParseUint(weightString, 10, 32)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse backend weight: %s", err)
+		}
+		if config.BackendWeights == nil {
+			config.BackendWeights = map[netip.AddrPort]uint32{}
+		}
+		config.BackendWeights[backendAddr] = uint32(weight)
+	}
+	for _, s := range ctx.StringSlice("quic-versions") {
+		version, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse QUIC version: %s", err)
+		}
+		config.SupportedVersions = append(config.SupportedVersions, uint32(version))
+	}
+	if ctx.Bool("retry") || ctx.Uint64("retry-threshold") != 0 {
+		config.Retry = &router.RetryConfig{
+			Always:               ctx.Bool("retry"),
+			InitialRateThreshold: ctx.Uint64("retry-threshold"),
+		}
+	}
+	if ctx.Float64("rate-limit-prefix") != 0 || ctx.Float64("rate-limit-initials") != 0 {
+		action, err := router.ParseRateLimitAction(ctx.String("rate-limit-action"))
+		if err != nil {
+			return c, err
+		}
+		config.RateLimit = &router.RateLimitConfig{
+			PrefixRate:  ctx.Float64("rate-limit-prefix"),
+			InitialRate: ctx.Float64("rate-limit-initials"),
+			Action:      action,
+			RetryRate:   ctx.Float64("rate-limit-retries"),
+		}
+	}
+	if ctx.Float64("block-invalid-rate") != 0 {
+		config.AbuseDetection = &router.AbuseDetectionConfig{
+			InvalidConnIDRate: ctx.Float64("block-invalid-rate"),
+			InvalidExtHdrRate: ctx.Float64("block-invalid-rate"),
+			BlockDuration:     ctx.Duration("block-duration"),
+		}
+	}
+	c.Config = config
+	return c, nil
+}
+
+// stoppable is a router.Router or router.Tenants
+type stoppable interface {
+	Stop(err error)
+	Shutdown(ctx context.Context)
+}
+
+// handleStopSignals shuts down gracefully on SIGTERM if the grace period is not 0,
+// other signals stop immediately
+func handleStopSignals(s stoppable, gracePeriod time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, os.Kill)
+	go func() {
+		sig := <-c
+		if sig != syscall.SIGTERM || gracePeriod == 0 {
+			s.Stop(nil)
+			return
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		go func() {
+			// a second signal stops immediately
+			<-c
+			s.Stop(nil)
+		}()
+		s.Shutdown(shutdownCtx)
+	}()
+}
+
+func parseKey(s string) (*[32]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("failed to parse key: must be 32 byte")
+	}
+	return (*[32]byte)(key), nil
+}
+
+func generateKey() *[32]byte {
+	key := (*[32]byte)(make([]byte, 32))
+	_, err := rand.Read(key[:])
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
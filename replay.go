@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/urfave/cli/v2"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayCommand routes the datagrams of a capture file without sockets
+var replayCommand = &cli.Command{
+	Name:      "replay",
+	Usage:     "route the UDP datagrams of a pcap or pcapng file offline and print the decision per datagram; uses the key and config of the router flags or of --config",
+	ArgsUsage: "FILE",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "tenant",
+			Usage: "tenant of the config file; can be omitted if there is only one tenant",
+		},
+		&cli.BoolFlag{
+			Name:  "diff",
+			Usage: "only print datagrams whose decision differs from the comment of a capture of the router; fails if there are any",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return fmt.Errorf("expected capture file")
+		}
+		tenant, err := replayTenantConfig(ctx)
+		if err != nil {
+			return err
+		}
+		replay, err := router.NewReplay(tenant)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(ctx.Args().First())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		reader, err := router.NewCaptureReader(f)
+		if err != nil {
+			return err
+		}
+		var replayed, differing int
+		for {
+			d, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// datagrams sent by the router are captured too
+			if !replay.Receives(d.Dst) || strings.HasPrefix(d.Comment, "sent: ") {
+				continue
+			}
+			replayed++
+			decision, err := replay.Route(d.Time, d.Src, d.Dst, d.Payload)
+			differs := d.Comment != "" && d.Comment != decision
+			if differs {
+				differing++
+			}
+			if ctx.Bool("diff") && !differs {
+				continue
+			}
+			fmt.Printf("%d %s %s\n", d.Number, d.Time.UTC().Format(time.RFC3339Nano), decision)
+			if err != nil {
+				fmt.Printf("  stops the router: %s\n", err)
+			}
+			if differs {
+				fmt.Printf("  captured: %s\n", d.Comment)
+			}
+		}
+		fmt.Printf("replayed %d datagrams, skipped %d packets that are no complete UDP datagrams\n", replayed, reader.Skipped())
+		if ctx.Bool("diff") && differing != 0 {
+			return cli.Exit(fmt.Sprintf("%d datagrams were routed differently than captured", differing), 1)
+		}
+		return nil
+	},
+}
+
+// replayTenantConfig returns the tenant of the config file, or configures a tenant by the router flags
+func replayTenantConfig(ctx *cli.Context) (router.TenantConfig, error) {
+	if !ctx.IsSet("config") {
+		if !ctx.IsSet("key") {
+			return router.TenantConfig{}, fmt.Errorf("--key or --config is required to replay")
+		}
+		return tenantConfigFromFlags(ctx)
+	}
+	f, err := readConfigFile(ctx.String("config"))
+	if err != nil {
+		return router.TenantConfig{}, err
+	}
+	name := ctx.String("tenant")
+	if name == "" && len(f.Tenants) > 1 {
+		return router.TenantConfig{}, fmt.Errorf("--tenant is required with several tenants")
+	}
+	for _, t := range f.Tenants {
+		if t.Name != name && name != "" {
+			continue
+		}
+		tenant, err := t.toTenantConfig()
+		if err != nil {
+			return tenant, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		return tenant, nil
+	}
+	return router.TenantConfig{}, fmt.Errorf("unknown tenant %q", name)
+}
@@ -0,0 +1,233 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultAbuseIPv4PrefixLen = 32
+	DefaultAbuseIPv6PrefixLen = 64
+	DefaultAbuseBlockDuration = time.Minute
+	DefaultAbuseMaxBlocked    = 10000
+)
+
+// AbuseDetectionConfig blocks source prefixes that send invalid packets,
+// e.g. short header packets with random connection IDs, which cost the router crypto operations.
+// The packets of blocked prefixes are dropped before any crypto, except the packets of backends.
+// Like the rate limits, the invalid packets of prefixes are counted in a sketch of fixed size,
+// so prefixes whose buckets collide may be blocked together.
+type AbuseDetectionConfig struct {
+	// InvalidConnIDRate blocks a prefix that sends more short header packets per second
+	// whose connection ID fails verification or has an unknown server ID, 0 disables it
+	InvalidConnIDRate float64
+	// InvalidExtHdrRate blocks a prefix that sends more packets per second
+	// with an extension header type that can neither be opened nor is a greased short header packet, 0 disables it.
+	// Extension headers are only opened for packets from backend addresses,
+	// the packets of other sources are greased short header packets.
+	InvalidExtHdrRate float64
+	// IPv4PrefixLen is the length of the blocked prefixes of IPv4 sources, the default is DefaultAbuseIPv4PrefixLen
+	IPv4PrefixLen int
+	// IPv6PrefixLen is the length of the blocked prefixes of IPv6 sources, the default is DefaultAbuseIPv6PrefixLen
+	IPv6PrefixLen int
+	// BlockDuration is the time a prefix is blocked, the default is DefaultAbuseBlockDuration
+	BlockDuration time.Duration
+	// MaxBlocked bounds the number of blocked prefixes, the default is DefaultAbuseMaxBlocked.
+	// Offending prefixes are not blocked while the blocklist is full.
+	MaxBlocked int
+}
+
+// invalidPacketKind is what a dropped packet is counted as by the abuse detection
+type invalidPacketKind uint8
+
+const (
+	invalidConnID invalidPacketKind = iota
+	invalidExtHdr
+)
+
+func (k invalidPacketKind) String() string {
+	if k == invalidExtHdr {
+		return "invalid extension headers"
+	}
+	return "invalid connection ids"
+}
+
+// blockedPrefix is an entry of the blocklist
+type blockedPrefix struct {
+	until  time.Time
+	reason invalidPacketKind
+}
+
+// abuseDetector is only used by the run loop, the counters and the blocklist may be read concurrently
+type abuseDetector struct {
+	config AbuseDetectionConfig
+	// invalid counts the invalid packets per kind, a sketch is nil if its kind is not detected
+	invalid [2]*prefixBuckets
+	// blocked is written by the run loop with mu held, the run loop reads it without
+	mu      sync.Mutex
+	blocked map[netip.Prefix]blockedPrefix
+	// numBlocked skips the blocklist lookup while it is empty
+	numBlocked atomic.Int64
+	// nextSweep is the time expired prefixes are removed from the blocklist
+	nextSweep      time.Time
+	invalidPackets [2]atomic.Uint64
+	blockedPackets atomic.Uint64
+	blocks         atomic.Uint64
+}
+
+func newAbuseDetector(config AbuseDetectionConfig) (*abuseDetector, error) {
+	if config.InvalidConnIDRate < 0 || config.InvalidExtHdrRate < 0 || config.BlockDuration < 0 || config.MaxBlocked < 0 {
+		return nil, fmt.Errorf("abuse detection limits must not be negative")
+	}
+	if config.IPv4PrefixLen == 0 {
+		config.IPv4PrefixLen = DefaultAbuseIPv4PrefixLen
+	}
+	if config.IPv6PrefixLen == 0 {
+		config.IPv6PrefixLen = DefaultAbuseIPv6PrefixLen
+	}
+	if config.IPv4PrefixLen < 0 || config.IPv4PrefixLen > 32 || config.IPv6PrefixLen < 0 || config.IPv6PrefixLen > 128 {
+		return nil, fmt.Errorf("invalid abuse detection prefix length")
+	}
+	if config.BlockDuration == 0 {
+		config.BlockDuration = DefaultAbuseBlockDuration
+	}
+	if config.MaxBlocked == 0 {
+		config.MaxBlocked = DefaultAbuseMaxBlocked
+	}
+	d := &abuseDetector{
+		config:  config,
+		blocked: map[netip.Prefix]blockedPrefix{},
+	}
+	if config.InvalidConnIDRate != 0 {
+		d.invalid[invalidConnID] = newPrefixBuckets(config.InvalidConnIDRate, config.InvalidConnIDRate)
+	}
+	if config.InvalidExtHdrRate != 0 {
+		d.invalid[invalidExtHdr] = newPrefixBuckets(config.InvalidExtHdrRate, config.InvalidExtHdrRate)
+	}
+	return d, nil
+}
+
+// adopt continues the counters and the blocklist of the previous detector,
+// and its counts of invalid packets if the config is unchanged
+func (d *abuseDetector) adopt(previous *abuseDetector) {
+	if d.config == previous.config {
+		d.invalid = previous.invalid
+	}
+	previous.mu.Lock()
+	for prefix, b := range previous.blocked {
+		d.blocked[prefix] = b
+	}
+	previous.mu.Unlock()
+	d.numBlocked.Store(int64(len(d.blocked)))
+	d.nextSweep = previous.nextSweep
+	for kind := range d.invalidPackets {
+		d.invalidPackets[kind].Store(previous.invalidPackets[kind].Load())
+	}
+	d.blockedPackets.Store(previous.blockedPackets.Load())
+	d.blocks.Store(previous.blocks.Load())
+}
+
+// prefix returns the blocked prefix of the source
+func (d *abuseDetector) prefix(source netip.Addr) netip.Prefix {
+	source = source.Unmap()
+	bits := d.config.IPv6PrefixLen
+	if source.Is4() {
+		bits = d.config.IPv4PrefixLen
+	}
+	prefix, _ := source.Prefix(bits)
+	return prefix
+}
+
+// blockedPrefix returns the prefix of the source if it is blocked, expired blocks are removed
+func (r *Router) blockedPrefix(source netip.Addr, now time.Time) (netip.Prefix, bool) {
+	d := r.abuseDetector
+	prefix := d.prefix(source)
+	b, ok := d.blocked[prefix]
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	if now.Before(b.until) {
+		return prefix, true
+	}
+	d.unblock(prefix)
+	r.logf("%s is no longer blocked\n", prefix)
+	return netip.Prefix{}, false
+}
+
+func (d *abuseDetector) unblock(prefix netip.Prefix) {
+	d.mu.Lock()
+	delete(d.blocked, prefix)
+	d.numBlocked.Store(int64(len(d.blocked)))
+	d.mu.Unlock()
+}
+
+// countInvalid counts a dropped invalid packet of the source and blocks its prefix if it sends too many
+func (r *Router) countInvalid(source netip.AddrPort, kind invalidPacketKind) {
+	d := r.abuseDetector
+	if d == nil {
+		return
+	}
+	d.invalidPackets[kind].Add(1)
+	if d.invalid[kind] == nil {
+		return
+	}
+	now := r.now()
+	prefix := d.prefix(source.Addr())
+	if d.invalid[kind].allow(prefix, now) {
+		return
+	}
+	if !now.Before(d.nextSweep) {
+		r.sweepBlocked(now)
+	}
+	if _, ok := d.blocked[prefix]; ok || len(d.blocked) >= d.config.MaxBlocked {
+		return
+	}
+	d.mu.Lock()
+	d.blocked[prefix] = blockedPrefix{until: now.Add(d.config.BlockDuration), reason: kind}
+	d.numBlocked.Store(int64(len(d.blocked)))
+	d.mu.Unlock()
+	d.blocks.Add(1)
+	rate := d.config.InvalidConnIDRate
+	if kind == invalidExtHdr {
+		rate = d.config.InvalidExtHdrRate
+	}
+	r.logf("blocked %s for %s after more than %g %s per second\n", prefix, d.config.BlockDuration, rate, kind)
+}
+
+// sweepBlocked removes the expired prefixes of sources that did not send since
+func (r *Router) sweepBlocked(now time.Time) {
+	d := r.abuseDetector
+	d.nextSweep = now.Add(d.config.BlockDuration)
+	for prefix, b := range d.blocked {
+		if !now.Before(b.until) {
+			d.unblock(prefix)
+			r.logf("%s is no longer blocked\n", prefix)
+		}
+	}
+}
+
+// BlockedPrefix is a source prefix blocked by the abuse detection
+type BlockedPrefix struct {
+	Prefix netip.Prefix
+	Until  time.Time
+	// Reason is the kind of invalid packets, e.g. "invalid connection ids"
+	Reason string
+}
+
+// BlockedPrefixes returns the source prefixes blocked by the abuse detection
+func (r *Router) BlockedPrefixes() []BlockedPrefix {
+	d := r.abuseDetector
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	blocked := make([]BlockedPrefix, 0, len(d.blocked))
+	for prefix, b := range d.blocked {
+		blocked = append(blocked, BlockedPrefix{Prefix: prefix, Until: b.until, Reason: b.reason.String()})
+	}
+	return blocked
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAbuseReplay(t *testing.T, config *AbuseDetectionConfig) (*Replay, *lockedBuffer, []byte, netip.AddrPort) {
+	secret := [32]byte{1}
+	backendAddr := netip.MustParseAddrPort("10.0.0.1:4433")
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	var logs lockedBuffer
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		Secret:            secret,
+		DefaultServerAddr: backendAddr,
+		Config:            &Config{AbuseDetection: config, Logger: log.New(&logs, "", 0)},
+	})
+	require.NoError(t, err)
+	protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	generator, err := NewConnIDGeneratorFromAddr(protector, backendAddr, rand.Reader)
+	require.NoError(t, err)
+	connID, err := generator.GenerateConnectionID()
+	require.NoError(t, err)
+	shortHdr := append([]byte{0x40}, connID.Bytes()...)
+	shortHdr = append(shortHdr, make([]byte, 20)...)
+	return replay, &logs, shortHdr, routerAddr
+}
+
+func TestInvalidConnIDIsDropped(t *testing.T) {
+	replay, _, shortHdr, routerAddr := newAbuseReplay(t, nil)
+	invalid := append([]byte{}, shortHdr...)
+	invalid[connIDLen] ^= 1
+	decision, err := replay.Route(time.Now(), netip.MustParseAddrPort("192.0.2.1:1234"), routerAddr, invalid)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "dropped: invalid connection id"), decision)
+}
+
+func TestAbuseDetectionBlocksInvalidConnIDs(t *testing.T) {
+	replay, logs, shortHdr, routerAddr := newAbuseReplay(t, &AbuseDetectionConfig{InvalidConnIDRate: 2})
+	invalid := append([]byte{}, shortHdr...)
+	invalid[connIDLen] ^= 1
+	start := time.Unix(1700000000, 0)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	route := func(at time.Duration, from netip.AddrPort, datagram []byte) string {
+		decision, err := replay.Route(start.Add(at), from, routerAddr, datagram)
+		require.NoError(t, err)
+		return decision
+	}
+	for i := 0; i < 3; i++ {
+		assert.True(t, strings.HasSuffix(route(0, client, invalid), "dropped: invalid connection id"))
+	}
+	assert.Equal(t, "blocked 192.0.2.1/32 for 1m0s after more than 2 invalid connection ids per second\n", logs.String())
+	blocked := replay.router.BlockedPrefixes()
+	require.Len(t, blocked, 1)
+	assert.Equal(t, BlockedPrefix{Prefix: netip.MustParsePrefix("192.0.2.1/32"), Until: start.Add(time.Minute), Reason: "invalid connection ids"}, blocked[0])
+
+	// valid packets of the blocked source are dropped too
+	assert.True(t, strings.HasSuffix(route(time.Second, client, shortHdr), "dropped: source 192.0.2.1/32 is blocked"))
+	assert.True(t, strings.HasSuffix(route(time.Second, netip.MustParseAddrPort("[::ffff:192.0.2.1]:1235"), shortHdr), "dropped: source 192.0.2.1/32 is blocked"))
+	assert.True(t, strings.HasSuffix(route(time.Second, netip.MustParseAddrPort("192.0.2.2:1234"), shortHdr), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(time.Minute, client, shortHdr), "forwarded to backend 10.0.0.1:4433"))
+	assert.Contains(t, logs.String(), "192.0.2.1/32 is no longer blocked\n")
+	assert.Empty(t, replay.router.BlockedPrefixes())
+
+	d := replay.router.abuseDetector
+	assert.Equal(t, uint64(3), d.invalidPackets[invalidConnID].Load())
+	assert.Equal(t, uint64(2), d.blockedPackets.Load())
+	assert.Equal(t, uint64(1), d.blocks.Load())
+}
+
+func TestAbuseDetectionBlocksInvalidExtHdrs(t *testing.T) {
+	replay, _, shortHdr, routerAddr := newAbuseReplay(t, &AbuseDetectionConfig{InvalidConnIDRate: 1, InvalidExtHdrRate: 1, IPv6PrefixLen: 48})
+	// extension headers are only opened for packets of backend addresses, e.g. spoofed ones
+	backendAddr := netip.MustParseAddrPort("192.0.2.1:4433")
+	require.NoError(t, replay.router.AddBackend(backendAddr))
+	extHdrPacket := make([]byte, 60)
+	extHdrPacket[0] = extHdrTypeWithCipherSuite(ClientAddrExtHdrType, CipherSuiteAES256GCM)
+	connIDPacket := append([]byte{}, shortHdr...)
+	connIDPacket[connIDLen] ^= 1
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 2; i++ {
+		_, err := replay.Route(now, backendAddr, routerAddr, extHdrPacket)
+		require.NoError(t, err)
+		_, err = replay.Route(now, netip.MustParseAddrPort("[2001:db8::1]:1234"), routerAddr, connIDPacket)
+		require.NoError(t, err)
+	}
+	blocked := replay.router.BlockedPrefixes()
+	slices.SortFunc(blocked, func(a, b BlockedPrefix) int { return a.Prefix.Addr().Compare(b.Prefix.Addr()) })
+	require.Len(t, blocked, 2)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.1/32"), blocked[0].Prefix)
+	assert.Equal(t, "invalid extension headers", blocked[0].Reason)
+	assert.Equal(t, netip.MustParsePrefix("2001:db8::/48"), blocked[1].Prefix)
+	decision, err := replay.Route(now, netip.MustParseAddrPort("[2001:db8:0:1::1]:1234"), routerAddr, shortHdr)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "dropped: source 2001:db8::/48 is blocked"), decision)
+	// the backend itself is not blocked
+	decision, err = replay.Route(now, backendAddr, routerAddr, extHdrPacket)
+	require.NoError(t, err)
+	assert.NotContains(t, decision, "is blocked")
+	assert.Equal(t, uint64(3), replay.router.abuseDetector.invalidPackets[invalidExtHdr].Load())
+}
+
+func TestExtHdrOfUnknownSourceDerivesNoKeys(t *testing.T) {
+	replay, _, _, routerAddr := newAbuseReplay(t, nil)
+	extHdrPacket := make([]byte, 60)
+	extHdrPacket[0] = extHdrTypeWithCipherSuite(ClientAddrExtHdrType, CipherSuiteAES256GCM)
+	for port := uint16(1); port <= 10; port++ {
+		decision, err := replay.Route(time.Now(), netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), port), routerAddr, extHdrPacket)
+		require.NoError(t, err)
+		assert.NotContains(t, decision, "forwarded")
+	}
+	packers := replay.router.keys.Load().current.clientIDExtHdrPackers
+	packers.mu.RLock()
+	defer packers.mu.RUnlock()
+	for serverID := range packers.values {
+		assert.NotNil(t, replay.router.backends.get(serverID), "key derived for unknown server %s", serverIDToAddr(serverID))
+	}
+}
+
+func TestAbuseDetectionCountsUnknownServerIDs(t *testing.T) {
+	replay, _, shortHdr, routerAddr := newAbuseReplay(t, &AbuseDetectionConfig{InvalidConnIDRate: 1})
+	replay.router.statelessResetLimiter = newTokenBucket(100, 100)
+	now := time.Unix(1700000000, 0)
+	route := func(from string, datagram []byte) string {
+		decision, err := replay.Route(now, netip.MustParseAddrPort(from), routerAddr, datagram)
+		require.NoError(t, err)
+		return decision
+	}
+	// random connection IDs have unknown server IDs
+	randomConnID := make([]byte, len(shortHdr))
+	randomConnID[0] = 0x40
+	for i := 0; i < 2; i++ {
+		_, err := rand.Read(randomConnID[1 : 1+connIDLen])
+		require.NoError(t, err)
+		route("192.0.2.1:1234", randomConnID)
+	}
+	assert.True(t, strings.HasSuffix(route("192.0.2.1:1234", shortHdr), "dropped: source 192.0.2.1/32 is blocked"))
+
+	// connection IDs of an unreachable backend are counted if they do not verify
+	require.NoError(t, replay.router.DrainBackend(netip.MustParseAddrPort("10.0.0.1:4433"), now.Add(-time.Second)))
+	assert.True(t, strings.HasSuffix(route("198.51.100.1:1234", shortHdr), "answered with stateless reset"))
+	invalid := append([]byte{}, shortHdr...)
+	invalid[connIDLen] ^= 1
+	for i := 0; i < 2; i++ {
+		assert.True(t, strings.HasSuffix(route("198.51.100.1:1234", invalid), "dropped: invalid connection id"))
+	}
+	assert.True(t, strings.HasSuffix(route("198.51.100.1:1234", shortHdr), "dropped: source 198.51.100.1/32 is blocked"))
+	assert.Equal(t, uint64(4), replay.router.abuseDetector.invalidPackets[invalidConnID].Load())
+}
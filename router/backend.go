@@ -0,0 +1,346 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BackendState int32
+
+const (
+	BackendUp BackendState = iota
+	BackendDown
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case BackendUp:
+		return "up"
+	case BackendDown:
+		return "down"
+	default:
+		return fmt.Sprintf("unknown backend state %d", int32(s))
+	}
+}
+
+type Backend struct {
+	addr     netip.AddrPort
+	serverID [connIDServerIDLen]byte
+	// pool the backend belongs to
+	pool  string
+	state atomic.Int32
+	// draining backends receive no new connections.
+	// The drain of an operator and the drain announced by the backend are tracked separately,
+	// so a backend announcing that it is ready does not end the drain of an operator.
+	drainedByOperator atomic.Bool
+	drainAnnounced    atomic.Bool
+	// drainDeadline in Unix nanoseconds, after which packets of established connections are no longer forwarded.
+	// 0 if there is no deadline.
+	drainDeadline atomic.Int64
+	load          atomic.Pointer[LoadReport]
+	// forwarded traffic, to see when a draining backend is idle
+	packetsForwarded atomic.Uint64
+	bytesForwarded   atomic.Uint64
+	lastForwarded    atomic.Int64
+	// lastControlSeq and the packet rate are only accessed by the router's run loop
+	lastControlSeq    uint64
+	rateWindowStart   time.Time
+	rateWindowPackets uint64
+	packetRate        float64
+	weight            atomic.Uint32
+	// slowStartBegin and slowStartEnd in Unix nanoseconds, 0 if the backend is not in slow start
+	slowStartBegin atomic.Int64
+	slowStartEnd   atomic.Int64
+}
+
+const (
+	DefaultBackendWeight uint32 = 1
+	// minSlowStartFactor is the factor of the weight at the beginning of slow start,
+	// so a single backend in slow start still receives connections
+	minSlowStartFactor = 0.01
+)
+
+func newBackend(addr netip.AddrPort, pool string) *Backend {
+	b := &Backend{
+		addr:     addr,
+		serverID: addrToServerID(addr),
+		pool:     pool,
+	}
+	b.weight.Store(DefaultBackendWeight)
+	return b
+}
+
+func (b *Backend) Addr() netip.AddrPort {
+	return b.addr
+}
+
+func (b *Backend) Pool() string {
+	return b.pool
+}
+
+func (b *Backend) State() BackendState {
+	return BackendState(b.state.Load())
+}
+
+// setState returns the previous state
+func (b *Backend) setState(state BackendState) BackendState {
+	return BackendState(b.state.Swap(int32(state)))
+}
+
+// Draining says if the backend is drained by an operator or announced that it is draining
+func (b *Backend) Draining() bool {
+	return b.drainedByOperator.Load() || b.drainAnnounced.Load()
+}
+
+// DrainedByOperator says if the backend is drained by DrainBackend
+func (b *Backend) DrainedByOperator() bool {
+	return b.drainedByOperator.Load()
+}
+
+// Load returns the last reported load, or nil if the backend did not report its load yet
+func (b *Backend) Load() *LoadReport {
+	return b.load.Load()
+}
+
+// DrainDeadline returns the zero time if there is no deadline
+func (b *Backend) DrainDeadline() time.Time {
+	deadline := b.drainDeadline.Load()
+	if deadline == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, deadline)
+}
+
+// drain stops new connections to the backend on behalf of an operator.
+// Packets of established connections are forwarded until the deadline,
+// the zero deadline means forever.
+// Returns false if the backend was already draining.
+func (b *Backend) drain(deadline time.Time) bool {
+	if deadline.IsZero() {
+		b.drainDeadline.Store(0)
+	} else {
+		b.drainDeadline.Store(deadline.UnixNano())
+	}
+	wasDraining := b.Draining()
+	b.drainedByOperator.Store(true)
+	return !wasDraining
+}
+
+// startDraining stops new connections to the backend, because the backend announced that it is draining.
+// It keeps the deadline, e.g. one set by an operator before.
+// Returns false if the backend was already draining.
+func (b *Backend) startDraining() bool {
+	wasDraining := b.Draining()
+	b.drainAnnounced.Store(true)
+	return !wasDraining
+}
+
+// undrain ends the drain of an operator and its deadline.
+// Returns false if the backend was not drained by an operator.
+func (b *Backend) undrain() bool {
+	b.drainDeadline.Store(0)
+	return b.drainedByOperator.Swap(false)
+}
+
+// ready ends the drain the backend announced, the drain of an operator remains.
+// Returns true if the backend is no longer draining.
+func (b *Backend) ready() bool {
+	return b.drainAnnounced.Swap(false) && !b.drainedByOperator.Load()
+}
+
+// Weight of the backend for new connections, without slow start
+func (b *Backend) Weight() uint32 {
+	return b.weight.Load()
+}
+
+func (b *Backend) setWeight(weight uint32) {
+	b.weight.Store(weight)
+}
+
+// startSlowStart ramps the weight up linearly over the window
+func (b *Backend) startSlowStart(now time.Time, window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	b.slowStartEnd.Store(0)
+	b.slowStartBegin.Store(now.UnixNano())
+	b.slowStartEnd.Store(now.Add(window).UnixNano())
+}
+
+// effectiveWeight is the weight reduced by slow start
+func (b *Backend) effectiveWeight(now time.Time) float64 {
+	weight := float64(b.Weight())
+	end := b.slowStartEnd.Load()
+	if end == 0 || now.UnixNano() >= end {
+		return weight
+	}
+	begin := b.slowStartBegin.Load()
+	factor := float64(now.UnixNano()-begin) / float64(end-begin)
+	return weight * min(max(factor, minSlowStartFactor), 1)
+}
+
+// available says if the backend can receive new connections
+func (b *Backend) available() bool {
+	return b.State() == BackendUp && !b.Draining()
+}
+
+// reachable says if packets of established connections are forwarded to the backend
+func (b *Backend) reachable(now time.Time) bool {
+	return b.State() != BackendDown && !b.drainExpired(now)
+}
+
+// drainExpired says if the drain deadline of the backend has passed
+func (b *Backend) drainExpired(now time.Time) bool {
+	deadline := b.drainDeadline.Load()
+	return deadline != 0 && now.UnixNano() >= deadline
+}
+
+func (b *Backend) countForwarded(n int, now time.Time) {
+	b.packetsForwarded.Add(1)
+	b.bytesForwarded.Add(uint64(n))
+	b.lastForwarded.Store(now.UnixNano())
+}
+
+// rateWindow is the minimum time over which the packet rate is measured
+const rateWindow = time.Second
+
+// updatePacketRate returns the packets per second forwarded to the backend.
+// It must only be called by the router's run loop.
+func (b *Backend) updatePacketRate(now time.Time) float64 {
+	if b.rateWindowStart.IsZero() {
+		b.rateWindowStart = now
+		b.rateWindowPackets = b.packetsForwarded.Load()
+		return 0
+	}
+	elapsed := now.Sub(b.rateWindowStart)
+	if elapsed >= rateWindow {
+		packets := b.packetsForwarded.Load()
+		b.packetRate = float64(packets-b.rateWindowPackets) / elapsed.Seconds()
+		b.rateWindowStart = now
+		b.rateWindowPackets = packets
+	}
+	return b.packetRate
+}
+
+// LastForwarded returns the time a packet was last forwarded to the backend,
+// or the zero time if no packet was forwarded yet
+func (b *Backend) LastForwarded() time.Time {
+	last := b.lastForwarded.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// backendSet contains all backends the router knows.
+// It is safe for concurrent use.
+type backendSet struct {
+	mu       sync.RWMutex
+	backends map[[connIDServerIDLen]byte]*Backend
+	// list is a copy of the backends that is replaced on every change,
+	// so the hot path can iterate without locking
+	list atomic.Pointer[[]*Backend]
+	// pools are the backends of every pool, replaced together with list
+	pools atomic.Pointer[map[string][]*Backend]
+}
+
+func newBackendSet() *backendSet {
+	s := &backendSet{
+		backends: map[[connIDServerIDLen]byte]*Backend{},
+	}
+	s.list.Store(&[]*Backend{})
+	s.pools.Store(&map[string][]*Backend{})
+	return s
+}
+
+// updateList must be called with mu locked
+func (s *backendSet) updateList() {
+	list := make([]*Backend, 0, len(s.backends))
+	pools := map[string][]*Backend{}
+	for _, b := range s.backends {
+		list = append(list, b)
+		pools[b.pool] = append(pools[b.pool], b)
+	}
+	s.list.Store(&list)
+	s.pools.Store(&pools)
+}
+
+// add adds the backend to the default pool.
+// It returns the existing backend if the address is already known.
+func (s *backendSet) add(addr netip.AddrPort) (*Backend, error) {
+	return s.addToPool(addr, DefaultPool)
+}
+
+// addToPool returns the existing backend if the address is already known in the same pool
+func (s *backendSet) addToPool(addr netip.AddrPort, pool string) (*Backend, error) {
+	if !addr.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("backend address %s is not IPv4", addr)
+	}
+	b := newBackend(addr, pool)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.backends[b.serverID]; ok {
+		if existing.pool != pool {
+			return nil, fmt.Errorf("backend %s is already in pool %q", addr, existing.pool)
+		}
+		return existing, nil
+	}
+	s.backends[b.serverID] = b
+	s.updateList()
+	return b, nil
+}
+
+// adopt replaces b by the backend with the same address and pool of the previous set,
+// returns false if there is no such backend
+func (s *backendSet) adopt(previous *backendSet, b *Backend) bool {
+	existing := previous.get(b.serverID)
+	if existing == nil || existing.addr != b.addr || existing.pool != b.pool {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends[b.serverID] = existing
+	s.updateList()
+	return true
+}
+
+func (s *backendSet) remove(addr netip.AddrPort) bool {
+	if !addr.Addr().Unmap().Is4() {
+		return false
+	}
+	serverID := addrToServerID(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.backends[serverID]
+	delete(s.backends, serverID)
+	s.updateList()
+	return ok
+}
+
+// getByAddr returns nil if the backend is unknown
+func (s *backendSet) getByAddr(addr netip.AddrPort) *Backend {
+	if !addr.Addr().Unmap().Is4() {
+		return nil
+	}
+	return s.get(addrToServerID(addr))
+}
+
+// get returns nil if the backend is unknown
+func (s *backendSet) get(serverID [connIDServerIDLen]byte) *Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends[serverID]
+}
+
+// all returns the backends, the returned slice must not be modified
+func (s *backendSet) all() []*Backend {
+	return *s.list.Load()
+}
+
+// pool returns the backends of the pool, the returned slice must not be modified
+func (s *backendSet) pool(name string) []*Backend {
+	return (*s.pools.Load())[name]
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBackendDrain(t *testing.T) {
+	backends := newBackendSet()
+	b, err := backends.add(netip.MustParseAddrPort("127.0.0.1:8292"))
+	require.NoError(t, err)
+	assert.True(t, b.available())
+	assert.True(t, b.drain(time.Now().Add(time.Hour)))
+	assert.False(t, b.available())
+	assert.True(t, b.reachable(time.Now()))
+	assert.False(t, b.drain(time.Now().Add(-time.Second)))
+	assert.False(t, b.reachable(time.Now()))
+	assert.True(t, b.undrain())
+	assert.True(t, b.available())
+	assert.True(t, b.reachable(time.Now()))
+	assert.True(t, b.DrainDeadline().IsZero())
+}
+
+func TestBackendStartDrainingKeepsDeadline(t *testing.T) {
+	backends := newBackendSet()
+	b, err := backends.add(netip.MustParseAddrPort("127.0.0.1:8292"))
+	require.NoError(t, err)
+	assert.True(t, b.startDraining())
+	assert.False(t, b.available())
+	assert.True(t, b.DrainDeadline().IsZero())
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	b.drain(deadline)
+	// a draining control message of the backend does not remove the deadline of the operator
+	assert.False(t, b.startDraining())
+	assert.True(t, deadline.Equal(b.DrainDeadline()))
+}
+
+func TestBackendReadyKeepsOperatorDrain(t *testing.T) {
+	backends := newBackendSet()
+	b, err := backends.add(netip.MustParseAddrPort("127.0.0.1:8292"))
+	require.NoError(t, err)
+	assert.True(t, b.startDraining())
+	assert.True(t, b.ready())
+	assert.True(t, b.available())
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	assert.True(t, b.drain(deadline))
+	assert.False(t, b.startDraining())
+	assert.False(t, b.ready())
+	assert.False(t, b.available())
+	assert.True(t, deadline.Equal(b.DrainDeadline()))
+	// the drain the backend announced remains when the operator undrains it
+	assert.False(t, b.startDraining())
+	assert.True(t, b.undrain())
+	assert.True(t, b.Draining())
+	assert.False(t, b.DrainedByOperator())
+	assert.True(t, b.ready())
+	assert.True(t, b.available())
+}
+
+func TestOperatorDrainSurvivesReady(t *testing.T) {
+	replay, logs, _, routerAddr := newAbuseReplay(t, nil)
+	backendAddr := netip.MustParseAddrPort("10.0.0.1:4433")
+	serverKey, err := DeriveServerKeyFromAddr([32]byte{1}, backendAddr, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	packer, err := NewControlMessagePacker(serverKey)
+	require.NoError(t, err)
+	b := replay.router.backends.getByAddr(backendAddr)
+	now := time.Unix(1700000000, 0)
+	deadline := now.Add(time.Hour)
+	require.NoError(t, replay.router.DrainBackend(backendAddr, deadline))
+
+	decision, err := replay.Route(now, backendAddr, routerAddr, packer.Ready())
+	require.NoError(t, err)
+	assert.Contains(t, decision, "applied ready")
+	assert.True(t, b.DrainedByOperator())
+	assert.False(t, b.available())
+	assert.True(t, deadline.Equal(b.DrainDeadline()))
+	assert.Contains(t, logs.String(), "remains drained by the operator")
+
+	// with health checks, the health checker decides if the backend is up
+	replay.router.healthChecker = newHealthChecker(replay.router, HealthCheckConfig{})
+	replay.router.setBackendState(b, BackendDown)
+	_, err = replay.Route(now, backendAddr, routerAddr, packer.Ready())
+	require.NoError(t, err)
+	assert.Equal(t, BackendDown, b.State())
+}
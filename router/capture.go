@@ -0,0 +1,253 @@
+package router
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Capture writes the datagrams a router receives and sends to a pcapng file.
+// Received datagrams are annotated with the decision of the router as pcapng comment,
+// e.g. the classification, the decoded server ID, the client address of backend packets and the drop reason.
+type Capture struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	pcapng *pcapngWriter
+	// closer is closed by Close, it is nil if the writer is no io.Closer
+	closer io.Closer
+	// filter is nil if all datagrams are captured
+	filter  *CaptureFilter
+	packets uint64
+	closed  bool
+	// err is the first write error, later datagrams are not captured
+	err error
+}
+
+// NewCapture writes the pcapng header.
+// If w is an io.Closer, it is closed by Close.
+func NewCapture(w io.Writer, filter *CaptureFilter) (*Capture, error) {
+	c := &Capture{w: bufio.NewWriter(w), filter: filter}
+	if closer, ok := w.(io.Closer); ok {
+		c.closer = closer
+	}
+	var err error
+	c.pcapng, err = newPcapngWriter(c.w)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// write captures the datagram of the trace and the datagrams sent by the router in response
+func (c *Capture) write(t *packetTrace) {
+	if !c.filter.match(t) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.err != nil {
+		return
+	}
+	c.err = c.pcapng.writePacket(t.received, t.from, t.listener.localAddr, t.datagram, t.String())
+	c.packets++
+	for _, sent := range t.sent {
+		if c.err != nil {
+			return
+		}
+		c.err = c.pcapng.writePacket(t.received, t.listener.localAddr, sent.to, sent.datagram, "sent: "+t.decision)
+		c.packets++
+	}
+}
+
+// Packets returns the number of captured datagrams
+func (c *Capture) Packets() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.packets
+}
+
+// Close flushes the capture, datagrams are no longer captured.
+// Returns the first write error.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+	if err := c.w.Flush(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.closer != nil {
+		if err := c.closer.Close(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	return c.err
+}
+
+func (c *Capture) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// StartCapture captures the datagrams of the router until StopCapture or until the capture is closed.
+// Returns an error if a capture is already running.
+func (r *Router) StartCapture(c *Capture) error {
+	for {
+		old := r.capture.Load()
+		if old != nil && !old.isClosed() {
+			return fmt.Errorf("a capture is already running")
+		}
+		if r.capture.CompareAndSwap(old, c) {
+			break
+		}
+	}
+	if c.filter != nil {
+		r.logf("started capture of %s\n", c.filter)
+	} else {
+		r.logf("started capture\n")
+	}
+	return nil
+}
+
+// StopCapture stops and returns the running capture, that must be closed by the caller.
+// Returns nil if no capture is running.
+func (r *Router) StopCapture() *Capture {
+	c := r.capture.Swap(nil)
+	if c != nil {
+		r.logf("stopped capture\n")
+	}
+	return c
+}
+
+// CaptureFilter selects the datagrams of a capture by client address or server ID.
+// Terms are "client" followed by an address or prefix and "server" followed by an address or a hex server ID,
+// terms can be negated by "not" and combined by "and", which takes precedence over "or",
+// e.g. "client 192.0.2.0/24 and not server 10.0.0.2:4433 or server 0a0000025111".
+type CaptureFilter struct {
+	expr string
+	// alternatives match if all terms of one alternative match
+	alternatives [][]captureFilterTerm
+}
+
+type captureFilterTerm struct {
+	negated bool
+	// client is valid for client terms
+	client   netip.Prefix
+	serverID [connIDServerIDLen]byte
+}
+
+func ParseCaptureFilter(expr string) (*CaptureFilter, error) {
+	f := &CaptureFilter{expr: expr}
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty capture filter")
+	}
+	var alternative []captureFilterTerm
+	for len(fields) != 0 {
+		var term captureFilterTerm
+		if fields[0] == "not" {
+			term.negated = true
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("failed to parse capture filter: incomplete term")
+		}
+		var err error
+		switch fields[0] {
+		case "client":
+			term.client, err = parseClientPrefix(fields[1])
+		case "server":
+			term.serverID, err = parseServerID(fields[1])
+		default:
+			return nil, fmt.Errorf("failed to parse capture filter: unknown term %q", fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse capture filter: %s", err)
+		}
+		alternative = append(alternative, term)
+		fields = fields[2:]
+		if len(fields) == 0 {
+			break
+		}
+		switch fields[0] {
+		case "and":
+		case "or":
+			f.alternatives = append(f.alternatives, alternative)
+			alternative = nil
+		default:
+			return nil, fmt.Errorf("failed to parse capture filter: expected and or or instead of %q", fields[0])
+		}
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("failed to parse capture filter: incomplete term")
+		}
+	}
+	f.alternatives = append(f.alternatives, alternative)
+	return f, nil
+}
+
+// parseClientPrefix accepts an address or a prefix, mapped IPv4 addresses are unmapped
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return unmapPrefix(prefix), nil
+}
+
+// parseServerID accepts the address of a backend or a hex server ID
+func parseServerID(s string) ([connIDServerIDLen]byte, error) {
+	if addr, err := netip.ParseAddrPort(s); err == nil {
+		if !addr.Addr().Unmap().Is4() {
+			return [connIDServerIDLen]byte{}, fmt.Errorf("server IDs can only encode IPv4 addresses")
+		}
+		return addrToServerID(netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())), nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != connIDServerIDLen {
+		return [connIDServerIDLen]byte{}, fmt.Errorf("expected server address or %d byte hex server ID instead of %q", connIDServerIDLen, s)
+	}
+	return [connIDServerIDLen]byte(b), nil
+}
+
+func (f *CaptureFilter) String() string {
+	return f.expr
+}
+
+// match returns true if the filter is nil
+func (f *CaptureFilter) match(t *packetTrace) bool {
+	if f == nil {
+		return true
+	}
+	for _, alternative := range f.alternatives {
+		matched := true
+		for _, term := range alternative {
+			if term.match(t) == term.negated {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *captureFilterTerm) match(trace *packetTrace) bool {
+	if t.client.IsValid() {
+		return trace.client.IsValid() && t.client.Contains(trace.client.Addr().Unmap())
+	}
+	return trace.hasServerID && trace.serverID == t.serverID
+}
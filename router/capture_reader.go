@@ -0,0 +1,388 @@
+package router
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"time"
+)
+
+// pcap file magic numbers, the nanosecond variant has nanosecond timestamps
+const (
+	pcapMagicMicroseconds     uint32 = 0xA1B2C3D4
+	pcapMagicNanoseconds      uint32 = 0xA1B23C4D
+	pcapngSimplePacketBlock          = 0x00000003
+	pcapngObsoletePacketBlock        = 0x00000002
+	pcapngTsResolDefault             = 6
+)
+
+// link types of the supported captures, see https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLoop      = 108
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+const (
+	etherTypeIPv4      = 0x0800
+	etherTypeIPv6      = 0x86DD
+	etherTypeVLAN      = 0x8100
+	etherTypeQinQ      = 0x88A8
+	maxCaptureBlockLen = 1 << 24
+)
+
+// CapturedDatagram is a UDP datagram of a capture file
+type CapturedDatagram struct {
+	// Number of the packet in the file, counting from 1 like Wireshark
+	Number  int
+	Time    time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Payload []byte
+	// Comment of the pcapng packet, e.g. the decision of the router in a Capture
+	Comment string
+}
+
+// CaptureReader reads the UDP datagrams of a pcap or pcapng file, e.g. of tcpdump or of a Capture.
+// Supported link types are Ethernet, raw IP, Linux cooked capture and BSD loopback.
+// Other packets, IP fragments and truncated datagrams are skipped.
+type CaptureReader struct {
+	r      *bufio.Reader
+	pcapng bool
+	order  binary.ByteOrder
+	// linkType and tsUnit of the pcap file
+	linkType uint32
+	tsUnit   time.Duration
+	// interfaces of the current pcapng section
+	interfaces []captureInterface
+	packets    int
+	skipped    int
+}
+
+type captureInterface struct {
+	linkType uint32
+	// tsResol is the if_tsresol option, see draft-ietf-opsawg-pcapng
+	tsResol byte
+}
+
+// NewCaptureReader reads the file header
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{r: bufio.NewReader(r)}
+	magic, err := c.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeaderBlock {
+		c.pcapng = true
+		return c, nil
+	}
+	var hdr [24]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[:]) {
+		case pcapMagicMicroseconds:
+			c.order, c.tsUnit = order, time.Microsecond
+		case pcapMagicNanoseconds:
+			c.order, c.tsUnit = order, time.Nanosecond
+		}
+	}
+	if c.order == nil {
+		return nil, fmt.Errorf("no pcap or pcapng file")
+	}
+	// the upper bits carry the FCS length
+	c.linkType = c.order.Uint32(hdr[20:]) & 0x0FFFFFFF
+	return c, nil
+}
+
+// Skipped returns the number of packets that were no complete UDP datagrams
+func (c *CaptureReader) Skipped() int {
+	return c.skipped
+}
+
+// Next returns the next UDP datagram, or io.EOF at the end of the file
+func (c *CaptureReader) Next() (*CapturedDatagram, error) {
+	for {
+		var d *CapturedDatagram
+		var err error
+		if c.pcapng {
+			d, err = c.nextPcapngPacket()
+		} else {
+			d, err = c.nextPcapPacket()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			return d, nil
+		}
+	}
+}
+
+// nextPcapPacket returns nil if the packet is no UDP datagram
+func (c *CaptureReader) nextPcapPacket() (*CapturedDatagram, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated pcap record")
+		}
+		return nil, err
+	}
+	capLen := c.order.Uint32(hdr[8:])
+	if capLen > maxCaptureBlockLen {
+		return nil, fmt.Errorf("pcap record of %d byte", capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, fmt.Errorf("truncated pcap record")
+	}
+	ts := time.Unix(int64(c.order.Uint32(hdr[:])), int64(c.order.Uint32(hdr[4:]))*int64(c.tsUnit))
+	return c.datagram(c.linkType, ts, data, ""), nil
+}
+
+// nextPcapngPacket returns nil if the block is no packet of a UDP datagram
+func (c *CaptureReader) nextPcapngPacket() (*CapturedDatagram, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated pcapng block")
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) == pcapngSectionHeaderBlock {
+		// the byte order magic of the section header determines the byte order of the section
+		bom, err := c.r.Peek(4)
+		if err != nil {
+			return nil, fmt.Errorf("truncated pcapng block")
+		}
+		c.order = nil
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			if order.Uint32(bom) == pcapngByteOrderMagic {
+				c.order = order
+			}
+		}
+		if c.order == nil {
+			return nil, fmt.Errorf("invalid pcapng byte order magic")
+		}
+		c.interfaces = nil
+	}
+	if c.order == nil {
+		return nil, fmt.Errorf("pcapng file does not start with a section header")
+	}
+	blockType, blockLen := c.order.Uint32(hdr[:]), c.order.Uint32(hdr[4:])
+	if blockLen < 12 || blockLen%4 != 0 || blockLen > maxCaptureBlockLen {
+		return nil, fmt.Errorf("invalid pcapng block length %d", blockLen)
+	}
+	block := make([]byte, blockLen-8)
+	if _, err := io.ReadFull(c.r, block); err != nil {
+		return nil, fmt.Errorf("truncated pcapng block")
+	}
+	body := block[:len(block)-4]
+	switch blockType {
+	case pcapngInterfaceDescBlock:
+		if len(body) < 8 {
+			return nil, fmt.Errorf("invalid pcapng interface description")
+		}
+		i := captureInterface{linkType: uint32(c.order.Uint16(body)), tsResol: pcapngTsResolDefault}
+		if value, ok := c.pcapngOption(body[8:], pcapngOptIfTsResol); ok && len(value) == 1 {
+			i.tsResol = value[0]
+		}
+		c.interfaces = append(c.interfaces, i)
+	case pcapngEnhancedPacketBlock:
+		if len(body) < 20 {
+			return nil, fmt.Errorf("invalid pcapng packet")
+		}
+		interfaceID, capLen := c.order.Uint32(body), c.order.Uint32(body[12:])
+		if int(interfaceID) >= len(c.interfaces) || uint64(capLen) > uint64(len(body)-20) {
+			return nil, fmt.Errorf("invalid pcapng packet")
+		}
+		i := c.interfaces[interfaceID]
+		ts := uint64(c.order.Uint32(body[4:]))<<32 | uint64(c.order.Uint32(body[8:]))
+		options := body[min(20+pcapngPaddedLen(int(capLen)), len(body)):]
+		comment, _ := c.pcapngOption(options, pcapngOptComment)
+		return c.datagram(i.linkType, i.timestamp(ts), body[20:20+capLen], string(comment)), nil
+	case pcapngSimplePacketBlock:
+		if len(body) < 4 || len(c.interfaces) == 0 {
+			return nil, fmt.Errorf("invalid pcapng simple packet")
+		}
+		// simple packets have no timestamp and the snap length of the first interface
+		data := body[4:]
+		if origLen := c.order.Uint32(body); uint64(origLen) < uint64(len(data)) {
+			data = data[:origLen]
+		}
+		return c.datagram(c.interfaces[0].linkType, time.Time{}, data, ""), nil
+	case pcapngObsoletePacketBlock:
+		c.packets++
+		c.skipped++
+	}
+	return nil, nil
+}
+
+// pcapngOption returns the value of the first option with the code
+func (c *CaptureReader) pcapngOption(options []byte, code uint16) ([]byte, bool) {
+	for len(options) >= 4 {
+		optCode, optLen := c.order.Uint16(options), int(c.order.Uint16(options[2:]))
+		if optCode == pcapngOptEndOfOpt || 4+optLen > len(options) {
+			break
+		}
+		if optCode == code {
+			return options[4 : 4+optLen], true
+		}
+		options = options[min(4+pcapngPaddedLen(optLen), len(options)):]
+	}
+	return nil, false
+}
+
+func pcapngPaddedLen(n int) int {
+	return n + (4-n%4)%4
+}
+
+// timestamp converts a timestamp in units of the if_tsresol of the interface
+func (i captureInterface) timestamp(ts uint64) time.Time {
+	var perSecond uint64
+	switch {
+	case i.tsResol&0x80 != 0 && i.tsResol&0x7F < 64:
+		perSecond = 1 << (i.tsResol & 0x7F)
+	case i.tsResol <= 19:
+		perSecond = uint64(math.Pow10(int(i.tsResol)))
+	default:
+		return time.Time{}
+	}
+	// the fraction times 10^9 can exceed 64 bit
+	hi, lo := bits.Mul64(ts%perSecond, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, perSecond)
+	return time.Unix(int64(ts/perSecond), int64(nanos))
+}
+
+// datagram decodes the link layer, IP and UDP header of a packet.
+// Returns nil and counts the packet as skipped if it is no complete, unfragmented UDP datagram.
+func (c *CaptureReader) datagram(linkType uint32, ts time.Time, data []byte, comment string) *CapturedDatagram {
+	c.packets++
+	packet, ok := linkLayerPayload(linkType, data)
+	if ok {
+		var d *CapturedDatagram
+		d, ok = parseIPUDPPacket(packet)
+		if ok {
+			d.Number = c.packets
+			d.Time = ts
+			d.Comment = comment
+			return d
+		}
+	}
+	c.skipped++
+	return nil
+}
+
+// linkLayerPayload returns the IP packet of a link layer frame
+func linkLayerPayload(linkType uint32, frame []byte) ([]byte, bool) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return frame, true
+	case linkTypeNull, linkTypeLoop:
+		// the address family is in host or network byte order, the IP version suffices
+		if len(frame) < 4 {
+			return nil, false
+		}
+		return frame[4:], true
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		etherType, payload := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(payload) < 4 {
+				return nil, false
+			}
+			etherType, payload = binary.BigEndian.Uint16(payload[2:]), payload[4:]
+		}
+		return payload, etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[14:])
+		return frame[16:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(frame)
+		return frame[20:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	default:
+		return nil, false
+	}
+}
+
+// IPv6 extension headers that can precede the UDP header
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6DestOptions = 60
+)
+
+// parseIPUDPPacket returns the datagram of an IP packet, the payload is not copied
+func parseIPUDPPacket(packet []byte) (*CapturedDatagram, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+	var src, dst netip.Addr
+	var udp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4HeaderLen {
+			return nil, false
+		}
+		hdrLen, totalLen := int(packet[0]&0x0F)*4, int(binary.BigEndian.Uint16(packet[2:]))
+		flagsAndOffset := binary.BigEndian.Uint16(packet[6:])
+		// fragments are skipped, more fragments bit or fragment offset
+		if hdrLen < ipv4HeaderLen || totalLen < hdrLen || totalLen > len(packet) || flagsAndOffset&0x3FFF != 0 || packet[9] != ipProtocolUDP {
+			return nil, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20]))
+		udp = packet[hdrLen:totalLen]
+	case 6:
+		if len(packet) < 40 {
+			return nil, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(packet[4:]))
+		if 40+payloadLen > len(packet) {
+			return nil, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40]))
+		nextHdr, payload := packet[6], packet[40:40+payloadLen]
+		for nextHdr == ipv6HopByHop || nextHdr == ipv6Routing || nextHdr == ipv6DestOptions {
+			if len(payload) < 8 || len(payload) < 8+int(payload[1])*8 {
+				return nil, false
+			}
+			nextHdr, payload = payload[0], payload[8+int(payload[1])*8:]
+		}
+		if nextHdr != ipProtocolUDP {
+			return nil, false
+		}
+		udp = payload
+	default:
+		return nil, false
+	}
+	if len(udp) < 8 {
+		return nil, false
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return nil, false
+	}
+	return &CapturedDatagram{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp)),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(udp[2:])),
+		Payload: udp[8:udpLen],
+	}, true
+}
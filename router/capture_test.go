@@ -0,0 +1,123 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCaptureFilter(t *testing.T) {
+	server := netip.MustParseAddrPort("10.0.0.2:4433")
+	trace := &packetTrace{client: netip.MustParseAddrPort("[::ffff:192.0.2.7]:1234")}
+	trace.setServerID(addrToServerID(server))
+
+	for expr, expected := range map[string]bool{
+		"client 192.0.2.0/24":                                 true,
+		"client 192.0.2.7":                                    true,
+		"client ::ffff:192.0.2.0/120":                         true,
+		"client 198.51.100.0/24":                              false,
+		"server 10.0.0.2:4433":                                true,
+		"server 0a0000025111":                                 true,
+		"client 192.0.2.0/24 and not server 10.0.0.2:4433":    false,
+		"client 198.51.100.0/24 or server 10.0.0.2:4433":      true,
+		"not client 198.51.100.0/24 and server 10.0.0.2:4433": true,
+	} {
+		f, err := ParseCaptureFilter(expr)
+		require.NoError(t, err, expr)
+		assert.Equal(t, expected, f.match(trace), expr)
+	}
+
+	for _, expr := range []string{"", "client", "client 192.0.2.0/24 and", "port 443", "client 192.0.2.0/24 server 10.0.0.2:4433", "server [::1]:443"} {
+		_, err := ParseCaptureFilter(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+// pcapngBlocks returns the bodies of the blocks by type
+func pcapngBlocks(t *testing.T, b []byte) map[uint32][][]byte {
+	blocks := map[uint32][][]byte{}
+	for len(b) != 0 {
+		require.GreaterOrEqual(t, len(b), 12)
+		blockType := binary.LittleEndian.Uint32(b)
+		blockLen := int(binary.LittleEndian.Uint32(b[4:]))
+		require.Equal(t, 0, blockLen%4)
+		require.GreaterOrEqual(t, len(b), blockLen)
+		require.Equal(t, uint32(blockLen), binary.LittleEndian.Uint32(b[blockLen-4:]))
+		blocks[blockType] = append(blocks[blockType], b[8:blockLen-4])
+		b = b[blockLen:]
+	}
+	return blocks
+}
+
+func TestCapture(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	r, secret := startTestRouter(t, backendAddr)
+	routerAddr := r.listeners[0].localAddr
+	client := listenLoopback(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	var buf bytes.Buffer
+	filter, err := ParseCaptureFilter("server " + backendAddr.String())
+	require.NoError(t, err)
+	c, err := NewCapture(&buf, filter)
+	require.NoError(t, err)
+	require.NoError(t, r.StartCapture(c))
+	assert.Error(t, r.StartCapture(c))
+
+	shortHdr := sendShortHeaderPacket(t, client, secret, backendAddr, routerAddr)
+	receiveDatagram(t, backend, shortHdr)
+	packer := newTestPacker(t, secret, backendAddr)
+	datagram, err := packer.AddHdr(shortHdr, clientAddr)
+	require.NoError(t, err)
+	_, err = backend.WriteToUDPAddrPort(datagram, routerAddr)
+	require.NoError(t, err)
+	receiveDatagram(t, client, shortHdr)
+	// not matched by the filter
+	_, err = client.WriteToUDPAddrPort(make([]byte, 30), routerAddr)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return c.Packets() == 4 }, time.Second, time.Millisecond)
+	assert.Same(t, c, r.StopCapture())
+	assert.Nil(t, r.StopCapture())
+	require.NoError(t, c.Close())
+	assert.Equal(t, uint64(4), c.Packets())
+
+	blocks := pcapngBlocks(t, buf.Bytes())
+	require.Len(t, blocks[pcapngSectionHeaderBlock], 1)
+	require.Len(t, blocks[pcapngInterfaceDescBlock], 1)
+	packets := blocks[pcapngEnhancedPacketBlock]
+	require.Len(t, packets, 4)
+	assert.Contains(t, string(packets[0]), "short header from "+clientAddr.String())
+	assert.Contains(t, string(packets[0]), "forwarded to backend "+backendAddr.String())
+	assert.Contains(t, string(packets[1]), "sent: forwarded to backend")
+	assert.Contains(t, string(packets[2]), "backend packet from "+backendAddr.String()+", client "+clientAddr.String())
+	assert.Contains(t, string(packets[3]), "sent: forwarded to client")
+	// the captured packet ends with the UDP payload sent by the client
+	capturedLen := int(binary.LittleEndian.Uint32(packets[0][12:]))
+	assert.Equal(t, 20+8+len(shortHdr), capturedLen)
+	assert.Equal(t, shortHdr, packets[0][20+20+8:20+capturedLen])
+}
+
+func TestIPUDPPacketChecksums(t *testing.T) {
+	payload := []byte("payload")
+	for _, addrs := range [][2]string{{"192.0.2.1:1234", "198.51.100.1:443"}, {"[2001:db8::1]:1234", "[::ffff:198.51.100.1]:443"}} {
+		src, dst := netip.MustParseAddrPort(addrs[0]), netip.MustParseAddrPort(addrs[1])
+		packet := appendIPUDPPacket(nil, src, dst, payload)
+		ipHdrLen, pseudoHeader := 40, append(append([]byte{}, packet[8:40]...), 0, ipProtocolUDP)
+		if packet[0]>>4 == 4 {
+			ipHdrLen = 20
+			assert.Equal(t, uint16(0xffff), internetChecksum(0, packet[:20]), "IPv4 header checksum")
+			pseudoHeader = append(append([]byte{}, packet[12:20]...), 0, ipProtocolUDP)
+		}
+		udp := packet[ipHdrLen:]
+		pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(len(udp)))
+		assert.Equal(t, uint16(0xffff), internetChecksum(internetChecksum(0, pseudoHeader), udp), "UDP checksum")
+		assert.Equal(t, payload, udp[8:])
+	}
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/birneee/aes6"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite selects the AEAD used for connection ID and extension header protection.
+// The numeric value is part of the wire format.
+type CipherSuite uint8
+
+const (
+	CipherSuiteAES256GCM CipherSuite = iota
+	CipherSuiteAES128GCM
+	CipherSuiteChaCha20Poly1305
+	numCipherSuites
+)
+
+var CipherSuites = []CipherSuite{CipherSuiteAES256GCM, CipherSuiteAES128GCM, CipherSuiteChaCha20Poly1305}
+
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteAES256GCM:
+		return "aes-256-gcm"
+	case CipherSuiteAES128GCM:
+		return "aes-128-gcm"
+	case CipherSuiteChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown cipher suite %d", uint8(s))
+	}
+}
+
+func ParseCipherSuite(s string) (CipherSuite, error) {
+	for _, suite := range CipherSuites {
+		if suite.String() == s {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", s)
+}
+
+func (s CipherSuite) Valid() bool {
+	return s < numCipherSuites
+}
+
+func (s CipherSuite) keyLen() int {
+	switch s {
+	case CipherSuiteAES128GCM:
+		return 16
+	case CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.KeySize
+	default:
+		return 32
+	}
+}
+
+// newAEAD returns an AEAD with a 12 byte nonce
+func (s CipherSuite) newAEAD(key []byte, tagSize int) (cipher.AEAD, error) {
+	switch s {
+	case CipherSuiteAES256GCM, CipherSuiteAES128GCM:
+		c, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return aes6.NewGCMWithTagSize(c, tagSize)
+	case CipherSuiteChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+		if tagSize == aead.Overhead() {
+			return aead, nil
+		}
+		return &truncatedTagAEAD{AEAD: aead, tagSize: tagSize}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %d", uint8(s))
+	}
+}
+
+// truncatedTagAEAD shortens the authentication tag of an AEAD
+// that does not support other tag sizes natively.
+type truncatedTagAEAD struct {
+	cipher.AEAD
+	tagSize int
+}
+
+func (a *truncatedTagAEAD) Overhead() int {
+	return a.tagSize
+}
+
+func (a *truncatedTagAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	sealed := a.AEAD.Seal(nil, nonce, plaintext, additionalData)
+	return append(dst, sealed[:len(plaintext)+a.tagSize]...)
+}
+
+// Open only supports empty plaintexts,
+// because the truncated tag cannot be verified by the underlying AEAD.
+func (a *truncatedTagAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) != a.tagSize {
+		return nil, errors.New("truncated tag AEAD only supports empty plaintexts")
+	}
+	expected := a.Seal(nil, nonce, nil, additionalData)
+	if subtle.ConstantTimeCompare(expected, ciphertext) != 1 {
+		return nil, errors.New("message authentication failed")
+	}
+	return dst, nil
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+)
+
+func TestCipherSuitesConnID(t *testing.T) {
+	for _, suite := range CipherSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			var secret [32]byte
+			_, err := rand.Read(secret[:])
+			require.NoError(t, err)
+			p, err := NewConnIDProtector(secret, suite)
+			require.NoError(t, err)
+			addr := netip.MustParseAddrPort("127.0.0.1:8292")
+			connID, err := p.ProtectAddr(addr, [6]byte{1, 2, 3, 4, 5, 6})
+			require.NoError(t, err)
+			serverID, _, err := p.Decode(connID[:])
+			assert.NoError(t, err)
+			assert.Equal(t, addr, serverIDToAddr(serverID))
+			connID[7] ^= 1
+			_, _, err = p.Decode(connID[:])
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCipherSuiteIdentifiedInExtHdr(t *testing.T) {
+	var secret [32]byte
+	_, err := rand.Read(secret[:])
+	require.NoError(t, err)
+	sender, err := NewNonQuicPrefixClientIDExtHdrPacker(secret, CipherSuiteChaCha20Poly1305)
+	require.NoError(t, err)
+	receiver, err := NewNonQuicPrefixClientIDExtHdrPacker(secret, CipherSuiteAES128GCM)
+	require.NoError(t, err)
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:8292")
+	packed, err := sender.AddHdr([]byte{1, 2, 3, 4}, clientAddr)
+	require.NoError(t, err)
+	hdrType, suite := splitExtHdrType(packed[0])
+	assert.Equal(t, ClientAddrExtHdrType, hdrType)
+	assert.Equal(t, CipherSuiteChaCha20Poly1305, suite)
+	unpackedClientAddr, _, err := receiver.RemoveHdr(packed, true)
+	assert.NoError(t, err)
+	assert.Equal(t, clientAddr, unpackedClientAddr)
+}
+
+func TestParseCipherSuite(t *testing.T) {
+	for _, suite := range CipherSuites {
+		parsed, err := ParseCipherSuite(suite.String())
+		assert.NoError(t, err)
+		assert.Equal(t, suite, parsed)
+	}
+	_, err := ParseCipherSuite("rot13")
+	assert.Error(t, err)
+}
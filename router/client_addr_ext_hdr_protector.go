@@ -8,10 +8,10 @@ type ClientAddrExtHdrProtector struct {
 	extHdrProtector *ExtensionHeaderProtector
 }
 
-func NewClientAddrExtHdrProtector(secret [32]byte) (*ClientAddrExtHdrProtector, error) {
+func NewClientAddrExtHdrProtector(secret [32]byte, suite CipherSuite) (*ClientAddrExtHdrProtector, error) {
 	p := &ClientAddrExtHdrProtector{}
 	var err error
-	p.extHdrProtector, err = NewExtensionHeaderProtector(secret)
+	p.extHdrProtector, err = NewExtensionHeaderProtector(secret, suite)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,202 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"github.com/quic-go/quic-go/quicvarint"
+	"golang.org/x/crypto/cryptobyte"
+	"slices"
+)
+
+// frame types allowed in Initial packets, see RFC 9000 Section 12.4
+const (
+	frameTypePadding         = 0x00
+	frameTypePing            = 0x01
+	frameTypeAck             = 0x02
+	frameTypeAckECN          = 0x03
+	frameTypeCrypto          = 0x06
+	frameTypeConnectionClose = 0x1c
+)
+
+const (
+	// maxClientHelloLen limits the memory of a reassembled ClientHello
+	maxClientHelloLen = 16 * 1024
+	// maxCryptoRanges limits the fragmentation of the reassembled CRYPTO data
+	maxCryptoRanges = 32
+	// tlsHandshakeTypeClientHello see RFC 8446 Section 4
+	tlsHandshakeTypeClientHello = 1
+	tlsExtensionServerName      = 0
+	tlsExtensionALPN            = 16
+)
+
+var ErrorInvalidClientHello = errors.New("invalid client hello")
+
+// parseCryptoFrames calls f for every CRYPTO frame in the payload of an Initial packet
+func parseCryptoFrames(payload []byte, f func(offset uint64, data []byte) error) error {
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		frameType, err := quicvarint.Read(r)
+		if err != nil {
+			return ErrorInvalidInitialPacket
+		}
+		switch frameType {
+		case frameTypePadding, frameTypePing:
+		case frameTypeAck, frameTypeAckECN:
+			// largest acknowledged, delay, range count, first range
+			var values [4]uint64
+			for i := range values {
+				if values[i], err = quicvarint.Read(r); err != nil {
+					return ErrorInvalidInitialPacket
+				}
+			}
+			n := 2 * values[2] // gap and length of every range
+			if frameType == frameTypeAckECN {
+				n += 3
+			}
+			for i := uint64(0); i < n; i++ {
+				if _, err := quicvarint.Read(r); err != nil {
+					return ErrorInvalidInitialPacket
+				}
+			}
+		case frameTypeCrypto:
+			offset, err := quicvarint.Read(r)
+			if err != nil {
+				return ErrorInvalidInitialPacket
+			}
+			length, err := quicvarint.Read(r)
+			if err != nil || length > uint64(r.Len()) {
+				return ErrorInvalidInitialPacket
+			}
+			start := len(payload) - r.Len()
+			if err := f(offset, payload[start:start+int(length)]); err != nil {
+				return err
+			}
+			_, _ = r.Seek(int64(length), 1)
+		case frameTypeConnectionClose:
+			// the client aborts the handshake, there is no ClientHello to route by
+			return ErrorInvalidInitialPacket
+		default:
+			return ErrorInvalidInitialPacket
+		}
+	}
+	return nil
+}
+
+// cryptoAssembler reassembles the CRYPTO stream of Initial packets up to the end of the ClientHello
+type cryptoAssembler struct {
+	buf []byte
+	// ranges are the sorted and merged received ranges of the stream
+	ranges [][2]uint64
+}
+
+func (a *cryptoAssembler) add(offset uint64, data []byte) error {
+	end := offset + uint64(len(data))
+	if end > maxClientHelloLen {
+		return ErrorInvalidClientHello
+	}
+	if end > uint64(len(a.buf)) {
+		a.buf = append(a.buf, make([]byte, int(end)-len(a.buf))...)
+	}
+	copy(a.buf[offset:], data)
+	a.ranges = append(a.ranges, [2]uint64{offset, end})
+	slices.SortFunc(a.ranges, func(x, y [2]uint64) int {
+		return int(x[0]) - int(y[0])
+	})
+	merged := a.ranges[:1]
+	for _, rng := range a.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rng[0] <= last[1] {
+			last[1] = max(last[1], rng[1])
+		} else {
+			merged = append(merged, rng)
+		}
+	}
+	a.ranges = merged
+	if len(a.ranges) > maxCryptoRanges {
+		return ErrorInvalidClientHello
+	}
+	return nil
+}
+
+// clientHello returns the ClientHello message including its header,
+// or false if it is not received completely yet
+func (a *cryptoAssembler) clientHello() ([]byte, bool, error) {
+	if len(a.ranges) == 0 || a.ranges[0][0] != 0 {
+		return nil, false, nil
+	}
+	contiguous := a.buf[:a.ranges[0][1]]
+	if len(contiguous) < 4 {
+		return nil, false, nil
+	}
+	if contiguous[0] != tlsHandshakeTypeClientHello {
+		return nil, false, ErrorInvalidClientHello
+	}
+	msgLen := 4 + (int(contiguous[1])<<16 | int(contiguous[2])<<8 | int(contiguous[3]))
+	if msgLen > maxClientHelloLen {
+		return nil, false, ErrorInvalidClientHello
+	}
+	if len(contiguous) < msgLen {
+		return nil, false, nil
+	}
+	return contiguous[:msgLen], true, nil
+}
+
+// clientHelloInfo contains the fields of a ClientHello used for routing
+type clientHelloInfo struct {
+	serverName string
+	alpn       []string
+}
+
+// parseClientHello parses a ClientHello message including its header, see RFC 8446 Section 4.1.2
+func parseClientHello(msg []byte) (clientHelloInfo, error) {
+	var info clientHelloInfo
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var body, sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != tlsHandshakeTypeClientHello ||
+		!s.ReadUint24LengthPrefixed(&body) || !s.Empty() ||
+		!body.Skip(2+32) || // legacy version and random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return clientHelloInfo{}, ErrorInvalidClientHello
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return clientHelloInfo{}, ErrorInvalidClientHello
+		}
+		switch extType {
+		case tlsExtensionServerName:
+			var names cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&names) {
+				return clientHelloInfo{}, ErrorInvalidClientHello
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return clientHelloInfo{}, ErrorInvalidClientHello
+				}
+				if nameType == 0 { // host_name
+					info.serverName = string(name)
+				}
+			}
+		case tlsExtensionALPN:
+			var protocols cryptobyte.String
+			if !ext.ReadUint16LengthPrefixed(&protocols) {
+				return clientHelloInfo{}, ErrorInvalidClientHello
+			}
+			for !protocols.Empty() {
+				var protocol cryptobyte.String
+				if !protocols.ReadUint8LengthPrefixed(&protocol) || len(protocol) == 0 {
+					return clientHelloInfo{}, ErrorInvalidClientHello
+				}
+				info.alpn = append(info.alpn, string(protocol))
+			}
+		}
+	}
+	return info, nil
+}
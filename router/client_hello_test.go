@@ -0,0 +1,187 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/cryptobyte"
+	"slices"
+	"testing"
+	"time"
+)
+
+// captureClientInitials returns the first datagrams of a quic-go client
+func captureClientInitials(t *testing.T, version quic.VersionNumber, serverName string, alpn []string) [][]byte {
+	server := listenLoopback(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		_, _ = quic.DialAddr(ctx, server.LocalAddr().String(), &tls.Config{ServerName: serverName, NextProtos: alpn}, &quic.Config{
+			Versions: []quic.VersionNumber{version},
+		})
+	}()
+	var datagrams [][]byte
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	for {
+		buf := make([]byte, MTU)
+		n, err := server.Read(buf)
+		if err != nil {
+			break
+		}
+		datagrams = append(datagrams, buf[:n])
+	}
+	require.NotEmpty(t, datagrams)
+	return datagrams
+}
+
+func TestParseClientHelloOfInitials(t *testing.T) {
+	for _, version := range []quic.VersionNumber{quic.Version1, quic.Version2} {
+		t.Run(version.String(), func(t *testing.T) {
+			datagrams := captureClientInitials(t, version, "example.com", []string{"h3", "hq-interop"})
+			var crypto cryptoAssembler
+			var msg []byte
+			complete := false
+			for _, datagram := range datagrams {
+				hdr, err := parseLongHeader(datagram)
+				require.NoError(t, err)
+				payload, err := decryptInitialPacket(datagram, &hdr)
+				require.NoError(t, err)
+				require.NoError(t, parseCryptoFrames(payload, crypto.add))
+				msg, complete, err = crypto.clientHello()
+				require.NoError(t, err)
+				if complete {
+					break
+				}
+			}
+			require.True(t, complete)
+			info, err := parseClientHello(msg)
+			require.NoError(t, err)
+			assert.Equal(t, "example.com", info.serverName)
+			assert.Equal(t, []string{"h3", "hq-interop"}, info.alpn)
+		})
+	}
+}
+
+func TestDecryptInitialPacketInvalid(t *testing.T) {
+	datagram := captureClientInitials(t, quic.Version1, "example.com", nil)[0]
+	hdr, err := parseLongHeader(datagram)
+	require.NoError(t, err)
+	datagram[len(datagram)-1] ^= 1
+	_, err = decryptInitialPacket(datagram, &hdr)
+	assert.ErrorIs(t, err, ErrorInvalidInitialPacket)
+}
+
+func TestCryptoAssemblerOutOfOrder(t *testing.T) {
+	msg := []byte{tlsHandshakeTypeClientHello, 0, 0, 4, 1, 2, 3, 4}
+	var crypto cryptoAssembler
+	require.NoError(t, crypto.add(5, msg[5:]))
+	_, complete, err := crypto.clientHello()
+	require.NoError(t, err)
+	assert.False(t, complete)
+	require.NoError(t, crypto.add(0, msg[:6]))
+	assembled, complete, err := crypto.clientHello()
+	require.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, msg, assembled)
+	assert.Error(t, crypto.add(maxClientHelloLen, []byte{1}))
+}
+
+func TestMatchServerName(t *testing.T) {
+	assert.True(t, matchServerName("example.com", "Example.com"))
+	assert.False(t, matchServerName("example.com", "www.example.com"))
+	assert.True(t, matchServerName("*.example.com", "www.example.com"))
+	assert.False(t, matchServerName("*.example.com", "example.com"))
+	assert.False(t, matchServerName("*.example.com", ".example.com"))
+}
+
+// sealClientInitial creates a client Initial packet with a 2 byte packet number, padded to MinInitialDatagramLen
+func sealClientInitial(t *testing.T, version uint32, destConnID []byte, pn uint16, frames []byte) []byte {
+	keys, err := newClientInitialKeys(version, destConnID)
+	require.NoError(t, err)
+	const pnLen = 2
+	b := []byte{0xc0 | encodePacketType(version, packetTypeInitial) | (pnLen - 1)}
+	b = binary.BigEndian.AppendUint32(b, version)
+	b = append(b, byte(len(destConnID)))
+	b = append(b, destConnID...)
+	b = append(b, 0, 0) // source connection ID and token
+	payloadLen := max(len(frames), MinInitialDatagramLen-len(b)-2-pnLen-initialTagLen)
+	b = quicvarint.AppendWithLen(b, uint64(pnLen+payloadLen+initialTagLen), 2)
+	pnOffset := len(b)
+	b = binary.BigEndian.AppendUint16(b, pn)
+	payload := make([]byte, payloadLen) // padding
+	copy(payload, frames)
+	nonce := slices.Clone(keys.iv)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	nonce[len(nonce)-1] ^= byte(pn)
+	b = keys.aead.Seal(b, nonce, payload, b)
+	var mask [16]byte
+	keys.hp.Encrypt(mask[:], b[pnOffset+maxPacketNumberLen:])
+	b[0] ^= mask[0] & 0x0f
+	b[pnOffset] ^= mask[1]
+	b[pnOffset+1] ^= mask[2]
+	return b
+}
+
+func appendCryptoFrame(b []byte, offset int, data []byte) []byte {
+	b = quicvarint.Append(b, frameTypeCrypto)
+	b = quicvarint.Append(b, uint64(offset))
+	b = quicvarint.Append(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// buildClientHello creates a ClientHello with a padding extension
+func buildClientHello(serverName string, alpn string, paddingLen int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(tlsHandshakeTypeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0) // session ID
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(0x1301) })
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(tlsExtensionServerName)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(serverName)) })
+				})
+			})
+			b.AddUint16(tlsExtensionALPN)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(alpn)) })
+				})
+			})
+			b.AddUint16(21) // padding
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, paddingLen)) })
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestParseClientHelloSpanningPackets(t *testing.T) {
+	msg := buildClientHello("example.com", "h3", 2000)
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	first := sealClientInitial(t, Version2, destConnID, 0, appendCryptoFrame(nil, 0, msg[:1000]))
+	second := sealClientInitial(t, Version2, destConnID, 1, appendCryptoFrame([]byte{frameTypePing}, 1000, msg[1000:]))
+	var crypto cryptoAssembler
+	for _, datagram := range [][]byte{second, first} {
+		hdr, err := parseLongHeader(datagram)
+		require.NoError(t, err)
+		payload, err := decryptInitialPacket(datagram, &hdr)
+		require.NoError(t, err)
+		require.NoError(t, parseCryptoFrames(payload, crypto.add))
+	}
+	assembled, complete, err := crypto.clientHello()
+	require.NoError(t, err)
+	require.True(t, complete)
+	info, err := parseClientHello(assembled)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", info.serverName)
+	assert.Equal(t, []string{"h3"}, info.alpn)
+}
@@ -7,31 +7,39 @@ import (
 )
 
 type ConnIDGenerator struct {
-	protector *ConnIDProtector
+	protector *ServerConnIDProtector
 	rand      io.Reader
-	serverID  [6]byte
 }
 
-func NewConnIDGenerator(protector *ConnIDProtector, serverID [6]byte, rand io.Reader) ConnIDGenerator {
+func NewConnIDGenerator(protector *ConnIDProtector, serverID [6]byte, rand io.Reader) (ConnIDGenerator, error) {
+	serverProtector, err := protector.serverProtectors.get(serverID)
+	if err != nil {
+		return ConnIDGenerator{}, err
+	}
+	return NewConnIDGeneratorFromServerProtector(serverProtector, rand), nil
+}
+
+func NewConnIDGeneratorFromAddr(protector *ConnIDProtector, serverAddr netip.AddrPort, rand io.Reader) (ConnIDGenerator, error) {
+	return NewConnIDGenerator(protector, addrToServerID(serverAddr), rand)
+}
+
+// NewConnIDGeneratorFromServerProtector is used by backends,
+// which only know their own ServerKey.
+func NewConnIDGeneratorFromServerProtector(protector *ServerConnIDProtector, rand io.Reader) ConnIDGenerator {
 	g := ConnIDGenerator{
 		protector: protector,
 		rand:      rand,
-		serverID:  serverID,
 	}
 	return g
 }
 
-func NewConnIDGeneratorFromAddr(protector *ConnIDProtector, serverAddr netip.AddrPort, rand io.Reader) ConnIDGenerator {
-	return NewConnIDGenerator(protector, addrToServerID(serverAddr), rand)
-}
-
 func (c ConnIDGenerator) GenerateConnectionID() (quic.ConnectionID, error) {
 	var random [6]byte
 	_, err := c.rand.Read(random[:])
 	if err != nil {
 		return quic.ConnectionID{}, err
 	}
-	connID := c.protector.Protect(c.serverID, random)
+	connID := c.protector.Protect(random)
 	return quic.ConnectionIDFromBytes(connID[:]), nil
 }
 
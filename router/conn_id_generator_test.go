@@ -12,10 +12,11 @@ func TestConnIDGenerator(t *testing.T) {
 	var secret [32]byte
 	_, err := rand.Reader.Read(secret[:])
 	assert.NoError(t, err)
-	protector, err := NewConnIDProtector(secret)
+	protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
 	require.NoError(t, err)
 	addr := netip.MustParseAddrPort("127.0.0.1:8292")
-	connIDGen := NewConnIDGeneratorFromAddr(protector, addr)
+	connIDGen, err := NewConnIDGeneratorFromAddr(protector, addr, rand.Reader)
+	require.NoError(t, err)
 	connID, err := connIDGen.GenerateConnectionID()
 	assert.NoError(t, err)
 	_, _, err = protector.Decode(connID.Bytes())
@@ -3,6 +3,7 @@ package router
 import (
 	"crypto/cipher"
 	"encoding/binary"
+	"fmt"
 	"github.com/quic-go/quic-go"
 	"net/netip"
 )
@@ -13,33 +14,101 @@ const (
 	connIDMACLen      = 6
 	connIDRandomLen   = 6
 	connIDLen         = connIDServerIDLen + connIDMACLen + connIDRandomLen
+	// ConnIDLen is the length of the connection IDs of all backends
+	ConnIDLen = connIDLen
 )
 
-var connIDHkdfInfo = []byte("quic lb")
-
-type ConnIDProtector struct {
-	secret    [connIDKeyLen]byte
+// ServerConnIDProtector protects the connection IDs of a single server.
+// The connection ID consists of the concealed server ID,
+// a MAC using the server key and a random nonce.
+type ServerConnIDProtector struct {
+	key       ServerKey
 	aead      cipher.AEAD
 	aeadNonce []byte
 }
 
-func NewConnIDProtector(secret [connIDKeyLen]byte) (*ConnIDProtector, error) {
+func NewServerConnIDProtector(key ServerKey) (*ServerConnIDProtector, error) {
+	p := &ServerConnIDProtector{
+		key: key,
+	}
+	var err error
+	p.aead, p.aeadNonce, err = createAEAD(key.Secret, key.CipherSuite, connIDMACLen, labelConnID)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *ServerConnIDProtector) Protect(random [connIDRandomLen]byte) [connIDLen]byte {
+	var connID [connIDLen]byte
+	copy(connID[:], p.key.ConcealedServerID[:])
+	copy(connID[connIDServerIDLen+connIDMACLen:], random[:])
+	p.aead.Seal(connID[connIDServerIDLen:connIDServerIDLen], p.aeadNonce, nil, p.additionalData(random))
+	return connID
+}
+
+// Verify checks the MAC and returns the random nonce
+func (p *ServerConnIDProtector) Verify(connID []byte) ([connIDRandomLen]byte, error) {
+	if len(connID) != connIDLen {
+		return [connIDRandomLen]byte{}, fmt.Errorf("unexpected connection ID length")
+	}
+	var random [connIDRandomLen]byte
+	copy(random[:], connID[connIDServerIDLen+connIDMACLen:])
+	if [connIDServerIDLen]byte(connID[:connIDServerIDLen]) != p.key.ConcealedServerID {
+		return [connIDRandomLen]byte{}, fmt.Errorf("connection ID of other server")
+	}
+	_, err := p.aead.Open(nil, p.aeadNonce, connID[connIDServerIDLen:connIDServerIDLen+connIDMACLen], p.additionalData(random))
+	if err != nil {
+		return [connIDRandomLen]byte{}, err
+	}
+	return random, nil
+}
+
+func (p *ServerConnIDProtector) additionalData(random [connIDRandomLen]byte) []byte {
+	var ad [connIDServerIDLen + connIDRandomLen]byte
+	copy(ad[:], p.key.ConcealedServerID[:])
+	copy(ad[connIDServerIDLen:], random[:])
+	return ad[:]
+}
+
+// ConnIDProtector protects and decodes the connection IDs of all servers.
+// It requires the master secret and is only used by the router.
+type ConnIDProtector struct {
+	secret           [connIDKeyLen]byte
+	suite            CipherSuite
+	serverIDMask     [connIDServerIDLen]byte
+	serverProtectors *perServer[*ServerConnIDProtector]
+}
+
+func NewConnIDProtector(secret [connIDKeyLen]byte, suite CipherSuite) (*ConnIDProtector, error) {
+	if !suite.Valid() {
+		return nil, fmt.Errorf("unsupported cipher suite %d", suite)
+	}
 	p := &ConnIDProtector{
 		secret: secret,
+		suite:  suite,
 	}
 	var err error
-	p.aead, p.aeadNonce, err = createAEAD(secret, connIDMACLen, connIDHkdfInfo)
+	p.serverIDMask, err = deriveServerIDMask(secret)
 	if err != nil {
 		return nil, err
 	}
+	p.serverProtectors = newPerServer(func(serverID [connIDServerIDLen]byte) (*ServerConnIDProtector, error) {
+		key, err := DeriveServerKey(p.secret, serverID, p.suite)
+		if err != nil {
+			return nil, err
+		}
+		return NewServerConnIDProtector(key)
+	})
 	return p, nil
 }
 
-func (p *ConnIDProtector) Protect(serverID [6]byte, random [6]byte) [connIDLen]byte {
-	var ciphertext [connIDLen]byte
-	p.aead.Seal(ciphertext[:0], p.aeadNonce, serverID[:], random[:])
-	copy(ciphertext[12:], random[:])
-	return ciphertext
+func (p *ConnIDProtector) Protect(serverID [6]byte, random [6]byte) ([connIDLen]byte, error) {
+	sp, err := p.serverProtectors.get(serverID)
+	if err != nil {
+		return [connIDLen]byte{}, err
+	}
+	return sp.Protect(random), nil
 }
 
 func addrToServerID(addr netip.AddrPort) [6]byte {
@@ -57,17 +126,27 @@ func serverIDToAddr(serverID [6]byte) netip.AddrPort {
 	)
 }
 
-func (p *ConnIDProtector) ProtectAddr(addr netip.AddrPort, random [6]byte) [connIDLen]byte {
+func (p *ConnIDProtector) ProtectAddr(addr netip.AddrPort, random [6]byte) ([connIDLen]byte, error) {
 	return p.Protect(addrToServerID(addr), random)
 }
 
+// UnverifiedServerID returns the server ID without verifying the MAC.
+// This is cheap and allows to check that the server is known, before deriving its key.
+func (p *ConnIDProtector) UnverifiedServerID(connID []byte) [connIDServerIDLen]byte {
+	return concealServerID([connIDServerIDLen]byte(connID[:connIDServerIDLen]), p.serverIDMask)
+}
+
 // return serverID and random nonce
 func (p *ConnIDProtector) Decode(connID []byte) ([6]byte, [6]byte, error) {
-	ciphertext := connID[:12]
-	var nonce [connIDRandomLen]byte
-	copy(nonce[:], connID[12:])
-	var serverID [connIDServerIDLen]byte
-	_, err := p.aead.Open(serverID[:0], p.aeadNonce, ciphertext, nonce[:])
+	if len(connID) != connIDLen {
+		return [6]byte{}, [6]byte{}, fmt.Errorf("unexpected connection ID length")
+	}
+	serverID := p.UnverifiedServerID(connID)
+	sp, err := p.serverProtectors.get(serverID)
+	if err != nil {
+		return [6]byte{}, [6]byte{}, err
+	}
+	nonce, err := sp.Verify(connID)
 	if err != nil {
 		return [6]byte{}, [6]byte{}, err
 	}
@@ -83,6 +162,9 @@ func (p *ConnIDProtector) DecodeAsAddr(connID quic.ConnectionID) (netip.AddrPort
 }
 
 func (p *ConnIDProtector) DecodeServerIDFromProtectedQUICShortHeaderPacket(buf []byte) ([6]byte, error) {
+	if len(buf) < 1+connIDLen {
+		return [6]byte{}, fmt.Errorf("packet too short")
+	}
 	// destination connection id starts after 1 byte
 	// and is always connIDLen bytes long
 	serverID, _, err := p.Decode(buf[1 : 1+connIDLen])
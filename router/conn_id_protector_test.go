@@ -12,13 +12,14 @@ func TestConnIDProtector(t *testing.T) {
 	var secret [32]byte
 	_, err := rand.Read(secret[:])
 	assert.NoError(t, err)
-	p, err := NewConnIDProtector(secret)
+	p, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
 	require.NoError(t, err)
 	addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 1)
 	var nonce [6]byte
 	_, err = rand.Read(nonce[:])
 	assert.NoError(t, err)
-	connID := p.ProtectAddr(addr, nonce)
+	connID, err := p.ProtectAddr(addr, nonce)
+	require.NoError(t, err)
 	_ = connID
 	var quicPacketShortHeaderPacket [1200]byte
 	copy(quicPacketShortHeaderPacket[1:], connID[:])
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ControlExtHdrType is sent by backends to the router
+const ControlExtHdrType byte = 0b00000101
+
+type ControlMessageType uint8
+
+const (
+	// ControlMessageDraining asks the router to stop sending new connections
+	ControlMessageDraining ControlMessageType = iota + 1
+	// ControlMessageReady asks the router to send new connections again after ControlMessageDraining.
+	// It does not end the drain of an operator,
+	// and only marks the backend up if health checks are disabled.
+	ControlMessageReady
+	// ControlMessageLoadReport reports the load of the backend
+	ControlMessageLoadReport
+)
+
+func (t ControlMessageType) String() string {
+	switch t {
+	case ControlMessageDraining:
+		return "draining"
+	case ControlMessageReady:
+		return "ready"
+	case ControlMessageLoadReport:
+		return "load report"
+	default:
+		return fmt.Sprintf("unknown control message %d", uint8(t))
+	}
+}
+
+const (
+	controlMessageSeqLen = 8
+	controlMessageMACLen = 16
+	// controlMessageHdrLen is the length of type | message type | sequence number
+	controlMessageHdrLen = 1 + 1 + controlMessageSeqLen
+	loadReportLen        = 4 + 2
+)
+
+var ErrorInvalidControlMessage = errors.New("invalid control message")
+
+// LoadReport is the load of a backend
+type LoadReport struct {
+	ActiveConnections uint32
+	// Utilization of the backend, e.g. CPU, from 0 to 1
+	Utilization float64
+}
+
+type controlMessage struct {
+	msgType ControlMessageType
+	seq     uint64
+	load    LoadReport
+}
+
+func deriveControlMessageKey(serverKey ServerKey) ([32]byte, error) {
+	key, err := expandLabel(serverKey.Secret, nil, labelControlMessage, 32)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return [32]byte(key), nil
+}
+
+func controlMessageMAC(key [32]byte, msg []byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(msg)
+	return h.Sum(nil)[:controlMessageMACLen]
+}
+
+// parseControlMessage verifies the MAC, but not the sequence number
+func parseControlMessage(b []byte, key [32]byte) (controlMessage, error) {
+	if len(b) < controlMessageHdrLen+controlMessageMACLen || b[0] != ControlExtHdrType {
+		return controlMessage{}, ErrorInvalidControlMessage
+	}
+	macStart := len(b) - controlMessageMACLen
+	if !hmac.Equal(b[macStart:], controlMessageMAC(key, b[:macStart])) {
+		return controlMessage{}, ErrorInvalidControlMessage
+	}
+	msg := controlMessage{
+		msgType: ControlMessageType(b[1]),
+		seq:     binary.BigEndian.Uint64(b[2:controlMessageHdrLen]),
+	}
+	payload := b[controlMessageHdrLen:macStart]
+	switch msg.msgType {
+	case ControlMessageDraining, ControlMessageReady:
+		if len(payload) != 0 {
+			return controlMessage{}, ErrorInvalidControlMessage
+		}
+	case ControlMessageLoadReport:
+		if len(payload) != loadReportLen {
+			return controlMessage{}, ErrorInvalidControlMessage
+		}
+		msg.load.ActiveConnections = binary.BigEndian.Uint32(payload)
+		msg.load.Utilization = float64(binary.BigEndian.Uint16(payload[4:])) / 10000
+	default:
+		return controlMessage{}, ErrorInvalidControlMessage
+	}
+	return msg, nil
+}
+
+// ControlMessagePacker creates control messages for the router.
+// It is used by backends.
+type ControlMessagePacker struct {
+	key     [32]byte
+	lastSeq uint64
+}
+
+func NewControlMessagePacker(serverKey ServerKey) (*ControlMessagePacker, error) {
+	key, err := deriveControlMessageKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlMessagePacker{key: key}, nil
+}
+
+// nextSeq is based on the time, so it still increases after a restart of the backend
+func (p *ControlMessagePacker) nextSeq() uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if seq <= p.lastSeq {
+		seq = p.lastSeq + 1
+	}
+	p.lastSeq = seq
+	return seq
+}
+
+func (p *ControlMessagePacker) pack(msgType ControlMessageType, payload []byte) []byte {
+	b := make([]byte, 0, controlMessageHdrLen+len(payload)+controlMessageMACLen)
+	b = append(b, ControlExtHdrType, byte(msgType))
+	b = binary.BigEndian.AppendUint64(b, p.nextSeq())
+	b = append(b, payload...)
+	return append(b, controlMessageMAC(p.key, b)...)
+}
+
+// Draining returns the UDP payload of a draining message
+func (p *ControlMessagePacker) Draining() []byte {
+	return p.pack(ControlMessageDraining, nil)
+}
+
+// Ready returns the UDP payload of a ready message
+func (p *ControlMessagePacker) Ready() []byte {
+	return p.pack(ControlMessageReady, nil)
+}
+
+// LoadReport returns the UDP payload of a load report message
+func (p *ControlMessagePacker) LoadReport(load LoadReport) []byte {
+	payload := make([]byte, 0, loadReportLen)
+	payload = binary.BigEndian.AppendUint32(payload, load.ActiveConnections)
+	utilization := min(max(load.Utilization, 0), 1)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(utilization*10000))
+	return p.pack(ControlMessageLoadReport, payload)
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+)
+
+func TestControlMessage(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	serverKey, err := DeriveServerKeyFromAddr(master, netip.MustParseAddrPort("127.0.0.1:8292"), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	key, err := deriveControlMessageKey(serverKey)
+	require.NoError(t, err)
+	packer, err := NewControlMessagePacker(serverKey)
+	require.NoError(t, err)
+
+	draining, err := parseControlMessage(packer.Draining(), key)
+	require.NoError(t, err)
+	assert.Equal(t, ControlMessageDraining, draining.msgType)
+	loadReport, err := parseControlMessage(packer.LoadReport(LoadReport{ActiveConnections: 42, Utilization: 0.5}), key)
+	require.NoError(t, err)
+	assert.Equal(t, ControlMessageLoadReport, loadReport.msgType)
+	assert.Equal(t, LoadReport{ActiveConnections: 42, Utilization: 0.5}, loadReport.load)
+	assert.Greater(t, loadReport.seq, draining.seq)
+
+	tampered := packer.Ready()
+	tampered[1] = byte(ControlMessageDraining)
+	_, err = parseControlMessage(tampered, key)
+	assert.ErrorIs(t, err, ErrorInvalidControlMessage)
+}
@@ -1,64 +1,67 @@
 package router
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
-	"golang.org/x/crypto/hkdf"
-	"io"
 )
 
+// AesMacLen is the authentication tag length of all cipher suites
 const AesMacLen = 16
 const ExtensionHeaderSecretSize int = 32
 
+// ExtensionHeaderProtector seals extension headers with an AEAD, the QUIC packet is the associated data.
+// Every packet is sealed under its own nonce, that is derived from the QUIC packet, see nonce.
 type ExtensionHeaderProtector struct {
-	secret    [ExtensionHeaderSecretSize]byte
-	aead      cipher.AEAD
-	aeadNonce []byte
+	secret [ExtensionHeaderSecretSize]byte
+	suite  CipherSuite
+	aead   cipher.AEAD
+	// nonceMAC derives the nonces of aead, it uses a separate key
+	nonceMAC      cipher.AEAD
+	nonceMACNonce []byte
 }
 
-func NewExtensionHeaderProtector(secret [ExtensionHeaderSecretSize]byte) (*ExtensionHeaderProtector, error) {
+func NewExtensionHeaderProtector(secret [ExtensionHeaderSecretSize]byte, suite CipherSuite) (*ExtensionHeaderProtector, error) {
 	p := &ExtensionHeaderProtector{
 		secret: secret,
+		suite:  suite,
 	}
 	var err error
-	p.aead, p.aeadNonce, err = p.createAEAD()
+	p.aead, _, err = createAEAD(secret, suite, AesMacLen, labelExtHdr)
+	if err != nil {
+		return nil, err
+	}
+	p.nonceMAC, p.nonceMACNonce, err = createAEAD(secret, suite, AesMacLen, labelExtHdrNonce)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-// Protect uses encrypted the QUIC packet as nonce for AES.
+// nonce is the truncated MAC of the QUIC packet, the receiver recomputes it from the packet.
+// The nonce is never sent, so it does not reveal the MAC.
+// Only identical QUIC packets, e.g. replayed ones, share a nonce.
+func (p *ExtensionHeaderProtector) nonce(quicPacket []byte) [aeadNonceLen]byte {
+	var mac [AesMacLen]byte
+	p.nonceMAC.Seal(mac[:0], p.nonceMACNonce, nil, quicPacket)
+	var nonce [aeadNonceLen]byte
+	copy(nonce[:], mac[:])
+	return nonce
+}
+
+// Protect encrypts the extension header under the nonce of the QUIC packet, and authenticates both.
 // This also appends a 16 byte authentication tag
 func (p *ExtensionHeaderProtector) Protect(extHdrData []byte, quicPacket []byte) ([]byte, error) {
-	return p.aead.Seal(nil, p.aeadNonce, extHdrData, quicPacket), nil
+	nonce := p.nonce(quicPacket)
+	return p.aead.Seal(nil, nonce[:], extHdrData, quicPacket), nil
 }
 
-// Decode uses the encrypted QUIC packet as nonce for AES
+// Decode fails if the extension header or the QUIC packet were modified
 func (p *ExtensionHeaderProtector) Decode(protectedExtHdrData []byte, quicPacket []byte) ([]byte, error) {
-	return p.aead.Open(nil, p.aeadNonce, protectedExtHdrData, quicPacket)
+	nonce := p.nonce(quicPacket)
+	return p.aead.Open(nil, nonce[:], protectedExtHdrData, quicPacket)
 }
 
-func (p *ExtensionHeaderProtector) createAEAD() (cipher.AEAD, []byte, error) {
-	h := hkdf.New(sha256.New, p.secret[:], nil, []byte("quic-go token source"))
-	key := make([]byte, 32) // use a 32 byte key, in order to select AES-256
-	if _, err := io.ReadFull(h, key); err != nil {
-		return nil, nil, err
-	}
-	aeadNonce := make([]byte, 12)
-	if _, err := io.ReadFull(h, aeadNonce); err != nil {
-		return nil, nil, err
-	}
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, nil, err
-	}
-	aead, err := cipher.NewGCM(c)
-	if err != nil {
-		return nil, nil, err
-	}
-	return aead, aeadNonce, nil
+func (p *ExtensionHeaderProtector) CipherSuite() CipherSuite {
+	return p.suite
 }
 
 func ProtectedExtensionHeaderDataLen(extensionHeaderDataLen int) int {
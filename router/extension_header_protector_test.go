@@ -3,6 +3,7 @@ package router
 import (
 	"crypto/rand"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -13,7 +14,7 @@ func TestExtensionHeaderProtector(t *testing.T) {
 	quicPacket := make([]byte, 1200)
 	_, err = rand.Read(quicPacket)
 	assert.NoError(t, err)
-	extHdrProtector, err := NewExtensionHeaderProtector(secret)
+	extHdrProtector, err := NewExtensionHeaderProtector(secret, CipherSuiteAES256GCM)
 	assert.NoError(t, err)
 	extHdr := []byte("hello")
 	protectedExtHdr, err := extHdrProtector.Protect(extHdr, quicPacket)
@@ -22,3 +23,30 @@ func TestExtensionHeaderProtector(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, extHdr, decodedExtHdr)
 }
+
+func TestExtensionHeaderProtectorNoncePerPacket(t *testing.T) {
+	for _, suite := range CipherSuites {
+		extHdrProtector, err := NewExtensionHeaderProtector([ExtensionHeaderSecretSize]byte{1}, suite)
+		require.NoError(t, err)
+		packetA := []byte("packet a")
+		packetB := []byte("packet b")
+		extHdrA := []byte{1, 2, 3, 4}
+		extHdrB := []byte{5, 6, 7, 8}
+		protectedA, err := extHdrProtector.Protect(extHdrA, packetA)
+		require.NoError(t, err)
+		protectedB, err := extHdrProtector.Protect(extHdrB, packetB)
+		require.NoError(t, err)
+		// a known extension header does not reveal the extension headers of other packets
+		var keystreamA, keystreamB [4]byte
+		for i := range keystreamA {
+			keystreamA[i] = protectedA[i] ^ extHdrA[i]
+			keystreamB[i] = protectedB[i] ^ extHdrB[i]
+		}
+		assert.NotEqual(t, keystreamA, keystreamB, suite)
+		_, err = extHdrProtector.Decode(protectedA, packetB)
+		assert.Error(t, err, suite)
+		decoded, err := extHdrProtector.Decode(protectedB, packetB)
+		require.NoError(t, err)
+		assert.Equal(t, extHdrB, decoded)
+	}
+}
@@ -0,0 +1,273 @@
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HealthCheckPingExtHdrType is sent by the router to the backends
+	HealthCheckPingExtHdrType byte = 0b00000011
+	// HealthCheckPongExtHdrType is the answer of the backends
+	HealthCheckPongExtHdrType byte = 0b00000100
+)
+
+const (
+	healthCheckNonceLen = 8
+	healthCheckMACLen   = 16
+	// healthCheckLen is the length of ping and pong: type | nonce | MAC
+	healthCheckLen = 1 + healthCheckNonceLen + healthCheckMACLen
+)
+
+const (
+	DefaultHealthCheckInterval = time.Second
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+)
+
+type HealthCheckConfig struct {
+	// Interval between pings, a ping fails if no pong is received within the interval.
+	// The default is DefaultHealthCheckInterval.
+	Interval time.Duration
+	// Rise is the number of consecutive successful checks to mark a backend up.
+	// The default is DefaultHealthCheckRise.
+	Rise int
+	// Fall is the number of consecutive failed checks to mark a backend down.
+	// The default is DefaultHealthCheckFall.
+	Fall int
+	// HandshakeTLSConfig enables an additional QUIC handshake with every backend per interval.
+	// The backends must accept connections without extension header for this.
+	// nil disables handshake checks.
+	HandshakeTLSConfig *tls.Config
+}
+
+func (c *HealthCheckConfig) populateDefaults() {
+	if c.Interval == 0 {
+		c.Interval = DefaultHealthCheckInterval
+	}
+	if c.Rise == 0 {
+		c.Rise = DefaultHealthCheckRise
+	}
+	if c.Fall == 0 {
+		c.Fall = DefaultHealthCheckFall
+	}
+}
+
+func deriveHealthCheckKey(serverKey ServerKey) ([32]byte, error) {
+	key, err := expandLabel(serverKey.Secret, nil, labelHealthCheck, 32)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return [32]byte(key), nil
+}
+
+// healthCheckMAC authenticates the type and the nonce,
+// the type is included so a ping cannot be reflected as pong
+func healthCheckMAC(key [32]byte, hdrType byte, nonce []byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte{hdrType})
+	h.Write(nonce)
+	return h.Sum(nil)[:healthCheckMACLen]
+}
+
+func appendHealthCheck(b []byte, key [32]byte, hdrType byte, nonce [healthCheckNonceLen]byte) []byte {
+	b = append(b, hdrType)
+	b = append(b, nonce[:]...)
+	return append(b, healthCheckMAC(key, hdrType, nonce[:])...)
+}
+
+// parseHealthCheck returns the nonce if the MAC verifies
+func parseHealthCheck(b []byte, key [32]byte, hdrType byte) ([healthCheckNonceLen]byte, bool) {
+	if len(b) != healthCheckLen || b[0] != hdrType {
+		return [healthCheckNonceLen]byte{}, false
+	}
+	nonce := b[1 : 1+healthCheckNonceLen]
+	if !hmac.Equal(b[1+healthCheckNonceLen:], healthCheckMAC(key, hdrType, nonce)) {
+		return [healthCheckNonceLen]byte{}, false
+	}
+	return [healthCheckNonceLen]byte(nonce), true
+}
+
+// HealthCheckResponder answers the health check pings of the router.
+// It is used by backends.
+type HealthCheckResponder struct {
+	key [32]byte
+}
+
+func NewHealthCheckResponder(serverKey ServerKey) (*HealthCheckResponder, error) {
+	key, err := deriveHealthCheckKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	return &HealthCheckResponder{key: key}, nil
+}
+
+// IsHealthCheckPing says if the UDP payload must be passed to HealthCheckResponder.Respond
+func IsHealthCheckPing(udpPayload []byte) bool {
+	return len(udpPayload) == healthCheckLen && udpPayload[0] == HealthCheckPingExtHdrType
+}
+
+// Respond returns the pong that must be sent back to the router,
+// or false if the ping is invalid.
+func (r *HealthCheckResponder) Respond(udpPayload []byte) ([]byte, bool) {
+	nonce, ok := parseHealthCheck(udpPayload, r.key, HealthCheckPingExtHdrType)
+	if !ok {
+		return nil, false
+	}
+	return appendHealthCheck(nil, r.key, HealthCheckPongExtHdrType, nonce), true
+}
+
+type backendHealth struct {
+	backend      *Backend
+	pendingNonce [healthCheckNonceLen]byte
+	pending      bool
+	pongReceived bool
+	handshakeOK  atomic.Bool
+	successes    int
+	failures     int
+}
+
+// healthChecker probes all backends of the router periodically
+type healthChecker struct {
+	config HealthCheckConfig
+	router *Router
+	mu     sync.Mutex
+	health map[[connIDServerIDLen]byte]*backendHealth
+}
+
+func newHealthChecker(router *Router, config HealthCheckConfig) *healthChecker {
+	config.populateDefaults()
+	return &healthChecker{
+		config: config,
+		router: router,
+		health: map[[connIDServerIDLen]byte]*backendHealth{},
+	}
+}
+
+func (c *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check evaluates the previous round and starts a new one
+func (c *healthChecker) check(ctx context.Context) {
+	backends := c.router.backends.all()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := make(map[[connIDServerIDLen]byte]*backendHealth, len(backends))
+	for _, b := range backends {
+		h, ok := c.health[b.serverID]
+		if !ok || h.backend != b {
+			h = &backendHealth{backend: b}
+		} else {
+			c.evaluate(h)
+		}
+		current[b.serverID] = h
+		c.ping(h)
+		if c.config.HandshakeTLSConfig != nil {
+			go c.handshake(ctx, h)
+		}
+	}
+	// forget removed backends
+	c.health = current
+}
+
+// evaluate must be called with mu locked
+func (c *healthChecker) evaluate(h *backendHealth) {
+	success := h.pongReceived && (c.config.HandshakeTLSConfig == nil || h.handshakeOK.Load())
+	if success {
+		c.router.metrics.healthChecksSucceeded.Add(1)
+		h.successes++
+		h.failures = 0
+		if h.backend.State() == BackendDown && h.successes >= c.config.Rise {
+			c.router.setBackendState(h.backend, BackendUp)
+			c.router.logf("backend %s is up\n", h.backend.addr)
+		}
+	} else {
+		c.router.metrics.healthChecksFailed.Add(1)
+		h.failures++
+		h.successes = 0
+		if h.backend.State() == BackendUp && h.failures >= c.config.Fall {
+			c.router.setBackendState(h.backend, BackendDown)
+			c.router.logf("backend %s is down\n", h.backend.addr)
+		}
+	}
+}
+
+// ping must be called with mu locked, pings are sent with the current key of the router
+func (c *healthChecker) ping(h *backendHealth) {
+	h.pending = false
+	h.pongReceived = false
+	key, err := c.router.keys.Load().current.healthCheckKeys.get(h.backend.serverID)
+	if err != nil {
+		c.router.logf("failed to derive health check key of backend %s: %s\n", h.backend.addr, err)
+		return
+	}
+	if _, err := rand.Read(h.pendingNonce[:]); err != nil {
+		return
+	}
+	h.pending = true
+	ping := appendHealthCheck(nil, key, HealthCheckPingExtHdrType, h.pendingNonce)
+	// the pong returns to the first listener
+	_, err = c.router.listeners[0].conn.WriteToUDPAddrPort(ping, h.backend.addr)
+	if err != nil {
+		c.router.logf("failed to send health check to backend %s: %s\n", h.backend.addr, err)
+	}
+}
+
+func (c *healthChecker) handshake(ctx context.Context, h *backendHealth) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Interval)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, h.backend.addr.String(), c.config.HandshakeTLSConfig, &quic.Config{
+		HandshakeIdleTimeout: c.config.Interval,
+	})
+	if err != nil {
+		h.handshakeOK.Store(false)
+		return
+	}
+	h.handshakeOK.Store(true)
+	_ = conn.CloseWithError(0, "")
+}
+
+// handlePong is called by the router for every HealthCheckPongExtHdrType packet.
+// Pongs are accepted under the current and the previous key,
+// because backends may answer with the key they had before a rotation.
+func (c *healthChecker) handlePong(udpPayload []byte, addr netip.AddrPort) {
+	if !addr.Addr().Unmap().Is4() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.health[addrToServerID(addr)]
+	if !ok || !h.pending {
+		return
+	}
+	for _, keys := range c.router.keys.Load().all() {
+		key, err := keys.healthCheckKeys.get(h.backend.serverID)
+		if err != nil {
+			return
+		}
+		nonce, ok := parseHealthCheck(udpPayload, key, HealthCheckPongExtHdrType)
+		if ok && nonce == h.pendingNonce {
+			h.pending = false
+			h.pongReceived = true
+			return
+		}
+	}
+}
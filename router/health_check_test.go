@@ -0,0 +1,124 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckPingPong(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	serverKey, err := DeriveServerKeyFromAddr(master, netip.MustParseAddrPort("127.0.0.1:8292"), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	key, err := deriveHealthCheckKey(serverKey)
+	require.NoError(t, err)
+	nonce := [healthCheckNonceLen]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ping := appendHealthCheck(nil, key, HealthCheckPingExtHdrType, nonce)
+	assert.True(t, IsHealthCheckPing(ping))
+	responder, err := NewHealthCheckResponder(serverKey)
+	require.NoError(t, err)
+	pong, ok := responder.Respond(ping)
+	require.True(t, ok)
+	parsedNonce, ok := parseHealthCheck(pong, key, HealthCheckPongExtHdrType)
+	assert.True(t, ok)
+	assert.Equal(t, nonce, parsedNonce)
+	// a ping must not be accepted as pong
+	ping[0] = HealthCheckPongExtHdrType
+	_, ok = parseHealthCheck(ping, key, HealthCheckPongExtHdrType)
+	assert.False(t, ok)
+}
+
+func TestHealthCheckHysteresis(t *testing.T) {
+	backends := newBackendSet()
+	b, err := backends.add(netip.MustParseAddrPort("127.0.0.1:8292"))
+	require.NoError(t, err)
+	c := newHealthChecker(&Router{config: &Config{}, metrics: newMetrics("", nil, backends, nil)}, HealthCheckConfig{Rise: 2, Fall: 2})
+	h := &backendHealth{backend: b}
+	c.evaluate(h)
+	assert.Equal(t, BackendUp, b.State())
+	c.evaluate(h)
+	assert.Equal(t, BackendDown, b.State())
+	h.pongReceived = true
+	c.evaluate(h)
+	assert.Equal(t, BackendDown, b.State())
+	c.evaluate(h)
+	assert.Equal(t, BackendUp, b.State())
+}
+
+func TestSelectBackend(t *testing.T) {
+	backends := newBackendSet()
+	for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+		_, err := backends.add(netip.MustParseAddrPort(addr))
+		require.NoError(t, err)
+	}
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	selected := selectBackend(backends.all(), destConnID, time.Now())
+	require.NotNil(t, selected)
+	assert.Equal(t, selected, selectBackend(backends.all(), destConnID, time.Now()))
+	selected.setState(BackendDown)
+	other := selectBackend(backends.all(), destConnID, time.Now())
+	require.NotNil(t, other)
+	assert.NotEqual(t, selected, other)
+	for _, b := range backends.all() {
+		b.setState(BackendDown)
+	}
+	assert.Nil(t, selectBackend(backends.all(), destConnID, time.Now()))
+}
+
+func TestHealthCheckAfterKeyRotation(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	r, secret := startTestRouter(t, backendAddr)
+	c := newHealthChecker(r, HealthCheckConfig{})
+	var rotated [32]byte
+	_, err := rand.Read(rotated[:])
+	require.NoError(t, err)
+	healthCheckKey := func(secret [32]byte) [32]byte {
+		serverKey, err := DeriveServerKeyFromAddr(secret, backendAddr, CipherSuiteAES256GCM)
+		require.NoError(t, err)
+		key, err := deriveHealthCheckKey(serverKey)
+		require.NoError(t, err)
+		return key
+	}
+	// ping starts a check and returns the nonce of the ping if it is sealed with key
+	ping := func(key [32]byte) ([healthCheckNonceLen]byte, bool) {
+		c.check(context.Background())
+		require.NoError(t, backend.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, MTU)
+		n, err := backend.Read(buf)
+		require.NoError(t, err)
+		require.True(t, IsHealthCheckPing(buf[:n]))
+		return parseHealthCheck(buf[:n], key, HealthCheckPingExtHdrType)
+	}
+	pong := func(key [32]byte, nonce [healthCheckNonceLen]byte) bool {
+		c.handlePong(appendHealthCheck(nil, key, HealthCheckPongExtHdrType, nonce), backendAddr)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.health[addrToServerID(backendAddr)].pongReceived
+	}
+
+	require.NoError(t, r.RotateKey(rotated))
+	// pings are sent with the new key
+	nonce, ok := ping(healthCheckKey(rotated))
+	require.True(t, ok)
+	assert.True(t, pong(healthCheckKey(rotated), nonce))
+	// pongs of the previous key are accepted until it is retired
+	nonce, ok = ping(healthCheckKey(rotated))
+	require.True(t, ok)
+	assert.True(t, pong(healthCheckKey(secret), nonce))
+
+	require.True(t, r.RetirePreviousKey())
+	nonce, ok = ping(healthCheckKey(rotated))
+	require.True(t, ok)
+	assert.False(t, pong(healthCheckKey(secret), nonce))
+	assert.True(t, pong(healthCheckKey(rotated), nonce))
+	c.check(context.Background())
+	assert.Equal(t, BackendUp, r.backends.getByAddr(backendAddr).State())
+}
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/quic-go/quic-go/quicvarint"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+var (
+	// initialSaltV1 see RFC 9001 Section 5.2
+	initialSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	// initialSaltV2 see RFC 9369 Section 3.3.1
+	initialSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+const (
+	initialKeyLen             = 16
+	initialIVLen              = 12
+	initialTagLen             = 16
+	headerProtectionSampleLen = 16
+	// maxPacketNumberLen is assumed when taking the header protection sample
+	maxPacketNumberLen = 4
+)
+
+var ErrorInvalidInitialPacket = errors.New("invalid initial packet")
+
+// hkdfExpandLabel is the HKDF-Expand-Label function of TLS 1.3, see RFC 8446 Section 7.1
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 2+1+len(fullLabel)+1)
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0) // empty context
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// initialKeys are the keys protecting the Initial packets of a client
+type initialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newClientInitialKeys derives the keys of the client's Initial packets from the destination connection ID,
+// see RFC 9001 Section 5.2 and RFC 9369 Section 3.3.
+// The version must be known, see isKnownVersion.
+func newClientInitialKeys(version uint32, destConnID []byte) (*initialKeys, error) {
+	salt, keyLabel, ivLabel, hpLabel := initialSaltV1, "quic key", "quic iv", "quic hp"
+	if version == Version2 {
+		salt, keyLabel, ivLabel, hpLabel = initialSaltV2, "quicv2 key", "quicv2 iv", "quicv2 hp"
+	}
+	initialSecret := hkdf.Extract(sha256.New, destConnID, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+	block, err := aes.NewCipher(hkdfExpandLabel(clientSecret, keyLabel, initialKeyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(clientSecret, hpLabel, initialKeyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &initialKeys{
+		aead: aead,
+		iv:   hkdfExpandLabel(clientSecret, ivLabel, initialIVLen),
+		hp:   hp,
+	}, nil
+}
+
+// decryptInitialPacket returns the plaintext payload of the first packet in the datagram,
+// which must be an Initial of a known version.
+// The datagram is not modified, it is still forwarded to the backend.
+func decryptInitialPacket(datagram []byte, hdr *longHeader) ([]byte, error) {
+	if !hdr.isInitial() || !isKnownVersion(hdr.version) {
+		return nil, ErrorInvalidInitialPacket
+	}
+	r := bytes.NewReader(datagram[hdr.lengthOffset:])
+	length, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, ErrorInvalidInitialPacket
+	}
+	pnOffset := len(datagram) - r.Len()
+	if length < maxPacketNumberLen+headerProtectionSampleLen || uint64(len(datagram)-pnOffset) < length {
+		return nil, ErrorInvalidInitialPacket
+	}
+	keys, err := newClientInitialKeys(hdr.version, hdr.destConnID)
+	if err != nil {
+		return nil, err
+	}
+	// remove the header protection on a copy of the header, see RFC 9001 Section 5.4
+	var mask [aes.BlockSize]byte
+	sampleOffset := pnOffset + maxPacketNumberLen
+	keys.hp.Encrypt(mask[:], datagram[sampleOffset:sampleOffset+headerProtectionSampleLen])
+	firstByte := datagram[0] ^ mask[0]&0x0f
+	pnLen := int(firstByte&0x03) + 1
+	header := make([]byte, pnOffset+pnLen)
+	copy(header, datagram)
+	header[0] = firstByte
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	// the truncated packet number is used as full packet number,
+	// clients start at 0 and send only few Initials
+	nonce := make([]byte, initialIVLen)
+	copy(nonce, keys.iv)
+	for i := 0; i < 8; i++ {
+		nonce[initialIVLen-1-i] ^= byte(pn >> (8 * i))
+	}
+	ciphertext := datagram[pnOffset+pnLen : pnOffset+int(length)]
+	if len(ciphertext) < initialTagLen {
+		return nil, ErrorInvalidInitialPacket
+	}
+	plaintext, err := keys.aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, ErrorInvalidInitialPacket
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,32 @@
+package router
+
+import (
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// Every key is derived from a secret with a distinct label,
+// so that no key is ever used for two purposes.
+const (
+	labelServerKey      = "quic-router server key"
+	labelServerIDMask   = "quic-router server id mask"
+	labelConnID         = "quic-router conn id"
+	labelExtHdr         = "quic-router ext hdr"
+	labelExtHdrNonce    = "quic-router ext hdr nonce"
+	labelRetryToken     = "quic-router retry token"
+	labelStatelessReset = "quic-router stateless reset"
+	labelHealthCheck    = "quic-router health check"
+	labelControlMessage = "quic-router control message"
+)
+
+// expandLabel derives length bytes from secret using HKDF-SHA256.
+// The salt is optional.
+func expandLabel(secret [32]byte, salt []byte, label string, length int) ([]byte, error) {
+	h := hkdf.New(sha256.New, secret[:], salt, []byte(label))
+	out := make([]byte, length)
+	if _, err := io.ReadFull(h, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
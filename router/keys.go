@@ -0,0 +1,120 @@
+package router
+
+import (
+	"fmt"
+	"github.com/quic-go/quic-go"
+)
+
+// routerKeys are the keys the router derives from a secret
+type routerKeys struct {
+	secret          [32]byte
+	suite           CipherSuite
+	connIDProtector *ConnIDProtector
+	// every server uses its own key for the extension headers
+	clientIDExtHdrPackers *perServer[NonQuicPrefixClientIDExtHdrPacker]
+	statelessResetKeys    *perServer[quic.StatelessResetKey]
+	controlMessageKeys    *perServer[[32]byte]
+	healthCheckKeys       *perServer[[32]byte]
+}
+
+func newRouterKeys(secret [32]byte, suite CipherSuite) (*routerKeys, error) {
+	k := &routerKeys{secret: secret, suite: suite}
+	var err error
+	k.connIDProtector, err = NewConnIDProtector(secret, suite)
+	if err != nil {
+		return nil, err
+	}
+	k.clientIDExtHdrPackers = newPerServer(func(serverID [connIDServerIDLen]byte) (NonQuicPrefixClientIDExtHdrPacker, error) {
+		key, err := k.serverKey(serverID)
+		if err != nil {
+			return NonQuicPrefixClientIDExtHdrPacker{}, err
+		}
+		return NewNonQuicPrefixClientIDExtHdrPacker(key.Secret, key.CipherSuite)
+	})
+	k.statelessResetKeys = newPerServer(func(serverID [connIDServerIDLen]byte) (quic.StatelessResetKey, error) {
+		key, err := k.serverKey(serverID)
+		if err != nil {
+			return quic.StatelessResetKey{}, err
+		}
+		return key.StatelessResetKey()
+	})
+	k.controlMessageKeys = newPerServer(func(serverID [connIDServerIDLen]byte) ([32]byte, error) {
+		key, err := k.serverKey(serverID)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return deriveControlMessageKey(key)
+	})
+	k.healthCheckKeys = newPerServer(func(serverID [connIDServerIDLen]byte) ([32]byte, error) {
+		key, err := k.serverKey(serverID)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return deriveHealthCheckKey(key)
+	})
+	return k, nil
+}
+
+// serverKey derives the key of a backend
+func (k *routerKeys) serverKey(serverID [connIDServerIDLen]byte) (ServerKey, error) {
+	return DeriveServerKey(k.secret, serverID, k.suite)
+}
+
+// keyRing is replaced as a whole on key rotation
+type keyRing struct {
+	current *routerKeys
+	// previous is the key before the last rotation, nil if there is none
+	previous *routerKeys
+}
+
+// all returns the current and the previous keys
+func (k *keyRing) all() []*routerKeys {
+	if k.previous == nil {
+		return []*routerKeys{k.current}
+	}
+	return []*routerKeys{k.current, k.previous}
+}
+
+// RotateKey makes secret the current key of the router.
+// Connection IDs and extension headers of backends protected with the previous key are still accepted,
+// until the next rotation or RetirePreviousKey, so established connections continue.
+// New connections are forwarded with the new key, so the backends must accept it before.
+// Health checks are sent with the new key, their answers are accepted under both keys.
+// Retry tokens keep using the configured key.
+func (r *Router) RotateKey(secret [32]byte) error {
+	keys, err := newRouterKeys(secret, r.config.CipherSuite)
+	if err != nil {
+		return err
+	}
+	for {
+		ring := r.keys.Load()
+		if ring.current.secret == secret {
+			return fmt.Errorf("key is already in use")
+		}
+		if r.keys.CompareAndSwap(ring, &keyRing{current: keys, previous: ring.current}) {
+			break
+		}
+	}
+	r.logf("rotated key\n")
+	return nil
+}
+
+// RetirePreviousKey stops accepting the key before the last rotation.
+// Returns false if there is no previous key.
+func (r *Router) RetirePreviousKey() bool {
+	for {
+		ring := r.keys.Load()
+		if ring.previous == nil {
+			return false
+		}
+		if r.keys.CompareAndSwap(ring, &keyRing{current: ring.current}) {
+			r.logf("retired previous key\n")
+			return true
+		}
+	}
+}
+
+// HasPreviousKey says if the key before the last rotation is still accepted
+func (r *Router) HasPreviousKey() bool {
+	return r.keys.Load().previous != nil
+}
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotateKey(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	r, secret := startTestRouter(t, backendAddr)
+	routerAddr := r.listeners[0].localAddr
+	client := listenLoopback(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	var rotated [32]byte
+	_, err := rand.Read(rotated[:])
+	require.NoError(t, err)
+	assert.ErrorContains(t, r.RotateKey(secret), "already in use")
+	assert.False(t, r.RetirePreviousKey())
+	require.NoError(t, r.RotateKey(rotated))
+	assert.True(t, r.HasPreviousKey())
+
+	// connections of both keys are forwarded, and the replies of both keys reach the client
+	for _, key := range [][32]byte{secret, rotated} {
+		shortHdr := sendShortHeaderPacket(t, client, key, backendAddr, routerAddr)
+		receiveDatagram(t, backend, shortHdr)
+		packer := newTestPacker(t, key, backendAddr)
+		datagram, err := packer.AddHdr(shortHdr, clientAddr)
+		require.NoError(t, err)
+		_, err = backend.WriteToUDPAddrPort(datagram, routerAddr)
+		require.NoError(t, err)
+		receiveDatagram(t, client, shortHdr)
+	}
+
+	// connections of the retired key are not forwarded anymore
+	require.True(t, r.RetirePreviousKey())
+	assert.False(t, r.HasPreviousKey())
+	sendShortHeaderPacket(t, client, secret, backendAddr, routerAddr)
+	require.NoError(t, backend.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = backend.Read(make([]byte, MTU))
+	assert.Error(t, err)
+}
+
+// lockedBuffer is written by the run loop and read by the test
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDebugLogging(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	var logs lockedBuffer
+	r, secret := startTestRouterWithConfig(t, backendAddr, &Config{Logger: log.New(&logs, "", 0)})
+	routerAddr := r.listeners[0].localAddr
+	client := listenLoopback(t)
+
+	shortHdr := sendShortHeaderPacket(t, client, secret, backendAddr, routerAddr)
+	receiveDatagram(t, backend, shortHdr)
+	assert.NotContains(t, logs.String(), "debug:")
+
+	// mapped prefixes match the unmapped client address
+	r.SetDebugLogging(netip.MustParsePrefix("::ffff:127.0.0.0/104"), true)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, r.DebugPrefixes())
+	shortHdr = sendShortHeaderPacket(t, client, secret, backendAddr, routerAddr)
+	receiveDatagram(t, backend, shortHdr)
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "forwarded to backend "+backendAddr.String())
+	}, time.Second, time.Millisecond)
+
+	r.SetDebugLogging(netip.MustParsePrefix("127.0.0.0/8"), false)
+	assert.Empty(t, r.DebugPrefixes())
+}
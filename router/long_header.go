@@ -0,0 +1,139 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+const (
+	Version1 uint32 = 0x00000001
+	// Version2 is QUIC version 2, see RFC 9369
+	Version2 uint32 = 0x6b3343cf
+	// versionNegotiation is the version field of Version Negotiation packets
+	versionNegotiation uint32 = 0
+	// maxConnIDLen of QUIC version 1 and 2
+	maxConnIDLen = 20
+	// maxInvariantConnIDLen of QUIC invariants, see RFC 8999
+	maxInvariantConnIDLen = 255
+)
+
+// longHeaderPacketType is independent of the version specific encoding
+type longHeaderPacketType uint8
+
+const (
+	packetTypeInitial longHeaderPacketType = iota
+	packetType0RTT
+	packetTypeHandshake
+	packetTypeRetry
+	// packetTypeUnknown is the type of packets with unknown versions
+	packetTypeUnknown
+)
+
+func (t longHeaderPacketType) String() string {
+	switch t {
+	case packetTypeInitial:
+		return "Initial"
+	case packetType0RTT:
+		return "0-RTT"
+	case packetTypeHandshake:
+		return "Handshake"
+	case packetTypeRetry:
+		return "Retry"
+	default:
+		return "long header"
+	}
+}
+
+// isKnownVersion reports whether the packet types of the version are known
+func isKnownVersion(version uint32) bool {
+	return version == Version1 || version == Version2
+}
+
+// decodePacketType decodes the type bits of the first byte
+func decodePacketType(version uint32, firstByte byte) longHeaderPacketType {
+	bits := (firstByte & 0x30) >> 4
+	switch version {
+	case Version1:
+		return longHeaderPacketType(bits)
+	case Version2:
+		// Initial 0b01, 0-RTT 0b10, Handshake 0b11, Retry 0b00
+		return longHeaderPacketType((bits + 3) % 4)
+	default:
+		return packetTypeUnknown
+	}
+}
+
+// encodePacketType encodes the type bits of the first byte
+func encodePacketType(version uint32, packetType longHeaderPacketType) byte {
+	if version == Version2 {
+		return byte((packetType+1)%4) << 4
+	}
+	return byte(packetType) << 4
+}
+
+var ErrorInvalidLongHeader = errors.New("invalid long header")
+
+// longHeader contains the unprotected fields of a long header packet.
+// The slices point into the parsed packet.
+type longHeader struct {
+	version    uint32
+	packetType longHeaderPacketType
+	destConnID []byte
+	srcConnID  []byte
+	// token is only set for Initial packets
+	token []byte
+	// lengthOffset is the offset of the length field of known versions
+	lengthOffset int
+}
+
+// parseLongHeader parses the invariant fields and the token of Initial packets.
+// Parsing stops before the length field.
+func parseLongHeader(b []byte) (longHeader, error) {
+	var hdr longHeader
+	if len(b) < 7 || !isLongHeaderPacket(b[0]) {
+		return longHeader{}, ErrorInvalidLongHeader
+	}
+	hdr.version = binary.BigEndian.Uint32(b[1:5])
+	connIDLenLimit := maxConnIDLen
+	if !isKnownVersion(hdr.version) {
+		connIDLenLimit = maxInvariantConnIDLen
+	}
+	hdr.packetType = decodePacketType(hdr.version, b[0])
+	pos := 5
+	destConnIDLen := int(b[pos])
+	pos++
+	if destConnIDLen > connIDLenLimit || len(b) < pos+destConnIDLen+1 {
+		return longHeader{}, ErrorInvalidLongHeader
+	}
+	hdr.destConnID = b[pos : pos+destConnIDLen]
+	pos += destConnIDLen
+	srcConnIDLen := int(b[pos])
+	pos++
+	if srcConnIDLen > connIDLenLimit || len(b) < pos+srcConnIDLen {
+		return longHeader{}, ErrorInvalidLongHeader
+	}
+	hdr.srcConnID = b[pos : pos+srcConnIDLen]
+	pos += srcConnIDLen
+	hdr.lengthOffset = pos
+	if !hdr.isInitial() {
+		return hdr, nil
+	}
+	r := bytes.NewReader(b[pos:])
+	tokenLen, err := quicvarint.Read(r)
+	if err != nil {
+		return longHeader{}, ErrorInvalidLongHeader
+	}
+	pos = len(b) - r.Len()
+	if uint64(len(b)-pos) < tokenLen {
+		return longHeader{}, ErrorInvalidLongHeader
+	}
+	hdr.token = b[pos : pos+int(tokenLen)]
+	hdr.lengthOffset = pos + int(tokenLen)
+	return hdr, nil
+}
+
+func (h *longHeader) isInitial() bool {
+	return h.packetType == packetTypeInitial
+}
@@ -0,0 +1,29 @@
+package router
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPacketTypeEncoding(t *testing.T) {
+	for _, version := range []uint32{Version1, Version2} {
+		for _, packetType := range []longHeaderPacketType{packetTypeInitial, packetType0RTT, packetTypeHandshake, packetTypeRetry} {
+			assert.Equal(t, packetType, decodePacketType(version, 0xc0|encodePacketType(version, packetType)))
+		}
+	}
+	assert.Equal(t, packetTypeInitial, decodePacketType(Version2, 0b11010000))
+	assert.Equal(t, packetTypeUnknown, decodePacketType(0x1a2a3a4a, 0xc0))
+}
+
+func TestParseLongHeaderV2Initial(t *testing.T) {
+	// fixed bit greased, see RFC 9287
+	initial := []byte{0b10010000, 0x6b, 0x33, 0x43, 0xcf, 2, 1, 2, 1, 3, 2, 4, 5, 0}
+	hdr, err := parseLongHeader(initial)
+	require.NoError(t, err)
+	assert.Equal(t, Version2, hdr.version)
+	assert.True(t, hdr.isInitial())
+	assert.Equal(t, []byte{1, 2}, hdr.destConnID)
+	assert.Equal(t, []byte{3}, hdr.srcConnID)
+	assert.Equal(t, []byte{4, 5}, hdr.token)
+}
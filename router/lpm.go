@@ -0,0 +1,121 @@
+package router
+
+import (
+	"net/netip"
+)
+
+// lpmTable is a binary trie for longest prefix matching of IPv4 and IPv6 addresses.
+// IPv4 prefixes are stored as IPv4-mapped IPv6 prefixes,
+// so IPv4 and IPv4-mapped IPv6 addresses match the same prefixes.
+// It is not safe for concurrent modification.
+type lpmTable[T any] struct {
+	root lpmNode[T]
+	len  int
+}
+
+type lpmNode[T any] struct {
+	children [2]*lpmNode[T]
+	value    T
+	set      bool
+}
+
+// lpmKey returns the IPv6 form of the prefix
+func lpmKey(prefix netip.Prefix) ([16]byte, int) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	if addr.Is4() {
+		return addr.As16(), 96 + prefix.Bits()
+	}
+	return addr.As16(), prefix.Bits()
+}
+
+func bitAt(key *[16]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// node returns the node of the prefix, it is created if create is set
+func (t *lpmTable[T]) node(prefix netip.Prefix, create bool) *lpmNode[T] {
+	key, bits := lpmKey(prefix)
+	n := &t.root
+	for i := 0; i < bits; i++ {
+		b := bitAt(&key, i)
+		if n.children[b] == nil {
+			if !create {
+				return nil
+			}
+			n.children[b] = &lpmNode[T]{}
+		}
+		n = n.children[b]
+	}
+	return n
+}
+
+// insert replaces the value of the prefix
+func (t *lpmTable[T]) insert(prefix netip.Prefix, value T) {
+	n := t.node(prefix, true)
+	if !n.set {
+		t.len++
+	}
+	n.value = value
+	n.set = true
+}
+
+// get returns the value of exactly the prefix
+func (t *lpmTable[T]) get(prefix netip.Prefix) (T, bool) {
+	n := t.node(prefix, false)
+	if n == nil || !n.set {
+		var zero T
+		return zero, false
+	}
+	return n.value, true
+}
+
+// remove returns false if the prefix is not in the table.
+// Nodes are not freed.
+func (t *lpmTable[T]) remove(prefix netip.Prefix) bool {
+	n := t.node(prefix, false)
+	if n == nil || !n.set {
+		return false
+	}
+	var zero T
+	n.value = zero
+	n.set = false
+	t.len--
+	return true
+}
+
+// lookup calls f for the values of all prefixes containing the address,
+// from the longest to the shortest prefix, until f returns true.
+// Returns true if f returned true.
+func (t *lpmTable[T]) lookup(addr netip.Addr, f func(T) bool) bool {
+	key := addr.Unmap().As16()
+	var matches [129]*lpmNode[T]
+	numMatches := 0
+	n := &t.root
+	for i := 0; n != nil; i++ {
+		if n.set {
+			matches[numMatches] = n
+			numMatches++
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[bitAt(&key, i)]
+	}
+	for i := numMatches - 1; i >= 0; i-- {
+		if f(matches[i].value) {
+			return true
+		}
+	}
+	return false
+}
+
+// longest returns the value of the longest prefix containing the address
+func (t *lpmTable[T]) longest(addr netip.Addr) (T, bool) {
+	var value T
+	found := t.lookup(addr, func(v T) bool {
+		value = v
+		return true
+	})
+	return value, found
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func TestLPMTable(t *testing.T) {
+	var table lpmTable[string]
+	table.insert(netip.MustParsePrefix("0.0.0.0/0"), "any4")
+	table.insert(netip.MustParsePrefix("10.0.0.0/8"), "10/8")
+	table.insert(netip.MustParsePrefix("10.1.0.0/16"), "10.1/16")
+	table.insert(netip.MustParsePrefix("2001:db8::/32"), "db8")
+	table.insert(netip.MustParsePrefix("192.0.2.1/32"), "host")
+	assert.Equal(t, 5, table.len)
+
+	v, ok := table.longest(netip.MustParseAddr("10.1.2.3"))
+	assert.True(t, ok)
+	assert.Equal(t, "10.1/16", v)
+	// IPv4-mapped addresses match IPv4 prefixes
+	v, _ = table.longest(netip.MustParseAddr("::ffff:10.2.0.1"))
+	assert.Equal(t, "10/8", v)
+	v, _ = table.longest(netip.MustParseAddr("192.0.2.1"))
+	assert.Equal(t, "host", v)
+	v, _ = table.longest(netip.MustParseAddr("2001:db8::1"))
+	assert.Equal(t, "db8", v)
+	_, ok = table.longest(netip.MustParseAddr("2001:db9::1"))
+	assert.False(t, ok)
+
+	var visited []string
+	table.lookup(netip.MustParseAddr("10.1.2.3"), func(v string) bool {
+		visited = append(visited, v)
+		return false
+	})
+	assert.Equal(t, []string{"10.1/16", "10/8", "any4"}, visited)
+
+	assert.True(t, table.remove(netip.MustParsePrefix("10.1.0.0/16")))
+	assert.False(t, table.remove(netip.MustParsePrefix("10.1.0.0/16")))
+	v, _ = table.longest(netip.MustParseAddr("10.1.2.3"))
+	assert.Equal(t, "10/8", v)
+	_, ok = table.get(netip.MustParsePrefix("10.0.0.0/8"))
+	assert.True(t, ok)
+}
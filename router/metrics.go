@@ -0,0 +1,132 @@
+package router
+
+import (
+	"expvar"
+	"time"
+)
+
+// metrics of a router, exported via expvar.
+// The map is not published, so several routers can run in one process.
+type metrics struct {
+	root                  *expvar.Map
+	healthChecksSucceeded *expvar.Int
+	healthChecksFailed    *expvar.Int
+}
+
+func newMetrics(tenant string, listeners []*listener, backends *backendSet, pools map[string]*pool) *metrics {
+	m := &metrics{
+		root:                  new(expvar.Map).Init(),
+		healthChecksSucceeded: new(expvar.Int),
+		healthChecksFailed:    new(expvar.Int),
+	}
+	tenantVar := new(expvar.String)
+	tenantVar.Set(tenant)
+	m.root.Set("tenant", tenantVar)
+	m.root.Set("listeners", expvar.Func(func() any {
+		addrs := make([]string, 0, len(listeners))
+		for _, l := range listeners {
+			addrs = append(addrs, l.localAddr.String())
+		}
+		return addrs
+	}))
+	m.root.Set("health_checks_succeeded", m.healthChecksSucceeded)
+	m.root.Set("health_checks_failed", m.healthChecksFailed)
+	m.root.Set("backends", expvar.Func(func() any {
+		states := map[string]any{}
+		for _, b := range backends.all() {
+			state := map[string]any{
+				"pool":              b.Pool(),
+				"state":             b.State().String(),
+				"draining":          b.Draining(),
+				"packets_forwarded": b.packetsForwarded.Load(),
+				"bytes_forwarded":   b.bytesForwarded.Load(),
+				"weight":            b.Weight(),
+				"effective_weight":  b.effectiveWeight(time.Now()),
+			}
+			if deadline := b.DrainDeadline(); !deadline.IsZero() {
+				state["drain_deadline"] = deadline
+			}
+			if last := b.LastForwarded(); !last.IsZero() {
+				state["seconds_since_last_forwarded"] = time.Since(last).Seconds()
+			}
+			if load := b.Load(); load != nil {
+				state["active_connections"] = load.ActiveConnections
+				state["utilization"] = load.Utilization
+			}
+			states[b.addr.String()] = state
+		}
+		return states
+	}))
+	m.root.Set("pools", expvar.Func(func() any {
+		states := map[string]any{}
+		for name, p := range pools {
+			state := map[string]any{
+				"selection":              p.selection.String(),
+				"initial_packets":        p.initialPackets.Load(),
+				"no_backend_drops":       p.noBackendDrops.Load(),
+				"canary_fallbacks":       p.canaryFallbacks.Load(),
+				"retransmitted_initials": p.retransmittedInitials.Load(),
+				"stateless_resets":       p.statelessResets.Load(),
+				"invalid_conn_ids":       p.invalidConnIDs.Load(),
+				"drain_deadline_drops":   p.drainDeadlineDrops.Load(),
+			}
+			var packets, bytes uint64
+			available := 0
+			for _, b := range backends.pool(name) {
+				packets += b.packetsForwarded.Load()
+				bytes += b.bytesForwarded.Load()
+				if b.available() {
+					available++
+				}
+			}
+			state["packets_forwarded"] = packets
+			state["bytes_forwarded"] = bytes
+			state["available_backends"] = available
+			if p.mirror != nil {
+				state["shadow"] = p.mirror.shadow.String()
+				state["packets_mirrored"] = p.mirror.packetsMirrored.Load()
+			}
+			if p.split != nil {
+				state["canary"] = p.split.canary
+				state["canary_fraction"] = p.split.Fraction()
+			}
+			states[name] = state
+		}
+		return states
+	}))
+	return m
+}
+
+// setRateLimiter adds the counters of the rate limits
+func (m *metrics) setRateLimiter(l *rateLimiter) {
+	m.root.Set("rate_limit", expvar.Func(func() any {
+		return map[string]any{
+			"action":                  l.config.Action.String(),
+			"prefix_limited_packets":  l.prefixLimited.Load(),
+			"initial_limited_packets": l.initialLimited.Load(),
+			"retries_sent":            l.retried.Load(),
+		}
+	}))
+}
+
+// setAbuseDetector adds the counters and the blocklist of the abuse detection
+func (m *metrics) setAbuseDetector(d *abuseDetector) {
+	m.root.Set("abuse_detection", expvar.Func(func() any {
+		blocked := map[string]any{}
+		d.mu.Lock()
+		for prefix, b := range d.blocked {
+			blocked[prefix.String()] = map[string]any{
+				"until":  b.until,
+				"reason": b.reason.String(),
+			}
+		}
+		d.mu.Unlock()
+		return map[string]any{
+			"invalid_conn_id_packets": d.invalidPackets[invalidConnID].Load(),
+			"invalid_ext_hdr_packets": d.invalidPackets[invalidExtHdr].Load(),
+			"blocked_packets":         d.blockedPackets.Load(),
+			"blocks":                  d.blocks.Load(),
+			"blocked_prefixes":        blocked,
+		}
+	}))
+}
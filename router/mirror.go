@@ -0,0 +1,121 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig copies the client to server packets of a sample of connections to a shadow backend.
+// The copies carry the extension header, so the shadow sees the real client address.
+// Packets the shadow sends are discarded.
+type MirrorConfig struct {
+	// Shadow backend, it must not be a backend of a pool.
+	// Its ServerKey is derived from the router's secret like the keys of the other backends.
+	Shadow netip.AddrPort
+	// Fraction of new connections from 0 to 1 that are mirrored
+	Fraction float64
+}
+
+const (
+	// mirroredClientIdleTimeout after which a client is no longer mirrored
+	mirroredClientIdleTimeout = 30 * time.Second
+	// maxMirroredClients limits the memory of a mirror
+	maxMirroredClients = 1 << 16
+)
+
+// mirror samples connections by the destination connection ID of their first Initial packets.
+// Because clients switch to connection IDs of the backend during the handshake,
+// the client addresses of sampled connections are remembered,
+// so whole connections are mirrored.
+type mirror struct {
+	shadow   netip.AddrPort
+	serverID [connIDServerIDLen]byte
+	fraction float64
+	// clients are the addresses of mirrored connections with the time of their last packet.
+	// They are only accessed by the router's run loop.
+	clients         map[netip.AddrPort]time.Time
+	packetsMirrored atomic.Uint64
+}
+
+func newMirror(config MirrorConfig) (*mirror, error) {
+	if !config.Shadow.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("shadow address %s is not IPv4", config.Shadow)
+	}
+	if !(config.Fraction >= 0 && config.Fraction <= 1) {
+		return nil, fmt.Errorf("mirror fraction %v is not between 0 and 1", config.Fraction)
+	}
+	return &mirror{
+		shadow:   config.Shadow,
+		serverID: addrToServerID(config.Shadow),
+		fraction: config.Fraction,
+		clients:  map[netip.AddrPort]time.Time{},
+	}, nil
+}
+
+// sample says if the connection with the client chosen destination connection ID is mirrored
+func (m *mirror) sample(destConnID []byte) bool {
+	if m.fraction == 0 {
+		return false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("mirror"))
+	_, _ = h.Write(destConnID)
+	u := float64(mix64(h.Sum64())>>11) / (1 << 53)
+	return u < m.fraction
+}
+
+// track mirrors the packets of the client
+func (m *mirror) track(client netip.AddrPort, now time.Time) {
+	if _, ok := m.clients[client]; !ok && len(m.clients) >= maxMirroredClients {
+		for c, last := range m.clients {
+			if now.Sub(last) >= mirroredClientIdleTimeout {
+				delete(m.clients, c)
+			}
+		}
+		if len(m.clients) >= maxMirroredClients {
+			return
+		}
+	}
+	m.clients[client] = now
+}
+
+// tracked says if the packets of the client are mirrored
+func (m *mirror) tracked(client netip.AddrPort, now time.Time) bool {
+	last, ok := m.clients[client]
+	if !ok {
+		return false
+	}
+	if now.Sub(last) >= mirroredClientIdleTimeout {
+		delete(m.clients, client)
+		return false
+	}
+	m.clients[client] = now
+	return true
+}
+
+// mirrorPacket sends a copy of a client packet forwarded to the backend to the shadow of the backend's pool,
+// if the client is mirrored
+func (r *Router) mirrorPacket(l *listener, readBuf []byte, addr netip.AddrPort, extHdrType byte, backend *Backend) error {
+	m := r.pools[backend.pool].mirror
+	if m == nil || !m.tracked(addr, r.now()) {
+		return nil
+	}
+	packer, err := r.keys.Load().current.clientIDExtHdrPackers.get(m.serverID)
+	if err != nil {
+		return err
+	}
+	datagram, err := packer.AddHdrOfType(extHdrType, readBuf, addr)
+	if err != nil {
+		return err
+	}
+	r.trace.mirrored(m.shadow)
+	err = r.writeTo(l, datagram, m.shadow)
+	if err != nil {
+		return err
+	}
+	m.packetsMirrored.Add(1)
+	return nil
+}
@@ -0,0 +1,34 @@
+package router
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMirrorSampling(t *testing.T) {
+	m, err := newMirror(MirrorConfig{Shadow: netip.MustParseAddrPort("127.0.0.1:1"), Fraction: 0.1})
+	require.NoError(t, err)
+	const n = 100000
+	count := 0
+	for i := 0; i < n; i++ {
+		if m.sample(binary.BigEndian.AppendUint64(nil, uint64(i))) {
+			count++
+		}
+	}
+	assert.InDelta(t, 0.1, float64(count)/n, 0.01)
+
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	now := time.Now()
+	assert.False(t, m.tracked(client, now))
+	m.track(client, now)
+	assert.True(t, m.tracked(client, now.Add(mirroredClientIdleTimeout/2)))
+	assert.True(t, m.tracked(client, now.Add(mirroredClientIdleTimeout)))
+	assert.False(t, m.tracked(client, now.Add(3*mirroredClientIdleTimeout)))
+
+	_, err = newMirror(MirrorConfig{Shadow: netip.MustParseAddrPort("[::1]:1")})
+	assert.Error(t, err)
+}
@@ -5,39 +5,64 @@ import (
 	"net/netip"
 )
 
-// NonQuicPrefixClientIDExtHdrPacker adds and removes extension headers as prefix inside the UDP datagram
+// NonQuicPrefixClientIDExtHdrPacker adds and removes extension headers as prefix inside the UDP datagram.
+// Headers are added using the configured cipher suite,
+// headers of all cipher suites can be removed.
 type NonQuicPrefixClientIDExtHdrPacker struct {
-	protector *ClientAddrExtHdrProtector
+	suite      CipherSuite
+	protectors [numCipherSuites]*ClientAddrExtHdrProtector
 }
 
-func NewNonQuicPrefixClientIDExtHdrPacker(secret [32]byte) (NonQuicPrefixClientIDExtHdrPacker, error) {
-	p := NonQuicPrefixClientIDExtHdrPacker{}
-	var err error
-	p.protector, err = NewClientAddrExtHdrProtector(secret)
-	if err != nil {
-		return NonQuicPrefixClientIDExtHdrPacker{}, err
+func NewNonQuicPrefixClientIDExtHdrPacker(secret [32]byte, suite CipherSuite) (NonQuicPrefixClientIDExtHdrPacker, error) {
+	if !suite.Valid() {
+		return NonQuicPrefixClientIDExtHdrPacker{}, fmt.Errorf("unsupported cipher suite %d", suite)
+	}
+	p := NonQuicPrefixClientIDExtHdrPacker{suite: suite}
+	for _, s := range CipherSuites {
+		var err error
+		p.protectors[s], err = NewClientAddrExtHdrProtector(secret, s)
+		if err != nil {
+			return NonQuicPrefixClientIDExtHdrPacker{}, err
+		}
 	}
 	return p, nil
 }
 
-func (p NonQuicPrefixClientIDExtHdrPacker) AddHdr(protectedQuicPacket []byte, clientAddr netip.AddrPort) []byte {
+// AddHdr returns ErrorPacketTooLong if the packet with extension header exceeds MaxUDPPayloadLen
+func (p NonQuicPrefixClientIDExtHdrPacker) AddHdr(protectedQuicPacket []byte, clientAddr netip.AddrPort) ([]byte, error) {
+	return p.AddHdrOfType(ClientAddrExtHdrType, protectedQuicPacket, clientAddr)
+}
+
+// AddHdrOfType is like AddHdr, hdrType must be ClientAddrExtHdrType or ValidatedClientAddrExtHdrType
+func (p NonQuicPrefixClientIDExtHdrPacker) AddHdrOfType(hdrType byte, protectedQuicPacket []byte, clientAddr netip.AddrPort) ([]byte, error) {
+	if p.Len()+len(protectedQuicPacket) > MaxUDPPayloadLen {
+		return nil, ErrorPacketTooLong
+	}
 	var writeBuf [MaxUDPPayloadLen]byte
-	writeBuf[0] = ClientAddrExtHdrType
-	protectedExtHdr := p.protector.Protect(protectedQuicPacket, clientAddr)
+	writeBuf[0] = extHdrTypeWithCipherSuite(hdrType, p.suite)
+	protectedExtHdr := p.protectors[p.suite].Protect(protectedQuicPacket, clientAddr)
 	copy(writeBuf[1:], protectedExtHdr)
 	copy(writeBuf[1+len(protectedExtHdr):], protectedQuicPacket)
-	return writeBuf[:1+len(protectedExtHdr)+len(protectedQuicPacket)]
+	return writeBuf[:1+len(protectedExtHdr)+len(protectedQuicPacket)], nil
 }
 
 func (p *NonQuicPrefixClientIDExtHdrPacker) RemoveHdr(udpPayload []byte, asIPv4 bool) (netip.AddrPort, []byte, error) {
-	if udpPayload[0] != ClientAddrExtHdrType {
+	hdrType, suite := splitExtHdrType(udpPayload[0])
+	if hdrType != ClientAddrExtHdrType && hdrType != ValidatedClientAddrExtHdrType {
 		return netip.AddrPort{}, nil, fmt.Errorf("unexpected type")
 	}
+	if !suite.Valid() {
+		return netip.AddrPort{}, nil, fmt.Errorf("unsupported cipher suite %d", suite)
+	}
+	protector := p.protectors[suite]
 	typeLen := 1
-	extHdrLen := p.protector.Len()
+	extHdrLen := protector.Len()
+	if len(udpPayload) < typeLen+extHdrLen {
+		return netip.AddrPort{}, nil, ErrorUnexpectedHeaderLen
+	}
 	protectedExtHdr := udpPayload[typeLen : typeLen+extHdrLen]
 	protectedQuicPacket := udpPayload[typeLen+extHdrLen:]
-	clientAddr, err := p.protector.Decode(protectedExtHdr, protectedQuicPacket, asIPv4)
+	clientAddr, err := protector.Decode(protectedExtHdr, protectedQuicPacket, asIPv4)
 	if err != nil {
 		return netip.AddrPort{}, nil, err
 	}
@@ -45,5 +70,15 @@ func (p *NonQuicPrefixClientIDExtHdrPacker) RemoveHdr(udpPayload []byte, asIPv4
 }
 
 func (p NonQuicPrefixClientIDExtHdrPacker) Len() int {
-	return 1 + p.protector.Len()
+	return 1 + p.protectors[p.suite].Len()
+}
+
+// IsValidatedClientAddrExtHdr reports whether the router validated the client address,
+// e.g. by a Retry, so the backend does not have to.
+func IsValidatedClientAddrExtHdr(udpPayload []byte) bool {
+	if len(udpPayload) == 0 {
+		return false
+	}
+	hdrType, _ := splitExtHdrType(udpPayload[0])
+	return hdrType == ValidatedClientAddrExtHdrType
 }
@@ -3,6 +3,7 @@ package router
 import (
 	"crypto/rand"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"net/netip"
 	"testing"
 )
@@ -11,13 +12,25 @@ func TestPacker(t *testing.T) {
 	var secret [32]byte
 	_, err := rand.Reader.Read(secret[:])
 	assert.NoError(t, err)
-	packer, err := NewNonQuicPrefixClientIDExtHdrPacker(secret)
+	packer, err := NewNonQuicPrefixClientIDExtHdrPacker(secret, CipherSuiteAES256GCM)
 	assert.NoError(t, err)
 	quicPacket := []byte{1, 2, 3, 4}
 	clientAddr := netip.MustParseAddrPort("127.0.0.1:8292")
-	packedQuicPacket := packer.AddHdr(quicPacket, clientAddr)
+	packedQuicPacket, err := packer.AddHdr(quicPacket, clientAddr)
+	assert.NoError(t, err)
 	unpackedClientAddr, unpackedQuicPacked, err := packer.RemoveHdr(packedQuicPacket, true)
 	assert.NoError(t, err)
 	assert.Equal(t, clientAddr, unpackedClientAddr)
 	assert.Equal(t, quicPacket, unpackedQuicPacked)
 }
+
+func TestPackerRejectsTooLongPackets(t *testing.T) {
+	packer, err := NewNonQuicPrefixClientIDExtHdrPacker([32]byte{}, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:8292")
+	packed, err := packer.AddHdr(make([]byte, MaxUDPPayloadLen-packer.Len()), clientAddr)
+	require.NoError(t, err)
+	assert.Len(t, packed, MaxUDPPayloadLen)
+	_, err = packer.AddHdrOfType(ValidatedClientAddrExtHdrType, make([]byte, MaxUDPPayloadLen-packer.Len()+1), clientAddr)
+	assert.ErrorIs(t, err, ErrorPacketTooLong)
+}
@@ -0,0 +1,158 @@
+package router
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcapng block types and options, see draft-ietf-opsawg-pcapng
+const (
+	pcapngSectionHeaderBlock  uint32 = 0x0A0D0D0A
+	pcapngInterfaceDescBlock  uint32 = 0x00000001
+	pcapngEnhancedPacketBlock uint32 = 0x00000006
+	pcapngByteOrderMagic      uint32 = 0x1A2B3C4D
+	pcapngOptEndOfOpt         uint16 = 0
+	pcapngOptComment          uint16 = 1
+	pcapngOptShbUserAppl      uint16 = 4
+	pcapngOptIfTsResol        uint16 = 9
+	pcapngLinkTypeRaw         uint16 = 101
+	pcapngTsResolNanoseconds  byte   = 9
+	ipv4HeaderLen                    = 20
+	ipProtocolUDP             byte   = 17
+	syntheticHopLimit         byte   = 64
+)
+
+// pcapngWriter writes UDP datagrams as raw IP packets with comments.
+// The IP and UDP headers are synthesized, because the sockets only return the UDP payload.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// newPcapngWriter writes the section header and the only interface
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)          // major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0)          // minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // unknown section length
+	shb = appendPcapngOption(shb, pcapngOptShbUserAppl, []byte("quic-router-go"))
+	shb = appendPcapngOption(shb, pcapngOptEndOfOpt, nil)
+	if err := p.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // reserved
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	idb = appendPcapngOption(idb, pcapngOptIfTsResol, []byte{pcapngTsResolNanoseconds})
+	idb = appendPcapngOption(idb, pcapngOptEndOfOpt, nil)
+	if err := p.writeBlock(pcapngInterfaceDescBlock, idb); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writePacket writes the UDP datagram from src to dst
+func (p *pcapngWriter) writePacket(t time.Time, src netip.AddrPort, dst netip.AddrPort, payload []byte, comment string) error {
+	packet := appendIPUDPPacket(nil, src, dst, payload)
+	ts := uint64(t.UnixNano())
+	epb := p.buf[:0]
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = appendPcapngPadded(epb, packet)
+	if comment != "" {
+		epb = appendPcapngOption(epb, pcapngOptComment, []byte(comment))
+		epb = appendPcapngOption(epb, pcapngOptEndOfOpt, nil)
+	}
+	p.buf = epb
+	return p.writeBlock(pcapngEnhancedPacketBlock, epb)
+}
+
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(12 + len(body))
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[:], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:], totalLen)
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(body); err != nil {
+		return err
+	}
+	_, err := p.w.Write(hdr[4:])
+	return err
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPcapngPadded(b, value)
+}
+
+// appendPcapngPadded pads to 32 bit
+func appendPcapngPadded(b []byte, value []byte) []byte {
+	b = append(b, value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// appendIPUDPPacket synthesizes the IP and UDP header of the datagram.
+// IPv4 is used if both addresses are IPv4 addresses, e.g. after unmapping, otherwise IPv6.
+func appendIPUDPPacket(b []byte, src netip.AddrPort, dst netip.AddrPort, payload []byte) []byte {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	udpLen := 8 + len(payload)
+	var pseudoHeader []byte
+	if srcAddr.Is4() && dstAddr.Is4() {
+		start := len(b)
+		b = append(b, 0x45, 0) // version 4, 20 byte header
+		b = binary.BigEndian.AppendUint16(b, uint16(ipv4HeaderLen+udpLen))
+		b = append(b, 0, 0, 0x40, 0, syntheticHopLimit, ipProtocolUDP, 0, 0) // don't fragment
+		b = append(b, srcAddr.AsSlice()...)
+		b = append(b, dstAddr.AsSlice()...)
+		binary.BigEndian.PutUint16(b[start+10:], ^internetChecksum(0, b[start:]))
+		pseudoHeader = append(pseudoHeader, b[start+12:start+20]...)
+	} else {
+		b = append(b, 0x60, 0, 0, 0) // version 6
+		b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+		b = append(b, ipProtocolUDP, syntheticHopLimit)
+		srcAddr16, dstAddr16 := src.Addr().As16(), dst.Addr().As16()
+		b = append(b, srcAddr16[:]...)
+		b = append(b, dstAddr16[:]...)
+		pseudoHeader = append(append(pseudoHeader, srcAddr16[:]...), dstAddr16[:]...)
+	}
+	pseudoHeader = append(pseudoHeader, 0, ipProtocolUDP)
+	pseudoHeader = binary.BigEndian.AppendUint16(pseudoHeader, uint16(udpLen))
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+	checksum := ^internetChecksum(internetChecksum(0, pseudoHeader), b[start:])
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[start+6:], checksum)
+	return b
+}
+
+// internetChecksum continues the one's complement sum of RFC 1071
+func internetChecksum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for ; len(b) >= 2; b = b[2:] {
+		s += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,202 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPool is the pool of the default server, the backends of Config.Backends,
+// and of backends added by Router.AddBackend
+const DefaultPool = ""
+
+// SelectionStrategy selects the backend of a new connection within a pool
+type SelectionStrategy uint8
+
+const (
+	// SelectionConsistentHash selects by weighted rendezvous hashing of the destination connection ID
+	SelectionConsistentHash SelectionStrategy = iota
+	// SelectionLeastLoaded selects the less loaded of two backends chosen by weighted rendezvous hashing.
+	// The load is the reported load of the backends, see ControlMessagePacker.LoadReport,
+	// or the packet rate the router forwards, if not all backends report their load.
+	SelectionLeastLoaded
+)
+
+func (s SelectionStrategy) String() string {
+	switch s {
+	case SelectionConsistentHash:
+		return "consistent-hash"
+	case SelectionLeastLoaded:
+		return "least-loaded"
+	default:
+		return fmt.Sprintf("unknown selection strategy %d", uint8(s))
+	}
+}
+
+func ParseSelectionStrategy(s string) (SelectionStrategy, error) {
+	switch s {
+	case "consistent-hash":
+		return SelectionConsistentHash, nil
+	case "least-loaded":
+		return SelectionLeastLoaded, nil
+	default:
+		return 0, fmt.Errorf("unknown selection strategy %q", s)
+	}
+}
+
+type PoolConfig struct {
+	Backends  []netip.AddrPort
+	Selection SelectionStrategy
+	// Mirror enables traffic mirroring to a shadow backend, nil disables it
+	Mirror *MirrorConfig
+}
+
+const (
+	// handshakeAffinityTimeout is how long the backend selected for a destination connection ID is remembered.
+	// Clients switch to a connection ID of the backend when the handshake progresses.
+	handshakeAffinityTimeout = 10 * time.Second
+	// maxHandshakeAffinities limits the memory of the affinities
+	maxHandshakeAffinities = 1 << 16
+	// minInitialRetransmissionInterval is the minimum time between two Initials with the same destination connection ID
+	// for the second to count as retransmission.
+	// Initials of a ClientHello spanning several packets arrive at once.
+	minInitialRetransmissionInterval = 100 * time.Millisecond
+)
+
+// handshakeMap remembers values of client chosen destination connection IDs during handshakes.
+// Entries live for at least handshakeAffinityTimeout, unless the maximum length is reached.
+// It must only be accessed by the router's run loop.
+type handshakeMap[V any] struct {
+	current  map[string]V
+	previous map[string]V
+	rotated  time.Time
+}
+
+func newHandshakeMap[V any]() *handshakeMap[V] {
+	return &handshakeMap[V]{
+		current:  map[string]V{},
+		previous: map[string]V{},
+	}
+}
+
+func (m *handshakeMap[V]) rotate(now time.Time) {
+	elapsed := now.Sub(m.rotated)
+	if elapsed < handshakeAffinityTimeout && len(m.current) < maxHandshakeAffinities/2 {
+		return
+	}
+	if elapsed < 2*handshakeAffinityTimeout {
+		m.previous = m.current
+	} else {
+		m.previous = map[string]V{}
+	}
+	m.current = map[string]V{}
+	m.rotated = now
+}
+
+// get returns the zero value if the destination connection ID is unknown
+func (m *handshakeMap[V]) get(destConnID []byte, now time.Time) V {
+	m.rotate(now)
+	if v, ok := m.current[string(destConnID)]; ok {
+		return v
+	}
+	return m.previous[string(destConnID)]
+}
+
+func (m *handshakeMap[V]) put(destConnID []byte, v V, now time.Time) {
+	m.rotate(now)
+	m.current[string(destConnID)] = v
+}
+
+// handshakeAffinity remembers the backends selected for client chosen destination connection IDs,
+// so all long header packets of a handshake reach the same backend, even if the load changes meanwhile.
+type handshakeAffinity = handshakeMap[*Backend]
+
+func newHandshakeAffinity() *handshakeAffinity {
+	return newHandshakeMap[*Backend]()
+}
+
+// pool is a named group of backends with a selection strategy
+type pool struct {
+	name      string
+	selection SelectionStrategy
+	// affinity is used by SelectionLeastLoaded, and by SelectionConsistentHash with slow start,
+	// because the weights of backends in slow start change during handshakes.
+	// nil if the selection is deterministic.
+	affinity *handshakeAffinity
+	// split is nil if no new connections are routed to a canary pool
+	split *split
+	// mirror is nil if no traffic is mirrored
+	mirror *mirror
+	// initials is the time of the first Initial of the client chosen destination connection IDs
+	initials *handshakeMap[time.Time]
+	// counters for metrics, the backends count the forwarded packets
+	initialPackets atomic.Uint64
+	noBackendDrops atomic.Uint64
+	// canaryFallbacks counts the new connections of a canary pool
+	// routed to the split pool, because no backend was available
+	canaryFallbacks atomic.Uint64
+	// retransmittedInitials counts the Initials with the destination connection ID of an earlier Initial.
+	// Clients retransmit them until a backend answers, so they show failing handshakes.
+	retransmittedInitials atomic.Uint64
+	// the following counters count packets of connection IDs of backends of the pool
+	statelessResets    atomic.Uint64
+	invalidConnIDs     atomic.Uint64
+	drainDeadlineDrops atomic.Uint64
+}
+
+func newPool(name string, config PoolConfig, slowStart time.Duration) (*pool, error) {
+	p := &pool{name: name, selection: config.Selection, initials: newHandshakeMap[time.Time]()}
+	switch config.Selection {
+	case SelectionConsistentHash:
+		if slowStart > 0 {
+			p.affinity = newHandshakeAffinity()
+		}
+	case SelectionLeastLoaded:
+		p.affinity = newHandshakeAffinity()
+	default:
+		return nil, fmt.Errorf("pool %q: %s", name, config.Selection)
+	}
+	if config.Mirror != nil {
+		var err error
+		p.mirror, err = newMirror(*config.Mirror)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+	}
+	return p, nil
+}
+
+// countInitial counts the Initial as retransmitted if an Initial with the same destination connection ID
+// arrived at least minInitialRetransmissionInterval earlier.
+// It must only be called by the router's run loop.
+func (p *pool) countInitial(destConnID []byte, now time.Time) {
+	p.initialPackets.Add(1)
+	first := p.initials.get(destConnID, now)
+	if first.IsZero() {
+		p.initials.put(destConnID, now, now)
+	} else if now.Sub(first) >= minInitialRetransmissionInterval {
+		p.retransmittedInitials.Add(1)
+	}
+}
+
+// selectBackend must only be called by the router's run loop.
+// Returns nil if no backend is available.
+func (p *pool) selectBackend(backends []*Backend, destConnID []byte, now time.Time) *Backend {
+	if p.affinity == nil {
+		return selectBackend(backends, destConnID, now)
+	}
+	if b := p.affinity.get(destConnID, now); b != nil && b.available() {
+		return b
+	}
+	var b *Backend
+	if p.selection == SelectionLeastLoaded {
+		b = selectLeastLoaded(backends, destConnID, now)
+	} else {
+		b = selectBackend(backends, destConnID, now)
+	}
+	if b != nil {
+		p.affinity.put(destConnID, b, now)
+	}
+	return b
+}
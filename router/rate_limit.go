@@ -0,0 +1,275 @@
+package router
+
+import (
+	"fmt"
+	"hash/maphash"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket allows rate events per second on average and up to burst events at once
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens accumulated since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+const (
+	DefaultRateLimitIPv4PrefixLen = 24
+	DefaultRateLimitIPv6PrefixLen = 48
+	// DefaultRateLimitRetryRate is the default of RateLimitConfig.RetryRate
+	DefaultRateLimitRetryRate = 1000
+	// rateLimitSketchDepth and rateLimitSketchWidth bound the memory of the per-prefix buckets
+	rateLimitSketchDepth = 4
+	rateLimitSketchWidth = 2048
+)
+
+// RateLimitAction is applied to long header packets exceeding the rate limits
+type RateLimitAction uint8
+
+const (
+	// RateLimitDrop drops the packets
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitRetry answers Initials without valid Retry token with a Retry, other packets are dropped.
+	// Initials with a valid token are not limited, because their client address is validated.
+	// Retries are limited by RateLimitConfig.RetryRate, so spoofed floods are not reflected.
+	RateLimitRetry
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitRetry:
+		return "retry"
+	default:
+		return fmt.Sprintf("unknown rate limit action %d", uint8(a))
+	}
+}
+
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch s {
+	case "drop":
+		return RateLimitDrop, nil
+	case "retry":
+		return RateLimitRetry, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit action %q", s)
+	}
+}
+
+// RateLimitConfig limits the long header packets the router handles,
+// e.g. to protect the backends from Initial floods.
+// Packets of sources are limited per prefix,
+// the buckets of the prefixes share a sketch of fixed size, so floods of spoofed sources do not grow the memory.
+// Prefixes whose buckets collide in the sketch may be limited together.
+type RateLimitConfig struct {
+	// PrefixRate limits the long header packets per second of each source prefix, 0 disables the limit
+	PrefixRate float64
+	// PrefixBurst is the number of packets a source prefix may send at once, the default is PrefixRate
+	PrefixBurst float64
+	// IPv4PrefixLen is the length of the source prefixes of IPv4 clients, the default is DefaultRateLimitIPv4PrefixLen
+	IPv4PrefixLen int
+	// IPv6PrefixLen is the length of the source prefixes of IPv6 clients, the default is DefaultRateLimitIPv6PrefixLen
+	IPv6PrefixLen int
+	// InitialRate limits the Initial packets per second of all sources together, 0 disables the limit
+	InitialRate float64
+	// InitialBurst is the number of Initial packets that may arrive at once, the default is InitialRate
+	InitialBurst float64
+	// Action is applied to packets exceeding a limit
+	Action RateLimitAction
+	// RetryRate limits the Retries per second sent by RateLimitRetry, the default is DefaultRateLimitRetryRate.
+	// Limited Initials are dropped if the Retry rate is exceeded.
+	RetryRate float64
+}
+
+// rateLimiter is only used by the run loop, the counters may be read concurrently
+type rateLimiter struct {
+	config RateLimitConfig
+	// prefixes is nil without PrefixRate
+	prefixes *prefixBuckets
+	// initials is nil without InitialRate
+	initials *tokenBucket
+	// retries is nil without RateLimitRetry
+	retries        *tokenBucket
+	prefixLimited  atomic.Uint64
+	initialLimited atomic.Uint64
+	retried        atomic.Uint64
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	if config.PrefixRate < 0 || config.PrefixBurst < 0 || config.InitialRate < 0 || config.InitialBurst < 0 || config.RetryRate < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if config.IPv4PrefixLen == 0 {
+		config.IPv4PrefixLen = DefaultRateLimitIPv4PrefixLen
+	}
+	if config.IPv6PrefixLen == 0 {
+		config.IPv6PrefixLen = DefaultRateLimitIPv6PrefixLen
+	}
+	if config.IPv4PrefixLen < 0 || config.IPv4PrefixLen > 32 || config.IPv6PrefixLen < 0 || config.IPv6PrefixLen > 128 {
+		return nil, fmt.Errorf("invalid rate limit prefix length")
+	}
+	if config.Action != RateLimitDrop && config.Action != RateLimitRetry {
+		return nil, fmt.Errorf("unknown rate limit action %d", config.Action)
+	}
+	if config.PrefixBurst == 0 {
+		config.PrefixBurst = config.PrefixRate
+	}
+	if config.InitialBurst == 0 {
+		config.InitialBurst = config.InitialRate
+	}
+	if config.RetryRate == 0 {
+		config.RetryRate = DefaultRateLimitRetryRate
+	}
+	l := &rateLimiter{config: config}
+	if config.PrefixRate != 0 {
+		l.prefixes = newPrefixBuckets(config.PrefixRate, config.PrefixBurst)
+	}
+	if config.InitialRate != 0 {
+		l.initials = newTokenBucket(config.InitialRate, config.InitialBurst)
+	}
+	if config.Action == RateLimitRetry {
+		l.retries = newTokenBucket(config.RetryRate, config.RetryRate)
+	}
+	return l, nil
+}
+
+// adopt continues the counters of the previous rate limiter,
+// and its buckets if the limits are unchanged, so limited sources remain limited
+func (l *rateLimiter) adopt(previous *rateLimiter) {
+	if l.config == previous.config {
+		l.prefixes = previous.prefixes
+		l.initials = previous.initials
+		l.retries = previous.retries
+	}
+	l.prefixLimited.Store(previous.prefixLimited.Load())
+	l.initialLimited.Store(previous.initialLimited.Load())
+	l.retried.Store(previous.retried.Load())
+}
+
+// limited says if the long header packet of the client exceeds a limit, otherwise the packet is counted.
+// Initials are only counted by the Initial limit if the prefix limit is not exceeded.
+func (l *rateLimiter) limited(client netip.Addr, initial bool, now time.Time) bool {
+	if l.prefixes != nil && !l.prefixes.allow(l.prefix(client), now) {
+		l.prefixLimited.Add(1)
+		return true
+	}
+	if initial && l.initials != nil && !l.initials.allow(now) {
+		l.initialLimited.Add(1)
+		return true
+	}
+	return false
+}
+
+// prefix returns the source prefix of the client
+func (l *rateLimiter) prefix(client netip.Addr) netip.Prefix {
+	client = client.Unmap()
+	bits := l.config.IPv6PrefixLen
+	if client.Is4() {
+		bits = l.config.IPv4PrefixLen
+	}
+	prefix, _ := client.Prefix(bits)
+	return prefix
+}
+
+// prefixBuckets is a count-min sketch of token buckets.
+// A prefix maps to one bucket per row, each bucket also counts the packets of the colliding prefixes,
+// so the fullest bucket of a prefix has at most the tokens the prefix would have on its own.
+// Prefixes may be limited early if they collide in all rows, but never exceed their rate.
+type prefixBuckets struct {
+	// seed makes the buckets of a prefix unpredictable, so collisions cannot be provoked
+	seed    maphash.Seed
+	buckets [rateLimitSketchDepth][rateLimitSketchWidth]tokenBucket
+}
+
+func newPrefixBuckets(rate float64, burst float64) *prefixBuckets {
+	p := &prefixBuckets{seed: maphash.MakeSeed()}
+	for row := range p.buckets {
+		for i := range p.buckets[row] {
+			p.buckets[row][i] = *newTokenBucket(rate, burst)
+		}
+	}
+	return p
+}
+
+func (p *prefixBuckets) allow(prefix netip.Prefix, now time.Time) bool {
+	var key [17]byte
+	addr := prefix.Addr().As16()
+	copy(key[:], addr[:])
+	key[16] = byte(prefix.Bits())
+	if prefix.Addr().Is4() {
+		// distinguish IPv4 prefixes from IPv4-mapped IPv6 prefixes
+		key[16] |= 0x80
+	}
+	h := maphash.Bytes(p.seed, key[:])
+	// the rows use independent bits of the hash
+	var buckets [rateLimitSketchDepth]*tokenBucket
+	tokens := 0.0
+	for row := range p.buckets {
+		b := &p.buckets[row][(h>>(16*row))%rateLimitSketchWidth]
+		b.refill(now)
+		tokens = max(tokens, b.tokens)
+		buckets[row] = b
+	}
+	if tokens < 1 {
+		return false
+	}
+	// conservative update: buckets are not drained below the tokens left to the prefix,
+	// so colliding prefixes are limited as little as possible
+	for _, b := range buckets {
+		b.tokens = min(b.tokens, tokens-1)
+	}
+	return true
+}
+
+// handleRateLimited applies the action of the rate limits to a long header packet exceeding them
+func (r *Router) handleRateLimited(l *listener, hdr *longHeader, datagramLen int, addr netip.AddrPort) error {
+	if r.rateLimiter.config.Action != RateLimitRetry || !hdr.isInitial() {
+		r.trace.drop("rate limited")
+		return nil // drop
+	}
+	if datagramLen < MinInitialDatagramLen {
+		r.trace.drop("rate limited, initial in too short datagram")
+		return nil // drop, not answered
+	}
+	if !r.rateLimiter.retries.allow(r.now()) {
+		r.trace.drop("rate limited, retry rate exceeded")
+		return nil // drop
+	}
+	r.rateLimiter.retried.Add(1)
+	err := r.sendRetry(l, hdr, datagramLen, addr)
+	r.trace.decide("rate limited, answered with retry")
+	return err
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"encoding/binary"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendTestInitial appends an Initial datagram without payload of MinInitialDatagramLen bytes
+func appendTestInitial(b []byte, destConnID []byte, token []byte) []byte {
+	start := len(b)
+	b = append(b, 0xc0)
+	b = binary.BigEndian.AppendUint32(b, Version1)
+	b = append(b, byte(len(destConnID)))
+	b = append(b, destConnID...)
+	b = append(b, 0)
+	b = quicvarint.Append(b, uint64(len(token)))
+	b = append(b, token...)
+	b = quicvarint.AppendWithLen(b, uint64(MinInitialDatagramLen-(len(b)-start)-2), 2)
+	return append(b, make([]byte, MinInitialDatagramLen-(len(b)-start))...)
+}
+
+func newRateLimitReplay(t *testing.T, config RateLimitConfig) (*Replay, netip.AddrPort) {
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		DefaultServerAddr: netip.MustParseAddrPort("10.0.0.1:4433"),
+		Config:            &Config{RateLimit: &config},
+	})
+	require.NoError(t, err)
+	return replay, routerAddr
+}
+
+func TestRateLimitPrefix(t *testing.T) {
+	replay, routerAddr := newRateLimitReplay(t, RateLimitConfig{PrefixRate: 2})
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	start := time.Unix(1700000000, 0)
+	route := func(at time.Duration, from string) string {
+		decision, err := replay.Route(start.Add(at), netip.MustParseAddrPort(from), routerAddr, initial)
+		require.NoError(t, err)
+		return decision
+	}
+	assert.True(t, strings.HasSuffix(route(0, "192.0.2.1:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(0, "192.0.2.1:1235"), "forwarded to backend 10.0.0.1:4433"))
+	// the /24 of the client is limited
+	assert.True(t, strings.HasSuffix(route(0, "192.0.2.1:1234"), "dropped: rate limited"))
+	assert.True(t, strings.HasSuffix(route(0, "192.0.2.200:1234"), "dropped: rate limited"))
+	assert.True(t, strings.HasSuffix(route(0, "198.51.100.1:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(time.Second/2, "192.0.2.1:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(time.Second/2, "192.0.2.1:1234"), "dropped: rate limited"))
+	// IPv6 clients are limited by /48
+	assert.True(t, strings.HasSuffix(route(0, "[2001:db8:1::1]:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(0, "[2001:db8:1:2::1]:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.True(t, strings.HasSuffix(route(0, "[2001:db8:1:3::1]:1234"), "dropped: rate limited"))
+	assert.True(t, strings.HasSuffix(route(0, "[2001:db8:2::1]:1234"), "forwarded to backend 10.0.0.1:4433"))
+	assert.Equal(t, uint64(4), replay.router.rateLimiter.prefixLimited.Load())
+	assert.Zero(t, replay.router.rateLimiter.initialLimited.Load())
+}
+
+func TestRateLimitInitialsRetry(t *testing.T) {
+	replay, routerAddr := newRateLimitReplay(t, RateLimitConfig{InitialRate: 1, Action: RateLimitRetry})
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	initial := appendTestInitial(nil, destConnID, nil)
+	decision, err := replay.Route(now, client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "forwarded to backend 10.0.0.1:4433"), decision)
+	decision, err = replay.Route(now, netip.MustParseAddrPort("198.51.100.1:1234"), routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "rate limited, answered with retry"), decision)
+
+	// Initials with a valid token are not limited
+	retrySrcConnID := []byte{9, 10, 11, 12, 13, 14, 15, 16}
+	token, err := replay.router.retry.tokenProtector.NewToken(client, destConnID, retrySrcConnID, now)
+	require.NoError(t, err)
+	decision, err = replay.Route(now, client, routerAddr, appendTestInitial(nil, retrySrcConnID, token))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "forwarded to backend 10.0.0.1:4433"), decision)
+	decision, err = replay.Route(now, client, routerAddr, appendTestInitial(nil, retrySrcConnID, []byte("invalid")))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "rate limited, answered with retry"), decision)
+	assert.Equal(t, uint64(3), replay.router.rateLimiter.initialLimited.Load())
+	assert.Equal(t, uint64(2), replay.router.rateLimiter.retried.Load())
+}
+
+func TestPrefixBucketsCollisions(t *testing.T) {
+	p := newPrefixBuckets(1, 1)
+	now := time.Now()
+	// distinct prefixes rarely share all buckets
+	allowed := 0
+	for i := 0; i < 1000; i++ {
+		prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)
+		if p.allow(prefix, now) {
+			allowed++
+		}
+	}
+	assert.Greater(t, allowed, 980)
+	assert.False(t, p.allow(netip.MustParsePrefix("10.0.0.0/24"), now))
+	assert.True(t, p.allow(netip.MustParsePrefix("10.0.0.0/24"), now.Add(time.Second)))
+}
+
+func TestRateLimitRetryIsLimited(t *testing.T) {
+	replay, routerAddr := newRateLimitReplay(t, RateLimitConfig{InitialRate: 1, InitialBurst: 1, Action: RateLimitRetry, RetryRate: 1})
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	decision, err := replay.Route(now, client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "forwarded to backend 10.0.0.1:4433"), decision)
+
+	// small limited Initials of spoofed sources are not answered
+	decision, err = replay.Route(now, client, routerAddr, initial[:200])
+	require.NoError(t, err)
+	assert.Contains(t, decision, "dropped: ")
+	assert.NotContains(t, decision, "answered")
+	assert.Zero(t, replay.router.rateLimiter.retried.Load())
+
+	decision, err = replay.Route(now, client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "rate limited, answered with retry"), decision)
+	// Retries have their own limit
+	decision, err = replay.Route(now, client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "dropped: rate limited, retry rate exceeded"), decision)
+	assert.Equal(t, uint64(1), replay.router.rateLimiter.retried.Load())
+}
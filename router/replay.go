@@ -0,0 +1,86 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Replay routes datagrams like a router of the tenant, but without sockets,
+// e.g. to reproduce the decisions of a router from a capture or to test a changed config against captured traffic.
+// Datagrams are routed at their receive time, so Retry tokens, rate limits and handshake timeouts behave like in the capture.
+// Backends are up unless a control message of the replayed traffic changes their state,
+// health checks are not sent.
+type Replay struct {
+	router *Router
+}
+
+func NewReplay(config TenantConfig) (*Replay, error) {
+	listeners := make([]*listener, 0, len(config.Listen))
+	for _, addr := range config.Listen {
+		listeners = append(listeners, &listener{localAddr: addr})
+	}
+	r, err := newRouter(listeners, config.Secret, config.DefaultServerAddr, config.Config, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.replaying = true
+	r.applyWeights()
+	if config.Config.HealthCheck != nil {
+		// pongs are classified like by the router, but no backend is pinged
+		r.healthChecker = newHealthChecker(r, *config.Config.HealthCheck)
+	}
+	return &Replay{router: r}, nil
+}
+
+// Receives says if a datagram to the address is received by a listener of the router.
+// Datagrams to other addresses, e.g. the datagrams the router sent, must not be routed.
+func (p *Replay) Receives(to netip.AddrPort) bool {
+	return p.listener(to) != nil
+}
+
+// listener returns the listener whose socket receives datagrams to the address, or nil
+func (p *Replay) listener(to netip.AddrPort) *listener {
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
+	for _, l := range p.router.listeners {
+		addr := l.localAddr.Addr().Unmap()
+		if addr == to.Addr() && l.localAddr.Port() == to.Port() {
+			return l
+		}
+		// IPv6 sockets also receive IPv4 datagrams
+		if addr.IsUnspecified() && l.localAddr.Port() == to.Port() && (addr.Is6() || to.Addr().Is4()) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Route routes the datagram from the address to the listener receiving datagrams to the address,
+// see Receives.
+// Returns the decision, that is formatted like the comments of a Capture,
+// and the error that would have stopped the router.
+func (p *Replay) Route(received time.Time, from netip.AddrPort, to netip.AddrPort, datagram []byte) (string, error) {
+	l := p.listener(to)
+	if l == nil {
+		return "", fmt.Errorf("no listener receives datagrams to %s", to)
+	}
+	// IPv6 sockets receive IPv4 datagrams from mapped addresses
+	if l.localAddr.Addr().Is6() && !l.localAddr.Addr().Is4In6() {
+		from = netip.AddrPortFrom(netip.AddrFrom16(from.Addr().As16()), from.Port())
+	} else {
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	}
+	r := p.router
+	r.replayed = received
+	r.trace = &packetTrace{
+		received: received,
+		listener: l,
+		from:     from,
+		datagram: datagram,
+		client:   from,
+	}
+	err := r.routeUDPPacket(l, datagram, from)
+	trace := r.trace
+	r.trace = nil
+	return trace.String(), err
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayCapture(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	r, secret := startTestRouter(t, backendAddr)
+	routerAddr := r.listeners[0].localAddr
+	client := listenLoopback(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, nil)
+	require.NoError(t, err)
+	require.NoError(t, r.StartCapture(c))
+	shortHdr := sendShortHeaderPacket(t, client, secret, backendAddr, routerAddr)
+	receiveDatagram(t, backend, shortHdr)
+	packer := newTestPacker(t, secret, backendAddr)
+	datagram, err := packer.AddHdr(shortHdr, clientAddr)
+	require.NoError(t, err)
+	_, err = backend.WriteToUDPAddrPort(datagram, routerAddr)
+	require.NoError(t, err)
+	receiveDatagram(t, client, shortHdr)
+	_, err = client.WriteToUDPAddrPort(make([]byte, 30), routerAddr)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return c.Packets() == 5 }, time.Second, time.Millisecond)
+	r.StopCapture()
+	require.NoError(t, c.Close())
+
+	replay, err := NewReplay(TenantConfig{Listen: []netip.AddrPort{routerAddr}, Secret: secret, DefaultServerAddr: backendAddr, Config: &Config{}})
+	require.NoError(t, err)
+	reader, err := NewCaptureReader(&buf)
+	require.NoError(t, err)
+	replayed := 0
+	for {
+		d, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if !replay.Receives(d.Dst) {
+			assert.True(t, strings.HasPrefix(d.Comment, "sent: "), d.Comment)
+			continue
+		}
+		decision, err := replay.Route(d.Time, d.Src, d.Dst, d.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, d.Comment, decision)
+		replayed++
+	}
+	assert.Equal(t, 3, replayed)
+	assert.Zero(t, reader.Skipped())
+}
+
+func TestReplayListener(t *testing.T) {
+	replay, err := NewReplay(TenantConfig{
+		Listen: []netip.AddrPort{netip.MustParseAddrPort("[::]:443"), netip.MustParseAddrPort("192.0.2.1:4433")},
+		Config: &Config{},
+	})
+	require.NoError(t, err)
+	for to, expected := range map[string]bool{
+		"198.51.100.1:443":          true,
+		"[2001:db8::1]:443":         true,
+		"192.0.2.1:4433":            true,
+		"[::ffff:192.0.2.1]:4433":   true,
+		"192.0.2.2:4433":            false,
+		"[2001:db8::1]:4433":        false,
+		"[::ffff:198.51.100.1]:444": false,
+	} {
+		assert.Equal(t, expected, replay.Receives(netip.MustParseAddrPort(to)), to)
+	}
+	// like the sockets, the IPv6 listener receives IPv4 datagrams from mapped addresses
+	decision, err := replay.Route(time.Now(), netip.MustParseAddrPort("198.51.100.7:1234"), netip.MustParseAddrPort("192.0.2.1:443"), make([]byte, 30))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(decision, "greased short header from [::ffff:198.51.100.7]:1234, "), decision)
+	decision, err = replay.Route(time.Now(), netip.MustParseAddrPort("[::ffff:198.51.100.7]:1234"), netip.MustParseAddrPort("192.0.2.1:4433"), make([]byte, 30))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(decision, "greased short header from 198.51.100.7:1234, "), decision)
+}
+
+func TestCaptureReaderPcap(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("198.51.100.1:443")
+	ipv4 := appendIPUDPPacket(nil, src, dst, []byte("ipv4"))
+	ipv6 := appendIPUDPPacket(nil, netip.MustParseAddrPort("[2001:db8::1]:1234"), netip.MustParseAddrPort("[2001:db8::2]:443"), []byte("ipv6"))
+	tcp := append([]byte{}, ipv4...)
+	tcp[9] = 6
+	fragment := append([]byte{}, ipv4...)
+	fragment[6] = 0x20 // more fragments
+
+	// big endian pcap with nanosecond timestamps and Ethernet frames
+	var file []byte
+	file = binary.BigEndian.AppendUint32(file, pcapMagicNanoseconds)
+	file = binary.BigEndian.AppendUint16(file, 2)
+	file = binary.BigEndian.AppendUint16(file, 4)
+	file = append(file, make([]byte, 12)...)
+	file = binary.BigEndian.AppendUint32(file, linkTypeEthernet)
+	for i, frame := range [][]byte{
+		append(append(make([]byte, 12), 0x08, 0x00), ipv4...),
+		append(append(make([]byte, 12), 0x81, 0x00, 0, 1, 0x86, 0xDD), ipv6...),
+		append(append(make([]byte, 12), 0x08, 0x00), tcp...),
+		append(append(make([]byte, 12), 0x08, 0x00), fragment...),
+		append(append(make([]byte, 12), 0x08, 0x00), ipv4[:len(ipv4)-1]...),
+	} {
+		file = binary.BigEndian.AppendUint32(file, 1700000000)
+		file = binary.BigEndian.AppendUint32(file, uint32(i))
+		file = binary.BigEndian.AppendUint32(file, uint32(len(frame)))
+		file = binary.BigEndian.AppendUint32(file, uint32(len(frame)))
+		file = append(file, frame...)
+	}
+
+	reader, err := NewCaptureReader(bytes.NewReader(file))
+	require.NoError(t, err)
+	d, err := reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1700000000, 0), d.Time)
+	assert.Equal(t, src, d.Src)
+	assert.Equal(t, dst, d.Dst)
+	assert.Equal(t, []byte("ipv4"), d.Payload)
+	d, err = reader.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 2, d.Number)
+	assert.Equal(t, time.Unix(1700000000, 1), d.Time)
+	assert.Equal(t, netip.MustParseAddrPort("[2001:db8::2]:443"), d.Dst)
+	assert.Equal(t, []byte("ipv6"), d.Payload)
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 3, reader.Skipped())
+
+	_, err = NewCaptureReader(bytes.NewReader(make([]byte, 24)))
+	assert.Error(t, err)
+}
+
+func TestReplayUsesCaptureTime(t *testing.T) {
+	replay, _, shortHdr, routerAddr := newAbuseReplay(t, nil)
+	replay.router.config.SlowStart = time.Minute
+	backendAddr := netip.MustParseAddrPort("10.0.0.1:4433")
+	start := time.Unix(1700000000, 0)
+	route := func(at time.Duration) string {
+		decision, err := replay.Route(start.Add(at), netip.MustParseAddrPort("192.0.2.1:1234"), routerAddr, shortHdr)
+		require.NoError(t, err)
+		return decision
+	}
+	// the drain deadline is in the past of the wall clock, but not of the capture
+	require.NoError(t, replay.router.DrainBackend(backendAddr, start.Add(time.Minute)))
+	assert.True(t, strings.HasSuffix(route(0), "forwarded to backend 10.0.0.1:4433"))
+	assert.Contains(t, route(2*time.Minute), "unknown or unreachable backend")
+	b := replay.router.backends.getByAddr(backendAddr)
+	assert.Equal(t, start.UnixNano(), b.lastForwarded.Load())
+
+	// slow start begins at the time of the captured datagram
+	require.NoError(t, replay.router.UndrainBackend(backendAddr))
+	replay.router.setBackendState(b, BackendDown)
+	route(3 * time.Minute)
+	replay.router.setBackendState(b, BackendUp)
+	assert.Equal(t, start.Add(3*time.Minute).UnixNano(), b.slowStartBegin.Load())
+}
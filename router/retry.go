@@ -0,0 +1,251 @@
+package router
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"net/netip"
+	"time"
+)
+
+const (
+	retryTokenType            byte = 0x01
+	retryTokenNonceLen             = 12
+	DefaultRetryTokenLifetime      = 10 * time.Second
+)
+
+var (
+	ErrorInvalidRetryToken = errors.New("invalid retry token")
+	ErrorExpiredRetryToken = errors.New("expired retry token")
+)
+
+var (
+	retryIntegrityAEADV1  = newRetryIntegrityAEAD([16]byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e})
+	retryIntegrityNonceV1 = [12]byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb}
+	retryIntegrityAEADV2  = newRetryIntegrityAEAD([16]byte{0x8f, 0xb4, 0xb0, 0x1b, 0x56, 0xac, 0x48, 0xe2, 0x60, 0xfb, 0xcb, 0xce, 0xad, 0x7c, 0xcc, 0x92})
+	retryIntegrityNonceV2 = [12]byte{0xd8, 0x69, 0x69, 0xbc, 0x2d, 0x7c, 0x6d, 0x99, 0x90, 0xef, 0xb0, 0x4a}
+)
+
+func newRetryIntegrityAEAD(key [16]byte) cipher.AEAD {
+	c, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+type RetryConfig struct {
+	// Always sends a Retry for every Initial without a valid token
+	Always bool
+	// InitialRateThreshold sends Retries when more Initials per second are received.
+	// 0 disables this.
+	InitialRateThreshold uint64
+	// TokenLifetime is the validity of the issued tokens.
+	// The default is DefaultRetryTokenLifetime.
+	TokenLifetime time.Duration
+}
+
+// RetryToken is the decoded content of a token issued by the router's Retry service.
+// Backends need it to set the original_destination_connection_id
+// and retry_source_connection_id transport parameters.
+type RetryToken struct {
+	OriginalDestConnID quic.ConnectionID
+	RetrySrcConnID     quic.ConnectionID
+	IssuedAt           time.Time
+}
+
+// RetryTokenProtector encrypts and validates Retry tokens.
+// Tokens are bound to the client address.
+// The format is: type (1) | nonce (12) | AEAD(issued at (8) | odcid len (1) | odcid | rscid len (1) | rscid) | tag (16)
+type RetryTokenProtector struct {
+	aead cipher.AEAD
+}
+
+// DeriveRetryTokenKey derives the key shared by the router and the backends
+// for Retry token validation from the master secret.
+// Unlike the server keys, the key is the same for all backends,
+// because the router issues tokens before it selects a backend.
+// Whoever knows the key can mint tokens, so a leaked key lets spoofed Initials pass as validated,
+// see ValidatedClientAddrExtHdrType, for all backends until the master secret is rotated.
+func DeriveRetryTokenKey(master [32]byte) ([32]byte, error) {
+	key, err := expandLabel(master, nil, labelRetryToken, 32)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return [32]byte(key), nil
+}
+
+func NewRetryTokenProtector(tokenKey [32]byte) (*RetryTokenProtector, error) {
+	c, err := aes.NewCipher(tokenKey[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &RetryTokenProtector{aead: aead}, nil
+}
+
+func (p *RetryTokenProtector) NewToken(clientAddr netip.AddrPort, origDestConnID []byte, retrySrcConnID []byte, now time.Time) ([]byte, error) {
+	token := make([]byte, 1+retryTokenNonceLen, 1+retryTokenNonceLen+8+2+len(origDestConnID)+len(retrySrcConnID)+p.aead.Overhead())
+	token[0] = retryTokenType
+	if _, err := rand.Read(token[1:]); err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 8, 8+2+len(origDestConnID)+len(retrySrcConnID))
+	binary.BigEndian.PutUint64(plaintext, uint64(now.UnixMilli()))
+	plaintext = append(plaintext, byte(len(origDestConnID)))
+	plaintext = append(plaintext, origDestConnID...)
+	plaintext = append(plaintext, byte(len(retrySrcConnID)))
+	plaintext = append(plaintext, retrySrcConnID...)
+	clientAddrHdr := ClientAddrExtHdrFromAddrPort(clientAddr)
+	return p.aead.Seal(token, token[1:1+retryTokenNonceLen], plaintext, clientAddrHdr.Bytes()), nil
+}
+
+// DecodeToken fails if the token was not issued by the router for this client address
+// or is older than lifetime.
+func (p *RetryTokenProtector) DecodeToken(token []byte, clientAddr netip.AddrPort, lifetime time.Duration, now time.Time) (*RetryToken, error) {
+	if len(token) < 1+retryTokenNonceLen+p.aead.Overhead() || token[0] != retryTokenType {
+		return nil, ErrorInvalidRetryToken
+	}
+	clientAddrHdr := ClientAddrExtHdrFromAddrPort(clientAddr)
+	plaintext, err := p.aead.Open(nil, token[1:1+retryTokenNonceLen], token[1+retryTokenNonceLen:], clientAddrHdr.Bytes())
+	if err != nil {
+		return nil, ErrorInvalidRetryToken
+	}
+	if len(plaintext) < 8+1 {
+		return nil, ErrorInvalidRetryToken
+	}
+	t := &RetryToken{IssuedAt: time.UnixMilli(int64(binary.BigEndian.Uint64(plaintext)))}
+	rest := plaintext[8:]
+	origDestConnIDLen := int(rest[0])
+	if len(rest) < 1+origDestConnIDLen+1 {
+		return nil, ErrorInvalidRetryToken
+	}
+	t.OriginalDestConnID = quic.ConnectionIDFromBytes(rest[1 : 1+origDestConnIDLen])
+	rest = rest[1+origDestConnIDLen:]
+	retrySrcConnIDLen := int(rest[0])
+	if len(rest) != 1+retrySrcConnIDLen {
+		return nil, ErrorInvalidRetryToken
+	}
+	t.RetrySrcConnID = quic.ConnectionIDFromBytes(rest[1:])
+	if now.Sub(t.IssuedAt) > lifetime {
+		return nil, ErrorExpiredRetryToken
+	}
+	return t, nil
+}
+
+// appendRetryPacket appends a Retry packet, see RFC 9000 Section 17.2.5 and RFC 9369 Section 3.2
+func appendRetryPacket(b []byte, version uint32, destConnID []byte, srcConnID []byte, origDestConnID []byte, token []byte) ([]byte, error) {
+	if !isKnownVersion(version) {
+		return nil, fmt.Errorf("unsupported version %#x", version)
+	}
+	start := len(b)
+	var unused [1]byte
+	if _, err := rand.Read(unused[:]); err != nil {
+		return nil, err
+	}
+	b = append(b, 0xc0|encodePacketType(version, packetTypeRetry)|unused[0]&0x0f)
+	b = binary.BigEndian.AppendUint32(b, version)
+	b = append(b, byte(len(destConnID)))
+	b = append(b, destConnID...)
+	b = append(b, byte(len(srcConnID)))
+	b = append(b, srcConnID...)
+	b = append(b, token...)
+	tag := retryIntegrityTag(version, b[start:], origDestConnID)
+	return append(b, tag[:]...), nil
+}
+
+// retryIntegrityTag calculates the tag over the Retry pseudo-packet, see RFC 9001 Section 5.8
+func retryIntegrityTag(version uint32, retry []byte, origDestConnID []byte) [16]byte {
+	pseudo := make([]byte, 0, 1+len(origDestConnID)+len(retry))
+	pseudo = append(pseudo, byte(len(origDestConnID)))
+	pseudo = append(pseudo, origDestConnID...)
+	pseudo = append(pseudo, retry...)
+	var tag [16]byte
+	if version == Version2 {
+		retryIntegrityAEADV2.Seal(tag[:0], retryIntegrityNonceV2[:], nil, pseudo)
+	} else {
+		retryIntegrityAEADV1.Seal(tag[:0], retryIntegrityNonceV1[:], nil, pseudo)
+	}
+	return tag
+}
+
+// retryService decides when to send Retries and issues and validates the tokens
+type retryService struct {
+	config          RetryConfig
+	tokenProtector  *RetryTokenProtector
+	rateWindowStart time.Time
+	rateWindowCount uint64
+	// underLoad is true when the Initial rate of the last window exceeded the threshold
+	underLoad bool
+}
+
+func newRetryService(master [32]byte, config RetryConfig) (*retryService, error) {
+	if config.TokenLifetime == 0 {
+		config.TokenLifetime = DefaultRetryTokenLifetime
+	}
+	tokenKey, err := DeriveRetryTokenKey(master)
+	if err != nil {
+		return nil, err
+	}
+	tokenProtector, err := NewRetryTokenProtector(tokenKey)
+	if err != nil {
+		return nil, err
+	}
+	return &retryService{
+		config:         config,
+		tokenProtector: tokenProtector,
+	}, nil
+}
+
+// countInitial must be called for every Initial packet
+func (s *retryService) countInitial(now time.Time) {
+	if now.Sub(s.rateWindowStart) >= time.Second {
+		s.underLoad = s.config.InitialRateThreshold != 0 && s.rateWindowCount > s.config.InitialRateThreshold
+		s.rateWindowStart = now
+		s.rateWindowCount = 0
+	}
+	s.rateWindowCount++
+}
+
+func (s *retryService) required() bool {
+	if s.config.Always {
+		return true
+	}
+	return s.underLoad || (s.config.InitialRateThreshold != 0 && s.rateWindowCount > s.config.InitialRateThreshold)
+}
+
+// retryPacket returns a Retry packet for the Initial with the header hdr
+func (s *retryService) retryPacket(hdr *longHeader, clientAddr netip.AddrPort, now time.Time) ([]byte, error) {
+	var retrySrcConnID [connIDLen]byte
+	if _, err := rand.Read(retrySrcConnID[:]); err != nil {
+		return nil, err
+	}
+	token, err := s.tokenProtector.NewToken(clientAddr, hdr.destConnID, retrySrcConnID[:], now)
+	if err != nil {
+		return nil, err
+	}
+	return appendRetryPacket(nil, hdr.version, hdr.srcConnID, retrySrcConnID[:], hdr.destConnID, token)
+}
+
+func (s *retryService) validate(hdr *longHeader, clientAddr netip.AddrPort, now time.Time) (*RetryToken, error) {
+	token, err := s.tokenProtector.DecodeToken(hdr.token, clientAddr, s.config.TokenLifetime, now)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(token.RetrySrcConnID.Bytes(), hdr.destConnID) {
+		return nil, ErrorInvalidRetryToken
+	}
+	return token, nil
+}
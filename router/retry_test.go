@@ -0,0 +1,117 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRetryIntegrityTag(t *testing.T) {
+	// RFC 9001 Appendix A.4
+	origDestConnID, err := hex.DecodeString("8394c8f03e515708")
+	require.NoError(t, err)
+	retry, err := hex.DecodeString("ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba")
+	require.NoError(t, err)
+	tag := retryIntegrityTag(Version1, retry[:len(retry)-16], origDestConnID)
+	assert.Equal(t, retry[len(retry)-16:], tag[:])
+	// RFC 9369 Appendix A.4
+	retry, err = hex.DecodeString("cf6b3343cf0008f067a5502a4262b5746f6b656ec8646ce8bfe33952d955543665dcc7b6")
+	require.NoError(t, err)
+	tag = retryIntegrityTag(Version2, retry[:len(retry)-16], origDestConnID)
+	assert.Equal(t, retry[len(retry)-16:], tag[:])
+	hdr, err := parseLongHeader(retry)
+	require.NoError(t, err)
+	assert.Equal(t, packetTypeRetry, hdr.packetType)
+}
+
+func TestRetryToken(t *testing.T) {
+	var tokenKey [32]byte
+	_, err := rand.Read(tokenKey[:])
+	require.NoError(t, err)
+	p, err := NewRetryTokenProtector(tokenKey)
+	require.NoError(t, err)
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:8292")
+	now := time.Now()
+	token, err := p.NewToken(clientAddr, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9, 10}, now)
+	require.NoError(t, err)
+	decoded, err := p.DecodeToken(token, clientAddr, time.Second, now)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, decoded.OriginalDestConnID.Bytes())
+	assert.Equal(t, []byte{9, 10}, decoded.RetrySrcConnID.Bytes())
+	_, err = p.DecodeToken(token, netip.MustParseAddrPort("127.0.0.1:8293"), time.Second, now)
+	assert.ErrorIs(t, err, ErrorInvalidRetryToken)
+	_, err = p.DecodeToken(token, clientAddr, time.Second, now.Add(2*time.Second))
+	assert.ErrorIs(t, err, ErrorExpiredRetryToken)
+}
+
+func TestRetryService(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	s, err := newRetryService(master, RetryConfig{Always: true})
+	require.NoError(t, err)
+	clientAddr := netip.MustParseAddrPort("127.0.0.1:8292")
+	initial := []byte{0xc0, 0, 0, 0, 1, 4, 1, 2, 3, 4, 2, 5, 6, 0}
+	hdr, err := parseLongHeader(initial)
+	require.NoError(t, err)
+	require.True(t, hdr.isInitial())
+	assert.Empty(t, hdr.token)
+	now := time.Now()
+	retry, err := s.retryPacket(&hdr, clientAddr, now)
+	require.NoError(t, err)
+	retryHdr, err := parseLongHeader(retry)
+	require.NoError(t, err)
+	assert.Equal(t, packetTypeRetry, retryHdr.packetType)
+	assert.Equal(t, []byte{5, 6}, retryHdr.destConnID)
+	token := retry[7+len(retryHdr.destConnID)+len(retryHdr.srcConnID) : len(retry)-16]
+
+	// the client repeats the Initial with the token and the new destination connection ID
+	secondInitial := []byte{0xc0, 0, 0, 0, 1, byte(len(retryHdr.srcConnID))}
+	secondInitial = append(secondInitial, retryHdr.srcConnID...)
+	secondInitial = append(secondInitial, 2, 5, 6, byte(len(token)))
+	secondInitial = append(secondInitial, token...)
+	secondHdr, err := parseLongHeader(secondInitial)
+	require.NoError(t, err)
+	decoded, err := s.validate(&secondHdr, clientAddr, now)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, decoded.OriginalDestConnID.Bytes())
+}
+
+func TestRetryIgnoresShortInitials(t *testing.T) {
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		DefaultServerAddr: netip.MustParseAddrPort("10.0.0.1:4433"),
+		Config:            &Config{Retry: &RetryConfig{Always: true}},
+	})
+	require.NoError(t, err)
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	decision, err := replay.Route(time.Now(), client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.Contains(t, decision, "answered with retry")
+	// spoofed small Initials must not be reflected
+	decision, err = replay.Route(time.Now(), client, routerAddr, initial[:100])
+	require.NoError(t, err)
+	assert.Contains(t, decision, "dropped: initial in too short datagram")
+}
+
+func TestLongInitialsAreDropped(t *testing.T) {
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		DefaultServerAddr: netip.MustParseAddrPort("10.0.0.1:4433"),
+		Config:            &Config{},
+	})
+	require.NoError(t, err)
+	// a full MTU Initial does not fit into a datagram with extension header
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	initial = append(initial, make([]byte, 1440-len(initial))...)
+	decision, err := replay.Route(time.Now(), netip.MustParseAddrPort("192.0.2.1:1234"), routerAddr, initial)
+	require.NoError(t, err)
+	assert.Contains(t, decision, "dropped: too long")
+}
@@ -3,11 +3,17 @@ package router
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	socketoob "github.com/birneee/go-socket-oob"
+	"log"
 	"net"
 	"net/netip"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -20,100 +26,452 @@ const (
 )
 
 // first two bits must be 0
+// the next two bits identify the cipher suite, see extHdrTypeWithCipherSuite.
+// Greased QUIC short header packets (RFC 9287) share this type space,
+// they are told apart by verifying the extension header and the connection ID.
 const (
 	ClientAddrExtHdrType byte = 0b00000001
+	// ValidatedClientAddrExtHdrType is a ClientAddrExtHdrType,
+	// whose client address was validated by the router's Retry service
+	ValidatedClientAddrExtHdrType byte = 0b00000010
 )
 
+const (
+	extHdrCipherSuiteShift      = 4
+	extHdrCipherSuiteMask  byte = 0b00110000
+)
+
+// extHdrTypeWithCipherSuite encodes the cipher suite into the extension header type
+func extHdrTypeWithCipherSuite(hdrType byte, suite CipherSuite) byte {
+	return hdrType | byte(suite)<<extHdrCipherSuiteShift
+}
+
+// splitExtHdrType returns the extension header type without cipher suite and the cipher suite
+func splitExtHdrType(b byte) (byte, CipherSuite) {
+	return b &^ extHdrCipherSuiteMask, CipherSuite((b & extHdrCipherSuiteMask) >> extHdrCipherSuiteShift)
+}
+
+// SplitExtHdrType returns the extension header type and the cipher suite of the first byte of a datagram
+// with extension header, e.g. to inspect captured datagrams
+func SplitExtHdrType(b byte) (byte, CipherSuite) {
+	return splitExtHdrType(b)
+}
+
 var (
 	ErrorZeroLengthUDP       = errors.New("zero length udp")
 	ErrorUnexpectedHeaderLen = errors.New("unexpected header length")
+	// ErrorPacketTooLong is returned if the packet does not fit into a datagram with extension header
+	ErrorPacketTooLong = errors.New("packet too long")
 )
 
 type Config struct {
+	// Name of the tenant, it labels the metrics.
+	// Several tenants can share a process, each with its own Router, listeners and secret.
+	Name string
+	// CipherSuite for connection IDs and extension headers, the default is AES-256-GCM.
+	// Extension headers of all cipher suites are accepted.
+	CipherSuite CipherSuite
+	// Retry enables the router's Retry service, nil disables it
+	Retry *RetryConfig
+	// SupportedVersions are the QUIC versions supported by the backends.
+	// The router answers long header packets of other versions with a Version Negotiation packet.
+	// If empty, packets of all versions are forwarded.
+	SupportedVersions []uint32
+	// Backends of the default pool in addition to the default server
+	Backends []netip.AddrPort
+	// Selection strategy of the default pool
+	Selection SelectionStrategy
+	// Mirror of the default pool, nil disables it
+	Mirror *MirrorConfig
+	// Pools in addition to the default pool, the names must not be empty
+	Pools map[string]PoolConfig
+	// Splits route a fraction of the new connections of a pool to a canary pool,
+	// after the routing rules selected the pool
+	Splits []SplitRule
+	// RoutingRules select the action for new connections, see RoutingRule.
+	// Connections that match no rule are routed to the default pool.
+	// Rules matching on the ClientHello make the router decrypt the client's Initial packets,
+	// if the ClientHello cannot be parsed, these rules do not match.
+	RoutingRules []RoutingRule
+	// HealthCheck enables active health checking of the backends, nil disables it
+	HealthCheck *HealthCheckConfig
+	// BackendWeights of the backends, a backend receives new connections proportional to its weight.
+	// The default weight is DefaultBackendWeight, weight 0 sends no new connections to the backend.
+	BackendWeights map[netip.AddrPort]uint32
+	// SlowStart is the time over which the weight of a backend ramps up
+	// after it becomes up or is added while the router is running.
+	// With slow start, the backends selected for handshakes are remembered, see handshakeAffinityTimeout.
+	// 0 disables slow start.
+	SlowStart time.Duration
+	// Logger receives the log messages of the router, nil logs to stdout
+	Logger *log.Logger
+	// StatelessResetRate limits the Stateless Resets per second the router sends
+	// for connections of backends that are down or removed.
+	// 0 disables Stateless Resets.
+	StatelessResetRate float64
+	// RateLimit limits the long header packets of sources and the Initials of all sources, nil disables it
+	RateLimit *RateLimitConfig
+	// AbuseDetection blocks source prefixes sending invalid packets, nil disables it
+	AbuseDetection *AbuseDetectionConfig
 }
 
 type Router struct {
-	conn                 *net.UDPConn
-	config               *Config
-	connIDProtector      *ConnIDProtector
-	defaultServerAddr    netip.AddrPort
-	clientIDExtHdrPacker NonQuicPrefixClientIDExtHdrPacker
-	gso                  bool
-	gro                  bool
-	writeBuf             [socketoob.MaxGSOBufSize]byte
-	ctx                  context.Context
-	cancelCtx            context.CancelFunc
-	stopOnce             sync.Once
-}
-
-func NewRouter(conn *net.UDPConn, secret [32]byte, defaultServerAddr netip.AddrPort, config *Config) (Router, error) {
-	r := Router{
-		conn:              conn,
+	listeners []*listener
+	config    *Config
+	// secret is the configured key, keys may be rotated
+	secret            [32]byte
+	keys              atomic.Pointer[keyRing]
+	defaultServerAddr netip.AddrPort
+	retry             *retryService
+	backends          *backendSet
+	// pools are not changed after NewRouter
+	pools map[string]*pool
+	// shadows receive mirrored traffic, their packets are discarded
+	shadows map[netip.AddrPort]struct{}
+	// routing is nil without routing rules
+	routing *routingRules
+	// routeAffinity and pendingClientHellos are only used with routing rules matching on the ClientHello
+	routeAffinity         *handshakeAffinity
+	pendingClientHellos   map[string]*pendingClientHello
+	statelessResetLimiter *tokenBucket
+	// rateLimiter is nil without Config.RateLimit
+	rateLimiter *rateLimiter
+	// abuseDetector is nil without Config.AbuseDetection
+	abuseDetector *abuseDetector
+	healthChecker *healthChecker
+	metrics       *metrics
+	// debugPrefixes are the client prefixes whose packets are logged, nil if there are none
+	debugPrefixes atomic.Pointer[[]netip.Prefix]
+	// capture is nil if no capture is running
+	capture atomic.Pointer[Capture]
+	// trace of the datagram the run loop handles, nil if neither debug logging nor a capture is enabled
+	trace *packetTrace
+	// replaying routers have no sockets, see Replay
+	replaying bool
+	// replayed is the capture time of the last replayed datagram
+	replayed  time.Time
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	stopOnce  sync.Once
+	closed    chan struct{}
+	// shuttingDown routers accept no new connections
+	shuttingDown atomic.Bool
+	// handingOver routers do not close their sockets when they stop
+	handingOver atomic.Bool
+	// loopMu serializes the run loops of the listeners,
+	// state that is only accessed by the run loop is guarded by it
+	loopMu sync.Mutex
+}
+
+// listener is a socket the router receives packets of clients and backends on.
+// Packets of a client are forwarded from the listener that received them,
+// so the backend's packets return to it and reach the client from the address the client sent to.
+type listener struct {
+	conn *net.UDPConn
+	// localAddr is the destination of the received packets
+	localAddr netip.AddrPort
+	gro       bool
+}
+
+func NewRouter(conn *net.UDPConn, secret [32]byte, defaultServerAddr netip.AddrPort, config *Config) (*Router, error) {
+	return NewRouterWithListeners([]*net.UDPConn{conn}, secret, defaultServerAddr, config)
+}
+
+// NewRouterWithListeners creates a router receiving packets on all conns, e.g. one per virtual IP address.
+// The conns must not be shared with other routers.
+func NewRouterWithListeners(conns []*net.UDPConn, secret [32]byte, defaultServerAddr netip.AddrPort, config *Config) (*Router, error) {
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("no listener")
+	}
+	listeners := make([]*listener, 0, len(conns))
+	for _, conn := range conns {
+		listeners = append(listeners, newListener(conn))
+	}
+	r, err := newRouter(listeners, secret, defaultServerAddr, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.start()
+	return r, nil
+}
+
+func newListener(conn *net.UDPConn) *listener {
+	l := &listener{conn: conn}
+	if localAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		l.localAddr = localAddr.AddrPort()
+	}
+	if socketoob.IsGROSupported(conn) {
+		socketoob.EnableGRO(conn)
+		l.gro = socketoob.IsGROEnabled(conn)
+	}
+	return l
+}
+
+// newRouter creates a router that is not started yet.
+// The backends of the previous router, if not nil, are taken over with their state and counters,
+// backends that are new start slow start.
+func newRouter(listeners []*listener, secret [32]byte, defaultServerAddr netip.AddrPort, config *Config, previous *Router) (*Router, error) {
+	r := &Router{
+		listeners:         listeners,
+		secret:            secret,
 		defaultServerAddr: defaultServerAddr,
 		config:            config,
+		closed:            make(chan struct{}),
 	}
 	r.ctx, r.cancelCtx = context.WithCancel(context.Background())
-	var err error
-	r.clientIDExtHdrPacker, err = NewNonQuicPrefixClientIDExtHdrPacker(secret)
+	keys, err := newRouterKeys(secret, config.CipherSuite)
 	if err != nil {
-		return Router{}, err
+		return nil, err
 	}
-	r.connIDProtector, err = NewConnIDProtector(secret)
+	r.keys.Store(&keyRing{current: keys})
+	if config.Retry != nil {
+		r.retry, err = newRetryService(secret, *config.Retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.backends = newBackendSet()
+	if defaultServerAddr.IsValid() {
+		if _, err := r.backends.add(defaultServerAddr); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range config.Backends {
+		if _, err := r.backends.add(addr); err != nil {
+			return nil, err
+		}
+	}
+	r.pools = map[string]*pool{}
+	r.pools[DefaultPool], err = newPool(DefaultPool, PoolConfig{Selection: config.Selection, Mirror: config.Mirror}, config.SlowStart)
 	if err != nil {
-		return Router{}, err
+		return nil, err
 	}
-	r.gso = socketoob.IsGSOSupported(conn)
-	if socketoob.IsGROSupported(conn) {
-		socketoob.EnableGRO(conn)
-		r.gro = socketoob.IsGROEnabled(conn)
+	for name, poolConfig := range config.Pools {
+		if name == DefaultPool {
+			return nil, fmt.Errorf("pool name must not be empty")
+		}
+		r.pools[name], err = newPool(name, poolConfig, config.SlowStart)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range poolConfig.Backends {
+			if _, err := r.backends.addToPool(addr, name); err != nil {
+				return nil, err
+			}
+		}
 	}
-	go func() {
-		err := r.run()
+	r.shadows = map[netip.AddrPort]struct{}{}
+	for _, p := range r.pools {
+		if p.mirror == nil {
+			continue
+		}
+		if r.backends.getByAddr(p.mirror.shadow) != nil {
+			return nil, fmt.Errorf("shadow %s is a backend", p.mirror.shadow)
+		}
+		r.shadows[p.mirror.shadow] = struct{}{}
+	}
+	if err := applySplitRules(config.Splits, r.pools); err != nil {
+		return nil, err
+	}
+	if len(config.RoutingRules) != 0 {
+		r.routing, err = newRoutingRules(config.RoutingRules, r.pools)
 		if err != nil {
-			r.Stop(err)
+			return nil, err
 		}
-	}()
+		if r.routing.needsClientHello {
+			r.routeAffinity = newHandshakeAffinity()
+			r.pendingClientHellos = map[string]*pendingClientHello{}
+		}
+		if r.retry == nil && slices.ContainsFunc(config.RoutingRules, func(rule RoutingRule) bool { return rule.Action == RouteRetry }) {
+			r.retry, err = newRetryService(secret, RetryConfig{})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.RateLimit != nil {
+		r.rateLimiter, err = newRateLimiter(*config.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		if r.retry == nil && config.RateLimit.Action == RateLimitRetry {
+			r.retry, err = newRetryService(secret, RetryConfig{})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if previous != nil {
+		now := time.Now()
+		for _, b := range r.backends.all() {
+			if r.backends.adopt(previous.backends, b) {
+				continue
+			}
+			b.startSlowStart(now, config.SlowStart)
+		}
+	}
+	for addr := range config.BackendWeights {
+		if r.backends.getByAddr(addr) == nil {
+			return nil, fmt.Errorf("weight of unknown backend %s", addr)
+		}
+	}
+	if config.StatelessResetRate != 0 {
+		r.statelessResetLimiter = newTokenBucket(config.StatelessResetRate, config.StatelessResetRate)
+	}
+	if config.AbuseDetection != nil {
+		r.abuseDetector, err = newAbuseDetector(*config.AbuseDetection)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.metrics = newMetrics(config.Name, r.listeners, r.backends, r.pools)
+	if r.rateLimiter != nil {
+		r.metrics.setRateLimiter(r.rateLimiter)
+	}
+	if r.abuseDetector != nil {
+		r.metrics.setAbuseDetector(r.abuseDetector)
+	}
 	return r, nil
 }
 
-func (r *Router) run() error {
+// start applies the configured weights and starts the health checker and the run loops.
+// The weights are not applied before, because backends are shared with the previous router.
+func (r *Router) start() {
+	r.applyWeights()
+	if r.config.HealthCheck != nil {
+		r.healthChecker = newHealthChecker(r, *r.config.HealthCheck)
+		go r.healthChecker.run(r.ctx)
+	}
+	var wg sync.WaitGroup
+	for _, l := range r.listeners {
+		// clear the deadline of a hand over
+		_ = l.conn.SetReadDeadline(time.Time{})
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			err := r.run(l)
+			if err != nil {
+				r.Stop(err)
+			}
+		}(l)
+	}
+	go func() {
+		wg.Wait()
+		close(r.closed)
+	}()
+}
+
+func (r *Router) applyWeights() {
+	for _, b := range r.backends.all() {
+		b.setWeight(DefaultBackendWeight)
+	}
+	for addr, weight := range r.config.BackendWeights {
+		r.backends.getByAddr(addr).setWeight(weight)
+	}
+}
+
+// handOver stops the router without closing the sockets,
+// so the router of a new configuration can take them over.
+// Packets that arrive meanwhile are queued by the sockets.
+func (r *Router) handOver() {
+	r.handingOver.Store(true)
+	r.Stop(nil)
+	<-r.closed
+}
+
+// takeOver continues the handshakes of the previous router, that is handed over already,
+// so handshakes in progress reach the same backend
+func (r *Router) takeOver(previous *Router) {
+	if r.routeAffinity != nil && previous.routeAffinity != nil {
+		r.routeAffinity = previous.routeAffinity
+	}
+	if r.pendingClientHellos != nil && previous.pendingClientHellos != nil {
+		for destConnID, pending := range previous.pendingClientHellos {
+			// buffered packets are forwarded from the listener that received them
+			if slices.ContainsFunc(pending.packets, func(p pendingPacket) bool { return !slices.Contains(r.listeners, p.listener) }) {
+				continue
+			}
+			r.pendingClientHellos[destConnID] = pending
+		}
+	}
+	for name, p := range r.pools {
+		old, ok := previous.pools[name]
+		if !ok {
+			continue
+		}
+		if p.affinity != nil && old.affinity != nil {
+			p.affinity = old.affinity
+		}
+		p.initials = old.initials
+		if p.mirror != nil && old.mirror != nil && p.mirror.shadow == old.mirror.shadow {
+			p.mirror.clients = old.mirror.clients
+		}
+	}
+	ring := previous.keys.Load()
+	if r.secret == previous.secret && r.config.CipherSuite == previous.config.CipherSuite {
+		// keys rotated at runtime remain in use
+		r.keys.Store(ring)
+	} else if ring.current.secret != r.secret {
+		// connections of the previous key continue, like after RotateKey
+		r.keys.Store(&keyRing{current: r.keys.Load().current, previous: ring.current})
+	}
+	if r.rateLimiter != nil && previous.rateLimiter != nil {
+		r.rateLimiter.adopt(previous.rateLimiter)
+	}
+	if r.abuseDetector != nil && previous.abuseDetector != nil {
+		r.abuseDetector.adopt(previous.abuseDetector)
+	}
+	r.debugPrefixes.Store(previous.debugPrefixes.Load())
+	r.capture.Store(previous.capture.Load())
+}
+
+func (r *Router) run(l *listener) error {
+	defer func() {
+		if !r.handingOver.Load() {
+			_ = l.conn.Close()
+		}
+	}()
 	var buf [socketoob.MaxGSOBufSize]byte
-loop:
 	for {
-		select {
-		case <-r.ctx.Done():
-			break loop
-		default: // continue
-		}
-		if r.gro {
-			segments, _, _, addr, err := socketoob.ReadGRO(r.conn, buf[:], nil)
+		if l.gro {
+			segments, _, _, addr, err := socketoob.ReadGRO(l.conn, buf[:], nil)
 			if err != nil {
-				return err
+				return r.readError(err)
 			}
-			err = r.handleUDPPackets(segments, addr)
+			r.loopMu.Lock()
+			err = r.handleUDPPackets(l, segments, addr)
+			r.loopMu.Unlock()
 			if err != nil {
 				return err
 			}
 		} else {
-			n, addr, err := r.conn.ReadFromUDPAddrPort(buf[:])
+			n, addr, err := l.conn.ReadFromUDPAddrPort(buf[:])
 			if err != nil {
-				return err
+				return r.readError(err)
 			}
-			err = r.handleUDPPacket(buf[:n], addr)
+			r.loopMu.Lock()
+			err = r.handleUDPPacket(l, buf[:n], addr)
+			r.loopMu.Unlock()
 			if err != nil {
 				return err
 			}
 		}
 	}
-	r.conn.Close()
-	return nil
 }
 
-func (r *Router) handleUDPPackets(segments socketoob.Segments, addr netip.AddrPort) error {
+// readError returns nil if the read was unblocked by Stop
+func (r *Router) readError(err error) error {
+	if r.ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (r *Router) handleUDPPackets(l *listener, segments socketoob.Segments, addr netip.AddrPort) error {
 	segmentsIter := segments.Iterator()
 	for segmentsIter.HasNext() {
 		segBuf := segmentsIter.Next()
-		err := r.handleUDPPacket(segBuf, addr)
+		err := r.handleUDPPacket(l, segBuf, addr)
 		if err != nil {
 			return err
 		}
@@ -121,77 +479,684 @@ func (r *Router) handleUDPPackets(segments socketoob.Segments, addr netip.AddrPo
 	return nil
 }
 
-func (r *Router) handleUDPPacket(readBuf []byte, addr netip.AddrPort) error {
+// handleUDPPacket traces the datagram, if debug logging or a capture is enabled
+func (r *Router) handleUDPPacket(l *listener, readBuf []byte, addr netip.AddrPort) error {
+	capture := r.capture.Load()
+	if capture == nil && r.debugPrefixes.Load() == nil {
+		return r.routeUDPPacket(l, readBuf, addr)
+	}
+	r.trace = &packetTrace{
+		received: time.Now(),
+		listener: l,
+		from:     addr,
+		datagram: readBuf,
+		client:   addr,
+		keepSent: capture != nil,
+	}
+	err := r.routeUDPPacket(l, readBuf, addr)
+	trace := r.trace
+	r.trace = nil
+	if r.debugging(trace.client) {
+		r.logf("debug: %s\n", trace)
+	}
+	if capture != nil {
+		capture.write(trace)
+	}
+	return err
+}
+
+func (r *Router) routeUDPPacket(l *listener, readBuf []byte, addr netip.AddrPort) error {
 	if len(readBuf) == 0 {
 		return ErrorZeroLengthUDP
 	}
-	if isQUICPacket(readBuf[0]) {
-		if isLongHeaderPacket(readBuf[0]) {
-			return r.handleLongHeaderPacket(readBuf, addr)
-		} else {
-			return r.handleShortHeaderPacket(readBuf, addr)
+	// blocked sources cost no crypto
+	if r.abuseDetector != nil && r.abuseDetector.numBlocked.Load() != 0 {
+		if prefix, ok := r.blockedPrefix(addr.Addr(), r.now()); ok && r.backends.getByAddr(addr) == nil {
+			r.trace.classify("datagram")
+			r.trace.drop("source " + prefix.String() + " is blocked")
+			r.abuseDetector.blockedPackets.Add(1)
+			return nil // drop
 		}
+	}
+	if len(r.shadows) != 0 {
+		if _, ok := r.shadows[addr]; ok {
+			r.trace.classify("shadow packet")
+			r.trace.setClient(netip.AddrPort{})
+			r.trace.drop("packets of shadow backends are not forwarded")
+			return nil // drop
+		}
+	}
+	if isLongHeaderPacket(readBuf[0]) {
+		// extension header types never have the form bit set,
+		// so this is a long header packet even if the fixed bit is greased
+		return r.handleLongHeaderPacket(l, readBuf, addr)
+	} else if isQUICPacket(readBuf[0]) {
+		return r.handleShortHeaderPacket(l, readBuf, addr)
 	} else {
-		return r.handleNonQUICPacket(readBuf, addr)
+		return r.handleNonQUICPacket(l, readBuf, addr)
+	}
+}
+
+func (r *Router) handleLongHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort) error {
+	if len(readBuf) > MaxQUICPacketLen {
+		r.trace.classify("long header")
+		r.trace.drop("too long")
+		return nil //drop
+	}
+	hdr, err := parseLongHeader(readBuf)
+	if err != nil {
+		r.trace.classify("long header")
+		r.trace.drop("invalid long header")
+		return nil // drop
+	}
+	r.trace.classify(hdr.packetType.String())
+	if len(r.config.SupportedVersions) != 0 && !isSupportedVersion(r.config.SupportedVersions, hdr.version) {
+		return r.handleUnsupportedVersion(l, &hdr, len(readBuf), addr)
+	}
+	// servers must discard Initials in too short datagrams, see RFC 9000 Section 14.1,
+	// so spoofed small datagrams are neither answered nor forwarded
+	if hdr.isInitial() && len(readBuf) < MinInitialDatagramLen {
+		r.trace.drop("initial in too short datagram")
+		return nil // drop
+	}
+	// rate limits apply before any crypto.
+	// Limited Initials with a token are only answered with a Retry if the token is invalid.
+	limited := r.rateLimiter != nil && r.rateLimiter.limited(addr.Addr(), hdr.isInitial(), r.now())
+	if limited && !(r.rateLimiter.config.Action == RateLimitRetry && hdr.isInitial() && len(hdr.token) != 0) {
+		return r.handleRateLimited(l, &hdr, len(readBuf), addr)
+	}
+	// established connections are not subject to the routing rules
+	if backend, keys := r.establishedServer(&hdr); backend != nil {
+		return r.forwardLongHeaderPacket(l, readBuf, addr, ClientAddrExtHdrType, backend, keys)
+	}
+	if r.shuttingDown.Load() {
+		r.trace.drop("no new connections while shutting down")
+		return nil // drop, no new connections
+	}
+	extHdrType := ClientAddrExtHdrType
+	if r.retry != nil && hdr.isInitial() {
+		extHdrType = r.validateRetryToken(&hdr, addr)
+	}
+	validated := extHdrType == ValidatedClientAddrExtHdrType
+	if limited && !validated {
+		return r.handleRateLimited(l, &hdr, len(readBuf), addr)
+	}
+	decision := routingDecision{action: RouteToPool, pool: DefaultPool}
+	if r.routing != nil {
+		decision = r.routing.evaluate(addr, l.localAddr, &hdr, validated, nil)
+	}
+	switch {
+	case decision.action == RouteDrop:
+		r.trace.drop("routing rule")
+		return nil
+	case decision.action == RouteRetry, r.retry != nil && hdr.isInitial() && !validated && r.retry.required():
+		return r.sendRetry(l, &hdr, len(readBuf), addr)
+	case decision.needsClientHello:
+		return r.routeByClientHello(l, readBuf, addr, &hdr, extHdrType)
+	default:
+		return r.routeToPool(l, readBuf, addr, &hdr, extHdrType, nil, decision.pool, r.now())
 	}
 }
 
-func (r *Router) handleLongHeaderPacket(readBuf []byte, addr netip.AddrPort) error {
-	quicPacketWithExtHdr := r.clientIDExtHdrPacker.AddHdr(readBuf, addr)
-	_, err := r.conn.WriteToUDPAddrPort(quicPacketWithExtHdr, r.defaultServerAddr)
+// forwardLongHeaderPacket seals the extension header with the keys the connection ID of the backend is protected with
+func (r *Router) forwardLongHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort, extHdrType byte, backend *Backend, keys *routerKeys) error {
+	packer, err := keys.clientIDExtHdrPackers.get(backend.serverID)
 	if err != nil {
 		return err
 	}
+	quicPacketWithExtHdr, err := packer.AddHdrOfType(extHdrType, readBuf, addr)
+	if err != nil {
+		return err
+	}
+	r.trace.forwarded(backend)
+	err = r.writeTo(l, quicPacketWithExtHdr, backend.addr)
+	if err != nil {
+		return err
+	}
+	backend.countForwarded(len(quicPacketWithExtHdr), r.now())
+	if len(r.shadows) != 0 {
+		return r.mirrorPacket(l, readBuf, addr, extHdrType, backend)
+	}
 	return nil
 }
 
-func (r *Router) handleShortHeaderPacket(readBuf []byte, addr netip.AddrPort) error {
+// establishedServer returns the reachable backend whose connection ID is the destination connection ID,
+// or nil if the packet does not belong to an established connection.
+func (r *Router) establishedServer(hdr *longHeader) (*Backend, *routerKeys) {
+	if len(hdr.destConnID) != connIDLen {
+		return nil, nil
+	}
+	return r.lookupConnID(r.keys.Load(), hdr.destConnID)
+}
+
+// lookupConnID returns the reachable backend of the connection ID and the keys that verify it.
+// Returns nil if neither the current nor the previous key verifies a connection ID of a reachable backend.
+func (r *Router) lookupConnID(ring *keyRing, connID []byte) (*Backend, *routerKeys) {
+	for _, keys := range ring.all() {
+		backend := r.backends.get(keys.connIDProtector.UnverifiedServerID(connID))
+		if backend == nil || !backend.reachable(r.now()) {
+			continue
+		}
+		if _, _, err := keys.connIDProtector.Decode(connID); err != nil {
+			continue
+		}
+		return backend, keys
+	}
+	return nil, nil
+}
+
+// handleUnsupportedVersion answers with a Version Negotiation packet
+func (r *Router) handleUnsupportedVersion(l *listener, hdr *longHeader, datagramLen int, addr netip.AddrPort) error {
+	if hdr.version == versionNegotiation || datagramLen < MinInitialDatagramLen {
+		r.trace.drop(fmt.Sprintf("unsupported version %#x", hdr.version))
+		return nil // drop
+	}
+	versionNegotiationPacket := appendVersionNegotiationPacket(nil, hdr.destConnID, hdr.srcConnID, r.config.SupportedVersions)
+	r.trace.decide(fmt.Sprintf("unsupported version %#x, answered with version negotiation", hdr.version))
+	return r.writeTo(l, versionNegotiationPacket, addr)
+}
+
+// validateRetryToken returns ValidatedClientAddrExtHdrType if the Initial carries a valid token of the Retry service
+func (r *Router) validateRetryToken(hdr *longHeader, addr netip.AddrPort) byte {
+	now := r.now()
+	r.retry.countInitial(now)
+	if len(hdr.token) != 0 {
+		if _, err := r.retry.validate(hdr, addr, now); err == nil {
+			return ValidatedClientAddrExtHdrType
+		}
+		// the token might be issued by the backend in a NEW_TOKEN frame,
+		// proceed as if there was no token
+	}
+	return ClientAddrExtHdrType
+}
+
+// sendRetry answers an Initial with a Retry, other packets and Initials in too short datagrams are dropped
+func (r *Router) sendRetry(l *listener, hdr *longHeader, datagramLen int, addr netip.AddrPort) error {
+	if !hdr.isInitial() {
+		r.trace.drop("retry required")
+		return nil
+	}
+	if datagramLen < MinInitialDatagramLen {
+		r.trace.drop("initial in too short datagram")
+		return nil
+	}
+	retry, err := r.retry.retryPacket(hdr, addr, r.now())
+	if err != nil {
+		return err
+	}
+	r.trace.decide("answered with retry")
+	return r.writeTo(l, retry, addr)
+}
+
+func (r *Router) handleShortHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort) error {
+	r.trace.classify("short header")
 	if len(readBuf) > MaxQUICPacketLen {
+		r.trace.drop("too long")
 		return nil //drop
 	}
-	serverAddr, err := r.connIDProtector.DecodeServerIDFromProtectedQUICShortHeaderPacketAsAddr(readBuf)
+	return r.routeShortHeaderPacket(l, readBuf, addr, invalidConnID)
+}
+
+// handleGreasedShortHeaderPacket handles packets without fixed bit, that are no extension header packets.
+// These are short header packets of clients using grease_quic_bit (RFC 9287),
+// and are only forwarded if the connection ID verifies.
+// Invalid packets are counted as kind by the abuse detection.
+func (r *Router) handleGreasedShortHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort, kind invalidPacketKind) error {
+	r.trace.classify("greased short header")
+	r.trace.setClient(addr)
+	if len(readBuf) > MaxQUICPacketLen {
+		r.trace.drop("too long")
+		return nil //drop
+	}
+	return r.routeShortHeaderPacket(l, readBuf, addr, kind)
+}
+
+// routeShortHeaderPacket drops packets whose connection ID does not verify, they are counted as kind by the abuse detection.
+// Packets with an unknown server ID are counted too, e.g. of random connection IDs.
+// Packets for unreachable backends are only counted if their connection ID does not verify,
+// or if they had an invalid extension header, because opening it already cost crypto.
+// Packets with the server ID of a known backend are also counted by the backend's pool.
+func (r *Router) routeShortHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort, kind invalidPacketKind) error {
+	if len(readBuf) < 1+connIDLen {
+		r.trace.drop("too short")
+		return nil // drop
+	}
+	// destination connection id starts after 1 byte
+	// and is always connIDLen bytes long
+	connID := readBuf[1 : 1+connIDLen]
+	ring := r.keys.Load()
+	if backend, keys := r.lookupConnID(ring, connID); backend != nil {
+		return r.forwardShortHeaderPacket(l, readBuf, addr, backend, keys)
+	}
+	serverID := ring.current.connIDProtector.UnverifiedServerID(connID)
+	backend := r.backends.get(serverID)
+	if backend == nil || !backend.reachable(r.now()) {
+		if backend == nil || kind == invalidExtHdr {
+			r.countInvalid(addr, kind)
+		}
+		if backend != nil && backend.drainExpired(r.now()) {
+			r.pools[backend.pool].drainDeadlineDrops.Add(1)
+		}
+		return r.sendStatelessReset(l, readBuf, addr, serverID, backend)
+	}
+	r.trace.drop("invalid connection id")
+	r.countInvalid(addr, kind)
+	r.pools[backend.pool].invalidConnIDs.Add(1)
+	return nil // drop
+}
+
+// forwardShortHeaderPacket seals the extension header with the keys the connection ID of the backend is protected with
+func (r *Router) forwardShortHeaderPacket(l *listener, readBuf []byte, addr netip.AddrPort, backend *Backend, keys *routerKeys) error {
+	packer, err := keys.clientIDExtHdrPackers.get(backend.serverID)
 	if err != nil {
 		return err
 	}
-	quicPacketWithExtHdr := r.clientIDExtHdrPacker.AddHdr(readBuf, addr)
-	_, err = r.conn.WriteToUDPAddrPort(quicPacketWithExtHdr, serverAddr)
+	quicPacketWithExtHdr, err := packer.AddHdr(readBuf, addr)
 	if err != nil {
 		return err
 	}
+	r.trace.forwarded(backend)
+	err = r.writeTo(l, quicPacketWithExtHdr, backend.addr)
+	if err != nil {
+		return err
+	}
+	backend.countForwarded(len(quicPacketWithExtHdr), r.now())
+	if len(r.shadows) != 0 {
+		return r.mirrorPacket(l, readBuf, addr, ClientAddrExtHdrType, backend)
+	}
 	return nil
 }
 
-func (r *Router) handleNonQUICPacket(buf []byte, addr netip.AddrPort) error {
-	headerType := buf[0]
+// sendStatelessReset on behalf of a backend that is down or removed, if enabled and not rate limited.
+// backend is nil if the server ID is unknown.
+// Connection IDs of a known backend that do not verify are counted by the abuse detection and the backend's pool.
+func (r *Router) sendStatelessReset(l *listener, readBuf []byte, addr netip.AddrPort, serverID [connIDServerIDLen]byte, backend *Backend) error {
+	if r.statelessResetLimiter == nil || !r.statelessResetLimiter.allow(r.now()) {
+		r.trace.drop("unknown or unreachable backend, stateless reset disabled or rate limited")
+		return nil // drop
+	}
+	// only verify after rate limiting, because unknown server IDs require key derivation
+	connID := readBuf[1 : 1+connIDLen]
+	keys := r.keys.Load().current
+	if _, _, err := keys.connIDProtector.Decode(connID); err != nil {
+		r.trace.drop("invalid connection id")
+		if backend != nil {
+			// unknown server IDs are already counted
+			r.countInvalid(addr, invalidConnID)
+			r.pools[backend.pool].invalidConnIDs.Add(1)
+		}
+		return nil // drop
+	}
+	r.trace.setServerID(serverID)
+	key, err := keys.statelessResetKeys.get(serverID)
+	if err != nil {
+		return err
+	}
+	token := statelessResetToken(key, connID)
+	statelessReset, ok := appendStatelessReset(nil, token, len(readBuf))
+	if !ok {
+		r.trace.drop("unknown or unreachable backend, too short for a stateless reset")
+		return nil // drop
+	}
+	r.trace.decide("unknown or unreachable backend, answered with stateless reset")
+	if backend != nil {
+		r.pools[backend.pool].statelessResets.Add(1)
+	}
+	return r.writeTo(l, statelessReset, addr)
+}
+
+func (r *Router) handleNonQUICPacket(l *listener, buf []byte, addr netip.AddrPort) error {
+	headerType, _ := splitExtHdrType(buf[0])
 	switch headerType {
-	case ClientAddrExtHdrType:
-		serverAddr := addr
-		//fmt.Printf("remove hdr from %d byte udp payload\n", len(buf))
-		clientAddr, protectedQuicPacket, err := r.clientIDExtHdrPacker.RemoveHdr(buf, serverAddr.Addr().Is4())
-		if err != nil {
-			return fmt.Errorf("failed to remove header from %d byte udp datagram: %s: %v", len(buf), err, buf)
+	case ClientAddrExtHdrType, ValidatedClientAddrExtHdrType:
+		r.trace.classify("backend packet")
+		// only the keys of known backends are derived,
+		// so packets of other sources cost no crypto and do not fill the key caches
+		backend := r.backends.getByAddr(addr)
+		if backend == nil {
+			return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidConnID)
 		}
-		_, err = r.conn.WriteToUDPAddrPort(protectedQuicPacket, clientAddr)
-		if err != nil {
+		// the extension header must be sealed with the key of the sending server,
+		// which is derived from the current or previous secret of this router's tenant
+		var clientAddr netip.AddrPort
+		var protectedQuicPacket []byte
+		removed := false
+		for _, keys := range r.keys.Load().all() {
+			packer, err := keys.clientIDExtHdrPackers.get(backend.serverID)
+			if err != nil {
+				return err
+			}
+			clientAddr, protectedQuicPacket, err = packer.RemoveHdr(buf, addr.Addr().Is4())
+			if err == nil {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			// the first byte of greased short header packets can collide with the extension header types
+			return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidExtHdr)
+		}
+		r.trace.setClient(clientAddr)
+		r.trace.setServerID(backend.serverID)
+		r.trace.decide("forwarded to client")
+		if err := r.writeTo(l, protectedQuicPacket, clientAddr); err != nil {
 			return err
 		}
+	case HealthCheckPongExtHdrType:
+		if r.healthChecker == nil || len(buf) != healthCheckLen {
+			return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidConnID)
+		}
+		r.trace.classify("health check pong")
+		r.trace.setClient(netip.AddrPort{})
+		r.trace.decide("health check")
+		r.healthChecker.handlePong(buf, addr)
+	case ControlExtHdrType:
+		return r.handleControlMessage(l, buf, addr)
 	default:
-		// drop
+		return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidConnID)
+	}
+	return nil
+}
+
+// handleControlMessage applies authenticated control messages of backends
+func (r *Router) handleControlMessage(l *listener, buf []byte, addr netip.AddrPort) error {
+	backend := r.backends.getByAddr(addr)
+	if backend == nil {
+		return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidConnID)
+	}
+	var msg controlMessage
+	parsed := false
+	for _, keys := range r.keys.Load().all() {
+		key, err := keys.controlMessageKeys.get(backend.serverID)
+		if err != nil {
+			return err
+		}
+		msg, err = parseControlMessage(buf, key)
+		if err == nil {
+			parsed = true
+			break
+		}
+	}
+	if !parsed {
+		return r.handleGreasedShortHeaderPacket(l, buf, addr, invalidExtHdr)
+	}
+	r.trace.classify("control message")
+	r.trace.setClient(netip.AddrPort{})
+	r.trace.setServerID(backend.serverID)
+	if msg.seq <= backend.lastControlSeq {
+		r.trace.drop("replayed control message")
+		return nil // drop replayed message
+	}
+	backend.lastControlSeq = msg.seq
+	r.trace.decide("applied " + msg.msgType.String())
+	switch msg.msgType {
+	case ControlMessageDraining:
+		if backend.startDraining() {
+			r.logf("backend %s is draining\n", backend.addr)
+		}
+	case ControlMessageReady:
+		// the health checker decides if the backend is up
+		if r.healthChecker == nil {
+			r.setBackendState(backend, BackendUp)
+		}
+		if backend.ready() {
+			r.logf("backend %s is ready\n", backend.addr)
+		} else if backend.DrainedByOperator() {
+			r.logf("backend %s is ready, but remains drained by the operator\n", backend.addr)
+		}
+	case ControlMessageLoadReport:
+		load := msg.load
+		backend.load.Store(&load)
 	}
 	return nil
 }
 
+// defaultLogger is used without Config.Logger
+var defaultLogger = log.New(os.Stdout, "", 0)
+
+// logf logs a message to Config.Logger
+func (r *Router) logf(format string, v ...any) {
+	if r.config.Logger != nil {
+		r.config.Logger.Printf(format, v...)
+		return
+	}
+	defaultLogger.Printf(format, v...)
+}
+
+// debugging says if the packets of the client are logged
+func (r *Router) debugging(client netip.AddrPort) bool {
+	prefixes := r.debugPrefixes.Load()
+	if prefixes == nil {
+		return false
+	}
+	addr := client.Addr().Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmapPrefix unmaps prefixes of mapped IPv4 addresses, because clients are matched by their unmapped address
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked()
+}
+
+// SetDebugLogging enables or disables logging the routing of packets of clients in the prefix
+func (r *Router) SetDebugLogging(prefix netip.Prefix, enabled bool) {
+	prefix = unmapPrefix(prefix)
+	for {
+		old := r.debugPrefixes.Load()
+		var prefixes []netip.Prefix
+		if old != nil {
+			prefixes = slices.DeleteFunc(slices.Clone(*old), func(p netip.Prefix) bool { return p == prefix })
+		}
+		if enabled {
+			prefixes = append(prefixes, prefix)
+		}
+		var updated *[]netip.Prefix
+		if len(prefixes) != 0 {
+			updated = &prefixes
+		}
+		if r.debugPrefixes.CompareAndSwap(old, updated) {
+			break
+		}
+	}
+	if enabled {
+		r.logf("debug logging enabled for %s\n", prefix)
+	} else {
+		r.logf("debug logging disabled for %s\n", prefix)
+	}
+}
+
+// DebugPrefixes returns the client prefixes whose packets are logged
+func (r *Router) DebugPrefixes() []netip.Prefix {
+	prefixes := r.debugPrefixes.Load()
+	if prefixes == nil {
+		return nil
+	}
+	return slices.Clone(*prefixes)
+}
+
+// AddBackend adds a backend in state up to the default pool, see AddBackendToPool
+func (r *Router) AddBackend(addr netip.AddrPort) error {
+	return r.AddBackendToPool(addr, DefaultPool)
+}
+
+// AddBackendToPool adds a backend in state up to the pool, its weight ramps up by Config.SlowStart.
+// Adding a known backend to its pool again has no effect,
+// a known backend of another pool must be removed first.
+func (r *Router) AddBackendToPool(addr netip.AddrPort, pool string) error {
+	if _, ok := r.pools[pool]; !ok {
+		return fmt.Errorf("unknown pool %q", pool)
+	}
+	known := r.backends.getByAddr(addr) != nil
+	b, err := r.backends.addToPool(addr, pool)
+	if err != nil {
+		return err
+	}
+	if !known {
+		b.startSlowStart(r.now(), r.config.SlowStart)
+	}
+	return nil
+}
+
+// RemoveBackend returns false if the backend is unknown.
+// Clients of removed backends receive Stateless Resets, if enabled.
+func (r *Router) RemoveBackend(addr netip.AddrPort) bool {
+	return r.backends.remove(addr)
+}
+
+func (r *Router) SetBackendState(addr netip.AddrPort, state BackendState) error {
+	b := r.backends.getByAddr(addr)
+	if b == nil {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	r.setBackendState(b, state)
+	return nil
+}
+
+// setBackendState starts slow start if the backend becomes up
+func (r *Router) setBackendState(b *Backend, state BackendState) {
+	if b.setState(state) == BackendDown && state == BackendUp {
+		b.startSlowStart(r.now(), r.config.SlowStart)
+	}
+}
+
+// SetSplitFraction changes the fraction of new connections of the pool that are routed to its canary pool.
+// The pool must be split by Config.Splits.
+func (r *Router) SetSplitFraction(pool string, fraction float64) error {
+	p, ok := r.pools[pool]
+	if !ok {
+		return fmt.Errorf("unknown pool %q", pool)
+	}
+	if p.split == nil {
+		return fmt.Errorf("pool %q is not split", pool)
+	}
+	if err := p.split.setFraction(fraction); err != nil {
+		return err
+	}
+	r.logf("routing %g of new connections of pool %q to pool %q\n", fraction, pool, p.split.canary)
+	return nil
+}
+
+// SetBackendWeight sets the weight for new connections, weight 0 sends no new connections to the backend
+func (r *Router) SetBackendWeight(addr netip.AddrPort, weight uint32) error {
+	b := r.backends.getByAddr(addr)
+	if b == nil {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	b.setWeight(weight)
+	return nil
+}
+
+// DrainBackend stops new connections to the backend.
+// Packets of established connections are forwarded until the deadline,
+// the zero deadline means forever.
+func (r *Router) DrainBackend(addr netip.AddrPort, deadline time.Time) error {
+	b := r.backends.getByAddr(addr)
+	if b == nil {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	b.drain(deadline)
+	if deadline.IsZero() {
+		r.logf("backend %s is draining\n", addr)
+	} else {
+		r.logf("backend %s is draining until %s\n", addr, deadline.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// UndrainBackend ends the drain of DrainBackend.
+// The backend receives new connections again, unless it announced that it is draining.
+func (r *Router) UndrainBackend(addr netip.AddrPort) error {
+	b := r.backends.getByAddr(addr)
+	if b == nil {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	if b.undrain() {
+		if b.Draining() {
+			r.logf("backend %s is no longer drained by the operator, but announced that it is draining\n", addr)
+		} else {
+			r.logf("backend %s is no longer draining\n", addr)
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the router's tenant, see Config.Name
+func (r *Router) Name() string {
+	return r.config.Name
+}
+
+// ListenAddrs returns the local addresses of the listeners
+func (r *Router) ListenAddrs() []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(r.listeners))
+	for _, l := range r.listeners {
+		addrs = append(addrs, l.localAddr)
+	}
+	return addrs
+}
+
+func (r *Router) Backends() []*Backend {
+	return slices.Clone(r.backends.all())
+}
+
+// Metrics returns the metrics of the router, they can be published using expvar.Publish
+func (r *Router) Metrics() *expvar.Map {
+	return r.metrics.root
+}
+
 func (r *Router) Context() context.Context {
 	return r.ctx
 }
 
+// Stop stops the router immediately, established connections are interrupted.
+// It does not wait until the router is closed, see Closed.
 func (r *Router) Stop(err error) {
 	r.stopOnce.Do(func() {
-		if err != nil {
-			fmt.Printf("router stopped with error: %s\n", err)
-		} else {
-			fmt.Printf("stopped\n")
+		switch {
+		case r.handingOver.Load():
+			// the router of a new configuration continues
+		case err != nil:
+			r.logf("router stopped with error: %s\n", err)
+		default:
+			r.logf("stopped\n")
 		}
 		r.cancelCtx()
+		// unblock the reads of the run loops
+		for _, l := range r.listeners {
+			_ = l.conn.SetReadDeadline(time.Now())
+		}
 	})
 }
+
+// Closed is closed when the router stopped forwarding packets and closed the sockets
+func (r *Router) Closed() <-chan struct{} {
+	return r.closed
+}
+
+// Shutdown stops accepting new connections,
+// but forwards packets of established connections until ctx is done.
+// Then the router is stopped.
+// Returns when the router is closed.
+func (r *Router) Shutdown(ctx context.Context) {
+	if !r.shuttingDown.Swap(true) {
+		if deadline, ok := ctx.Deadline(); ok {
+			r.logf("shutting down, forwarding established connections until %s\n", deadline.Format(time.RFC3339))
+		} else {
+			r.logf("shutting down, forwarding established connections\n")
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-r.ctx.Done():
+	}
+	r.Stop(nil)
+	<-r.closed
+	r.logf("shutdown complete\n")
+}
@@ -0,0 +1,201 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func startTestRouter(t *testing.T, backendAddr netip.AddrPort) (*Router, [32]byte) {
+	return startTestRouterWithConfig(t, backendAddr, &Config{})
+}
+
+func startTestRouterWithConfig(t *testing.T, backendAddr netip.AddrPort, config *Config) (*Router, [32]byte) {
+	var secret [32]byte
+	_, err := rand.Read(secret[:])
+	require.NoError(t, err)
+	r, err := NewRouter(listenLoopback(t), secret, backendAddr, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Stop(nil) })
+	return r, secret
+}
+
+func TestStopUnblocksRead(t *testing.T) {
+	backend := listenLoopback(t)
+	r, _ := startTestRouter(t, backend.LocalAddr().(*net.UDPAddr).AddrPort())
+	r.Stop(nil)
+	select {
+	case <-r.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("router not closed")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	r, secret := startTestRouter(t, backendAddr)
+	client := listenLoopback(t)
+	routerAddr := r.listeners[0].conn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Shutdown(ctx)
+		close(done)
+	}()
+	require.Eventually(t, r.shuttingDown.Load, time.Second, time.Millisecond)
+
+	// new connections are dropped
+	initial := make([]byte, MinInitialDatagramLen)
+	initial[0] = 0xc0
+	binary.BigEndian.PutUint32(initial[1:], Version1)
+	initial[5] = 8
+	_, err := client.WriteToUDP(initial, routerAddr)
+	require.NoError(t, err)
+
+	// established connections are forwarded
+	protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	generator, err := NewConnIDGeneratorFromAddr(protector, backendAddr, rand.Reader)
+	require.NoError(t, err)
+	connID, err := generator.GenerateConnectionID()
+	require.NoError(t, err)
+	shortHdr := append([]byte{0x40}, connID.Bytes()...)
+	shortHdr = append(shortHdr, make([]byte, 20)...)
+	_, err = client.WriteToUDP(shortHdr, routerAddr)
+	require.NoError(t, err)
+
+	buf := make([]byte, MTU)
+	require.NoError(t, backend.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := backend.ReadFromUDPAddrPort(buf)
+	require.NoError(t, err)
+	// the Initial was not forwarded
+	assert.Equal(t, shortHdr, buf[n-len(shortHdr):n])
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+}
+
+func TestRouteByClientHello(t *testing.T) {
+	defaultBackend := listenLoopback(t)
+	webBackend := listenLoopback(t)
+	r, _ := startTestRouterWithConfig(t, defaultBackend.LocalAddr().(*net.UDPAddr).AddrPort(), &Config{
+		Pools: map[string]PoolConfig{
+			"web": {Backends: []netip.AddrPort{webBackend.LocalAddr().(*net.UDPAddr).AddrPort()}},
+		},
+		RoutingRules: []RoutingRule{{ServerName: "*.example.com", ALPN: "h3", Pool: "web"}},
+	})
+	client := listenLoopback(t)
+	datagrams := captureClientInitials(t, quic.Version1, "www.example.com", []string{"h3"})
+	for _, datagram := range datagrams {
+		_, err := client.WriteToUDP(datagram, r.listeners[0].conn.LocalAddr().(*net.UDPAddr))
+		require.NoError(t, err)
+	}
+	buf := make([]byte, MTU)
+	for _, datagram := range datagrams {
+		require.NoError(t, webBackend.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := webBackend.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, datagram, buf[n-len(datagram):n])
+	}
+	require.NoError(t, defaultBackend.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := defaultBackend.Read(buf)
+	assert.Error(t, err)
+}
+
+func TestRouteByClientHelloSpanningPackets(t *testing.T) {
+	defaultBackend := listenLoopback(t)
+	webBackend := listenLoopback(t)
+	r, _ := startTestRouterWithConfig(t, defaultBackend.LocalAddr().(*net.UDPAddr).AddrPort(), &Config{
+		Pools: map[string]PoolConfig{
+			"web": {Backends: []netip.AddrPort{webBackend.LocalAddr().(*net.UDPAddr).AddrPort()}},
+		},
+		RoutingRules: []RoutingRule{{ServerName: "example.com", Pool: "web"}},
+	})
+	msg := buildClientHello("example.com", "h3", 2000)
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	first := sealClientInitial(t, Version1, destConnID, 0, appendCryptoFrame(nil, 0, msg[:1000]))
+	second := sealClientInitial(t, Version1, destConnID, 1, appendCryptoFrame(nil, 1000, msg[1000:]))
+	// a retransmission after the ClientHello is complete
+	retransmission := sealClientInitial(t, Version1, destConnID, 2, appendCryptoFrame(nil, 1000, msg[1000:]))
+	client := listenLoopback(t)
+	// the second packet is buffered until the ClientHello is complete
+	for _, datagram := range [][]byte{second, first, retransmission} {
+		_, err := client.WriteToUDP(datagram, r.listeners[0].conn.LocalAddr().(*net.UDPAddr))
+		require.NoError(t, err)
+	}
+	buf := make([]byte, MTU)
+	for _, datagram := range [][]byte{second, first, retransmission} {
+		require.NoError(t, webBackend.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := webBackend.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, datagram, buf[n-len(datagram):n])
+	}
+}
+
+func TestMirror(t *testing.T) {
+	backend := listenLoopback(t)
+	backendAddr := backend.LocalAddr().(*net.UDPAddr).AddrPort()
+	shadow := listenLoopback(t)
+	r, secret := startTestRouterWithConfig(t, backendAddr, &Config{
+		Mirror: &MirrorConfig{Shadow: shadow.LocalAddr().(*net.UDPAddr).AddrPort(), Fraction: 1},
+	})
+	routerAddr := r.listeners[0].conn.LocalAddr().(*net.UDPAddr)
+	client := listenLoopback(t)
+	initial := sealClientInitial(t, Version1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0, appendCryptoFrame(nil, 0, buildClientHello("example.com", "h3", 0)))
+	_, err := client.WriteToUDP(initial, routerAddr)
+	require.NoError(t, err)
+	// packets with connection IDs of the backend are mirrored as well
+	protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	generator, err := NewConnIDGeneratorFromAddr(protector, backendAddr, rand.Reader)
+	require.NoError(t, err)
+	connID, err := generator.GenerateConnectionID()
+	require.NoError(t, err)
+	shortHdr := append([]byte{0x40}, connID.Bytes()...)
+	shortHdr = append(shortHdr, make([]byte, 20)...)
+	_, err = client.WriteToUDP(shortHdr, routerAddr)
+	require.NoError(t, err)
+
+	buf := make([]byte, MTU)
+	for _, conn := range []*net.UDPConn{backend, shadow} {
+		for _, datagram := range [][]byte{initial, shortHdr} {
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, datagram, buf[n-len(datagram):n])
+		}
+	}
+
+	// packets of the shadow are discarded
+	serverKey, err := DeriveServerKeyFromAddr(secret, shadow.LocalAddr().(*net.UDPAddr).AddrPort(), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	packer, err := NewNonQuicPrefixClientIDExtHdrPacker(serverKey.Secret, serverKey.CipherSuite)
+	require.NoError(t, err)
+	datagram, err := packer.AddHdr(shortHdr, client.LocalAddr().(*net.UDPAddr).AddrPort())
+	require.NoError(t, err)
+	_, err = shadow.WriteToUDP(datagram, routerAddr)
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = client.Read(buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,377 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RoutingAction is applied to new connections matching a RoutingRule
+type RoutingAction uint8
+
+const (
+	// RouteToPool routes the connection to RoutingRule.Pool
+	RouteToPool RoutingAction = iota
+	// RouteDrop drops the packets of the connection
+	RouteDrop
+	// RouteRetry answers Initial packets without valid Retry token with a Retry.
+	// Packets with a valid token skip the rule, so the next matching rule applies.
+	RouteRetry
+)
+
+func (a RoutingAction) String() string {
+	switch a {
+	case RouteToPool:
+		return "pool"
+	case RouteDrop:
+		return "drop"
+	case RouteRetry:
+		return "retry"
+	default:
+		return fmt.Sprintf("unknown routing action %d", uint8(a))
+	}
+}
+
+func ParseRoutingAction(s string) (RoutingAction, error) {
+	switch s {
+	case "pool":
+		return RouteToPool, nil
+	case "drop":
+		return RouteDrop, nil
+	case "retry":
+		return RouteRetry, nil
+	default:
+		return 0, fmt.Errorf("unknown routing action %q", s)
+	}
+}
+
+// RoutingRule matches new connections, all set fields must match.
+// Rules are evaluated by longest prefix match of the source address:
+// the rules of the longest matching source prefix are evaluated first, in configuration order,
+// then the rules of the next shorter prefix, and finally the rules without source prefix.
+type RoutingRule struct {
+	// SourcePrefixes match the client address.
+	// Empty matches any address.
+	SourcePrefixes []netip.Prefix
+	// Destination matches the address the router receives the packet on, i.e. the VIP.
+	// An unspecified address or port 0 match any.
+	Destination netip.AddrPort
+	// Versions match the QUIC version of the long header.
+	// Empty matches any version.
+	Versions []uint32
+	// ServerName matches the TLS server name indication exactly, case-insensitive.
+	// A leading "*." matches any subdomain.
+	// Empty matches any server name.
+	ServerName string
+	// ALPN matches if the client offers the protocol.
+	// Empty matches any protocol.
+	ALPN string
+	// Action applied to matching connections
+	Action RoutingAction
+	// Pool the connection is routed to by RouteToPool
+	Pool string
+}
+
+// needsClientHello says if the rule matches on the ClientHello,
+// the router decrypts the client's Initial packets for this
+func (rule *RoutingRule) needsClientHello() bool {
+	return rule.ServerName != "" || rule.ALPN != ""
+}
+
+// matchesPacket matches all fields except the source prefixes and the ClientHello
+func (rule *RoutingRule) matchesPacket(dest netip.AddrPort, hdr *longHeader, validated bool) bool {
+	if rule.Action == RouteRetry && (validated || !hdr.isInitial()) {
+		return false
+	}
+	if rule.Destination.IsValid() {
+		if !rule.Destination.Addr().IsUnspecified() && rule.Destination.Addr().Unmap() != dest.Addr().Unmap() {
+			return false
+		}
+		if rule.Destination.Port() != 0 && rule.Destination.Port() != dest.Port() {
+			return false
+		}
+	}
+	if len(rule.Versions) != 0 && !slices.Contains(rule.Versions, hdr.version) {
+		return false
+	}
+	return true
+}
+
+func (rule *RoutingRule) matchesClientHello(info *clientHelloInfo) bool {
+	if rule.ServerName != "" && !matchServerName(rule.ServerName, info.serverName) {
+		return false
+	}
+	if rule.ALPN != "" && !slices.Contains(info.alpn, rule.ALPN) {
+		return false
+	}
+	return true
+}
+
+func matchServerName(pattern string, serverName string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return len(serverName) > len(suffix) && strings.EqualFold(serverName[len(serverName)-len(suffix):], suffix)
+	}
+	return strings.EqualFold(pattern, serverName)
+}
+
+// routingRules evaluates the rules.
+// It is not changed after creation.
+type routingRules struct {
+	rules []RoutingRule
+	// bySource are the indices of the rules of every source prefix,
+	// rules without source prefix are stored at the root
+	bySource lpmTable[[]int]
+	// needsClientHello if any rule matches on the ClientHello
+	needsClientHello bool
+}
+
+func newRoutingRules(rules []RoutingRule, pools map[string]*pool) (*routingRules, error) {
+	rr := &routingRules{rules: rules}
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Action {
+		case RouteToPool:
+			if _, ok := pools[rule.Pool]; !ok {
+				return nil, fmt.Errorf("routing rule %d: unknown pool %q", i, rule.Pool)
+			}
+		case RouteDrop, RouteRetry:
+		default:
+			return nil, fmt.Errorf("routing rule %d: %s", i, rule.Action)
+		}
+		if rule.needsClientHello() {
+			rr.needsClientHello = true
+		}
+		prefixes := rule.SourcePrefixes
+		if len(prefixes) == 0 {
+			prefixes = []netip.Prefix{netip.PrefixFrom(netip.IPv6Unspecified(), 0)}
+		}
+		for _, prefix := range prefixes {
+			if !prefix.IsValid() {
+				return nil, fmt.Errorf("routing rule %d: invalid source prefix", i)
+			}
+			indices, _ := rr.bySource.get(prefix)
+			rr.bySource.insert(prefix, append(indices, i))
+		}
+	}
+	return rr, nil
+}
+
+type routingDecision struct {
+	action RoutingAction
+	pool   string
+	// needsClientHello is set if a rule matching on the ClientHello has to be evaluated,
+	// but the ClientHello is not known
+	needsClientHello bool
+}
+
+// evaluate returns the action of the first matching rule, or routes to the default pool.
+// info is nil if the ClientHello is not known.
+func (rr *routingRules) evaluate(source netip.AddrPort, dest netip.AddrPort, hdr *longHeader, validated bool, info *clientHelloInfo) routingDecision {
+	decision := routingDecision{action: RouteToPool, pool: DefaultPool}
+	rr.bySource.lookup(source.Addr(), func(indices []int) bool {
+		for _, i := range indices {
+			rule := &rr.rules[i]
+			if !rule.matchesPacket(dest, hdr, validated) {
+				continue
+			}
+			if rule.needsClientHello() {
+				if info == nil {
+					decision = routingDecision{needsClientHello: true}
+					return true
+				}
+				if !rule.matchesClientHello(info) {
+					continue
+				}
+			}
+			decision = routingDecision{action: rule.Action, pool: rule.Pool}
+			return true
+		}
+		return false
+	})
+	return decision
+}
+
+const (
+	// maxPendingClientHellos limits the handshakes whose ClientHello is reassembled at once
+	maxPendingClientHellos = 1024
+	// pendingClientHelloTimeout after which an incomplete ClientHello is discarded.
+	// The client retransmits its Initial packets.
+	pendingClientHelloTimeout = time.Second
+	// maxPendingPackets limits the packets buffered per handshake
+	maxPendingPackets = 8
+)
+
+type pendingPacket struct {
+	// listener that received the packet
+	listener   *listener
+	datagram   []byte
+	addr       netip.AddrPort
+	extHdrType byte
+}
+
+// pendingClientHello buffers the Initial packets of a ClientHello spanning several packets,
+// until the ClientHello is complete and the pool is known
+type pendingClientHello struct {
+	created time.Time
+	crypto  cryptoAssembler
+	packets []pendingPacket
+}
+
+// expirePendingClientHellos must be called by the router's run loop
+func (r *Router) expirePendingClientHellos(now time.Time) {
+	for destConnID, pending := range r.pendingClientHellos {
+		if now.Sub(pending.created) >= pendingClientHelloTimeout {
+			delete(r.pendingClientHellos, destConnID)
+		}
+	}
+}
+
+// routeByClientHello selects the backend of a new connection by the routing rules.
+// The selected backend is remembered for the destination connection ID,
+// so all long header packets of the handshake, e.g. 0-RTT packets, reach the same backend.
+// After the handshake, clients use connection IDs of the backend.
+func (r *Router) routeByClientHello(l *listener, readBuf []byte, addr netip.AddrPort, hdr *longHeader, extHdrType byte) error {
+	now := r.now()
+	if backend := r.routeAffinity.get(hdr.destConnID, now); backend != nil && backend.available() {
+		if hdr.isInitial() {
+			r.pools[backend.pool].countInitial(hdr.destConnID, now)
+		}
+		return r.forwardLongHeaderPacket(l, readBuf, addr, extHdrType, backend, r.keys.Load().current)
+	}
+	pending := r.pendingClientHellos[string(hdr.destConnID)]
+	if pending != nil && now.Sub(pending.created) >= pendingClientHelloTimeout {
+		delete(r.pendingClientHellos, string(hdr.destConnID))
+		pending = nil
+	}
+	if !hdr.isInitial() || !isKnownVersion(hdr.version) {
+		if pending != nil {
+			r.trace.decide("buffered until the ClientHello is complete")
+			pending.buffer(l, readBuf, addr, extHdrType)
+			return nil
+		}
+		if !hdr.isInitial() {
+			r.trace.drop("no Initial of the connection yet")
+			return nil // drop, e.g. 0-RTT packets that arrive before the Initial
+		}
+		// the ClientHello of unknown versions cannot be decrypted
+		return r.routeByClientHelloInfo(l, readBuf, addr, hdr, extHdrType, nil, &clientHelloInfo{}, now)
+	}
+	payload, err := decryptInitialPacket(readBuf, hdr)
+	if err != nil {
+		r.trace.drop("undecryptable Initial")
+		return nil // drop, the backend cannot decrypt the packet either
+	}
+	if pending == nil {
+		pending = &pendingClientHello{created: now}
+	}
+	var msg []byte
+	complete := false
+	err = parseCryptoFrames(payload, pending.crypto.add)
+	if err == nil {
+		msg, complete, err = pending.crypto.clientHello()
+	}
+	var info clientHelloInfo
+	if err == nil && complete {
+		info, err = parseClientHello(msg)
+	}
+	if err != nil {
+		// the backend is responsible for closing connections with malformed ClientHellos,
+		// rules matching on the ClientHello do not match
+		info = clientHelloInfo{}
+		complete = true
+	}
+	if complete {
+		return r.routeByClientHelloInfo(l, readBuf, addr, hdr, extHdrType, pending.packets, &info, now)
+	}
+	if _, ok := r.pendingClientHellos[string(hdr.destConnID)]; !ok {
+		if len(r.pendingClientHellos) >= maxPendingClientHellos {
+			r.expirePendingClientHellos(now)
+		}
+		if len(r.pendingClientHellos) >= maxPendingClientHellos {
+			return r.routeToPool(l, readBuf, addr, hdr, extHdrType, nil, DefaultPool, now)
+		}
+		r.pendingClientHellos[string(hdr.destConnID)] = pending
+	}
+	r.trace.decide("buffered until the ClientHello is complete")
+	pending.buffer(l, readBuf, addr, extHdrType)
+	return nil
+}
+
+// routeByClientHelloInfo applies the routing rules to the current packet and the buffered packets
+func (r *Router) routeByClientHelloInfo(l *listener, readBuf []byte, addr netip.AddrPort, hdr *longHeader, extHdrType byte, pending []pendingPacket, info *clientHelloInfo, now time.Time) error {
+	decision := r.routing.evaluate(addr, l.localAddr, hdr, extHdrType == ValidatedClientAddrExtHdrType, info)
+	switch decision.action {
+	case RouteDrop:
+		delete(r.pendingClientHellos, string(hdr.destConnID))
+		r.trace.drop("routing rule")
+		return nil
+	case RouteRetry:
+		// the client restarts the handshake with a new destination connection ID
+		delete(r.pendingClientHellos, string(hdr.destConnID))
+		return r.sendRetry(l, hdr, len(readBuf), addr)
+	default:
+		return r.routeToPool(l, readBuf, addr, hdr, extHdrType, pending, decision.pool, now)
+	}
+}
+
+// buffer copies the datagram, because the read buffer is reused
+func (p *pendingClientHello) buffer(l *listener, datagram []byte, addr netip.AddrPort, extHdrType byte) {
+	if len(p.packets) >= maxPendingPackets {
+		return // drop
+	}
+	p.packets = append(p.packets, pendingPacket{
+		listener:   l,
+		datagram:   slices.Clone(datagram),
+		addr:       addr,
+		extHdrType: extHdrType,
+	})
+}
+
+// routeToPool forwards the buffered packets and the current packet to a backend of the pool,
+// or of its canary pool.
+// Connections of a canary pool without available backend fall back to the pool.
+func (r *Router) routeToPool(l *listener, readBuf []byte, addr netip.AddrPort, hdr *longHeader, extHdrType byte, pending []pendingPacket, poolName string, now time.Time) error {
+	delete(r.pendingClientHellos, string(hdr.destConnID))
+	p := r.pools[poolName]
+	var backend *Backend
+	if p.split != nil && p.split.toCanary(hdr.destConnID) {
+		canary := r.pools[p.split.canary]
+		backend = canary.selectBackend(r.backends.pool(canary.name), hdr.destConnID, now)
+		if backend != nil {
+			p = canary
+		} else {
+			canary.canaryFallbacks.Add(1)
+		}
+	}
+	if hdr.isInitial() {
+		p.countInitial(hdr.destConnID, now)
+	}
+	if backend == nil {
+		backend = p.selectBackend(r.backends.pool(p.name), hdr.destConnID, now)
+	}
+	if backend == nil {
+		p.noBackendDrops.Add(1)
+		if p.name == DefaultPool {
+			r.trace.drop("no backend available")
+		} else {
+			r.trace.drop("no backend available in pool " + p.name)
+		}
+		return nil // drop, no backend available
+	}
+	if r.routeAffinity != nil {
+		r.routeAffinity.put(hdr.destConnID, backend, now)
+	}
+	if p.mirror != nil && p.mirror.sample(hdr.destConnID) {
+		p.mirror.track(addr, now)
+	}
+	// new connections use connection IDs protected with the current key
+	keys := r.keys.Load().current
+	for _, p := range pending {
+		if err := r.forwardLongHeaderPacket(p.listener, p.datagram, p.addr, p.extHdrType, backend, keys); err != nil {
+			return err
+		}
+	}
+	return r.forwardLongHeaderPacket(l, readBuf, addr, extHdrType, backend, keys)
+}
@@ -0,0 +1,46 @@
+package router
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+)
+
+func TestRoutingRules(t *testing.T) {
+	pools := map[string]*pool{DefaultPool: nil, "web": nil, "doq": nil, "customer": nil}
+	rules, err := newRoutingRules([]RoutingRule{
+		{ServerName: "*.example.com", ALPN: "doq", Pool: "doq"},
+		{ServerName: "*.example.com", Pool: "web"},
+		{SourcePrefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")}, Pool: "customer"},
+		{SourcePrefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")}, Action: RouteDrop},
+		{SourcePrefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, Action: RouteRetry},
+		{Versions: []uint32{Version2}, Destination: netip.MustParseAddrPort("0.0.0.0:443"), Action: RouteDrop},
+	}, pools)
+	require.NoError(t, err)
+	assert.True(t, rules.needsClientHello)
+	dest := netip.MustParseAddrPort("203.0.113.1:443")
+	v1 := &longHeader{version: Version1, packetType: packetTypeInitial}
+	v2 := &longHeader{version: Version2, packetType: packetTypeInitial}
+	info := &clientHelloInfo{serverName: "api.example.com", alpn: []string{"h3"}}
+	other := netip.MustParseAddrPort("203.0.113.2:1234")
+
+	assert.Equal(t, routingDecision{needsClientHello: true}, rules.evaluate(other, dest, v1, false, nil))
+	assert.Equal(t, routingDecision{pool: "web"}, rules.evaluate(other, dest, v1, false, info))
+	assert.Equal(t, routingDecision{pool: DefaultPool}, rules.evaluate(other, dest, v1, false, &clientHelloInfo{}))
+	// the longest source prefix is evaluated first
+	assert.Equal(t, routingDecision{pool: "customer"}, rules.evaluate(netip.MustParseAddrPort("192.0.2.1:1234"), dest, v1, false, nil))
+	assert.Equal(t, routingDecision{pool: "customer"}, rules.evaluate(netip.MustParseAddrPort("[2001:db8::1]:1234"), dest, v1, false, nil))
+	assert.Equal(t, routingDecision{action: RouteDrop}, rules.evaluate(netip.MustParseAddrPort("[::ffff:192.0.2.200]:1234"), dest, v1, false, nil))
+	// validated clients skip retry rules
+	retryClient := netip.MustParseAddrPort("198.51.100.1:1234")
+	assert.Equal(t, routingDecision{action: RouteRetry}, rules.evaluate(retryClient, dest, v1, false, nil))
+	assert.Equal(t, routingDecision{pool: "web"}, rules.evaluate(retryClient, dest, v1, true, info))
+	// version and destination
+	assert.Equal(t, routingDecision{needsClientHello: true}, rules.evaluate(other, dest, v2, false, nil))
+	assert.Equal(t, routingDecision{action: RouteDrop}, rules.evaluate(other, dest, v2, false, &clientHelloInfo{}))
+	assert.Equal(t, routingDecision{pool: DefaultPool}, rules.evaluate(other, netip.MustParseAddrPort("203.0.113.1:8443"), v2, false, &clientHelloInfo{}))
+
+	_, err = newRoutingRules([]RoutingRule{{Pool: "unknown"}}, pools)
+	assert.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+)
+
+// selectBackend selects the backend for a new connection
+// by weighted rendezvous hashing of the client's destination connection ID,
+// so all long header packets of a handshake reach the same backend
+// and adding or removing a backend, or changing its weight, only moves the minimum number of connections.
+// Backends that are down, draining or have weight 0 are skipped.
+// Returns nil if no backend is available.
+func selectBackend(backends []*Backend, destConnID []byte, now time.Time) *Backend {
+	var selected *Backend
+	var maxScore float64
+	for _, b := range backends {
+		if !b.available() {
+			continue
+		}
+		weight := b.effectiveWeight(now)
+		if weight <= 0 {
+			continue
+		}
+		score := weightedRendezvousScore(rendezvousScore(b.serverID, destConnID), weight)
+		if selected == nil || score > maxScore {
+			selected = b
+			maxScore = score
+		}
+	}
+	return selected
+}
+
+// weightedRendezvousScore is -weight/ln(u) with the hash mapped to u in (0, 1),
+// a backend wins with a probability proportional to its weight
+func weightedRendezvousScore(hash uint64, weight float64) float64 {
+	u := (float64(hash>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// selectLeastLoaded selects the less loaded of the two backends with the highest weighted rendezvous score,
+// the load is relative to the weight.
+// The candidates are chosen by the destination connection ID, so the choice only depends on the load,
+// see handshakeAffinity.
+// Returns nil if no backend is available.
+func selectLeastLoaded(backends []*Backend, destConnID []byte, now time.Time) *Backend {
+	var first, second *Backend
+	var firstScore, secondScore, firstWeight, secondWeight float64
+	for _, b := range backends {
+		if !b.available() {
+			continue
+		}
+		weight := b.effectiveWeight(now)
+		if weight <= 0 {
+			continue
+		}
+		score := weightedRendezvousScore(rendezvousScore(b.serverID, destConnID), weight)
+		if first == nil || score > firstScore {
+			second, secondScore, secondWeight = first, firstScore, firstWeight
+			first, firstScore, firstWeight = b, score, weight
+		} else if second == nil || score > secondScore {
+			second, secondScore, secondWeight = b, score, weight
+		}
+	}
+	if second == nil {
+		return first
+	}
+	firstLoad, secondLoad := compareLoad(first, second, now)
+	if secondLoad/secondWeight < firstLoad/firstWeight {
+		return second
+	}
+	return first
+}
+
+// compareLoad returns comparable loads of two backends.
+// The reported utilization is used if both backends report it,
+// then the reported active connections,
+// otherwise the packet rate the router forwards to the backends.
+func compareLoad(a, b *Backend, now time.Time) (float64, float64) {
+	aLoad, bLoad := a.Load(), b.Load()
+	if aLoad != nil && bLoad != nil {
+		if aLoad.Utilization != 0 || bLoad.Utilization != 0 {
+			return aLoad.Utilization, bLoad.Utilization
+		}
+		return float64(aLoad.ActiveConnections), float64(bLoad.ActiveConnections)
+	}
+	return a.updatePacketRate(now), b.updatePacketRate(now)
+}
+
+func rendezvousScore(serverID [connIDServerIDLen]byte, destConnID []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(serverID[:])
+	_, _ = h.Write(destConnID)
+	return mix64(h.Sum64())
+}
+
+// mix64 is the finalizer of splitmix64, FNV alone does not distribute well enough
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
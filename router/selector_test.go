@@ -0,0 +1,122 @@
+package router
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestBackends(t *testing.T, addrs ...string) []*Backend {
+	backends := newBackendSet()
+	var list []*Backend
+	for _, addr := range addrs {
+		b, err := backends.add(netip.MustParseAddrPort(addr))
+		require.NoError(t, err)
+		list = append(list, b)
+	}
+	return list
+}
+
+func TestSelectBackendWeighted(t *testing.T) {
+	backends := newTestBackends(t, "127.0.0.1:1", "127.0.0.1:2")
+	backends[1].setWeight(3)
+	now := time.Now()
+	const n = 10000
+	before := make([]*Backend, n)
+	counts := map[*Backend]int{}
+	for i := 0; i < n; i++ {
+		destConnID := binary.BigEndian.AppendUint64(nil, uint64(i))
+		before[i] = selectBackend(backends, destConnID, now)
+		counts[before[i]]++
+	}
+	assert.InDelta(t, 0.75, float64(counts[backends[1]])/n, 0.03)
+
+	// increasing a weight only moves connections to that backend
+	backends[0].setWeight(2)
+	for i := 0; i < n; i++ {
+		destConnID := binary.BigEndian.AppendUint64(nil, uint64(i))
+		after := selectBackend(backends, destConnID, now)
+		if after != before[i] {
+			assert.Equal(t, backends[0], after)
+		}
+	}
+
+	backends[0].setWeight(0)
+	backends[1].setWeight(0)
+	assert.Nil(t, selectBackend(backends, []byte{1, 2, 3, 4, 5, 6, 7, 8}, now))
+}
+
+func TestSlowStart(t *testing.T) {
+	b := newTestBackends(t, "127.0.0.1:1")[0]
+	b.setWeight(10)
+	now := time.Now()
+	b.startSlowStart(now, 10*time.Second)
+	assert.InDelta(t, 10*minSlowStartFactor, b.effectiveWeight(now), 1e-9)
+	assert.InDelta(t, 5, b.effectiveWeight(now.Add(5*time.Second)), 1e-9)
+	assert.Equal(t, float64(10), b.effectiveWeight(now.Add(10*time.Second)))
+	assert.Equal(t, float64(10), b.effectiveWeight(now.Add(time.Minute)))
+	// a single backend in slow start still receives connections
+	assert.Equal(t, b, selectBackend([]*Backend{b}, []byte{1, 2, 3, 4}, now))
+}
+
+func TestSelectLeastLoaded(t *testing.T) {
+	backends := newTestBackends(t, "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	now := time.Now()
+	backends[0].load.Store(&LoadReport{Utilization: 0.9})
+	backends[1].load.Store(&LoadReport{Utilization: 0.1})
+	backends[2].load.Store(&LoadReport{Utilization: 0.5})
+	for i := 0; i < 100; i++ {
+		destConnID := binary.BigEndian.AppendUint64(nil, uint64(i))
+		// the most loaded backend is never the less loaded of two candidates
+		assert.NotEqual(t, backends[0], selectLeastLoaded(backends, destConnID, now))
+	}
+	// the load is relative to the weight
+	backends[0].setWeight(10)
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Equal(t, backends[0], selectLeastLoaded(backends[:2], destConnID, now))
+}
+
+func TestPoolHandshakeAffinity(t *testing.T) {
+	backends := newTestBackends(t, "127.0.0.1:1", "127.0.0.1:2")
+	backends[0].load.Store(&LoadReport{ActiveConnections: 10})
+	backends[1].load.Store(&LoadReport{ActiveConnections: 20})
+	p, err := newPool("test", PoolConfig{Selection: SelectionLeastLoaded}, 0)
+	require.NoError(t, err)
+	now := time.Now()
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	require.Equal(t, backends[0], p.selectBackend(backends, destConnID, now))
+	// the load changes during the handshake
+	backends[0].load.Store(&LoadReport{ActiveConnections: 30})
+	assert.Equal(t, backends[0], p.selectBackend(backends, destConnID, now.Add(time.Second)))
+	assert.Equal(t, backends[1], p.selectBackend(backends, []byte{8, 7, 6, 5, 4, 3, 2, 1}, now))
+	// the affinity expires
+	assert.Equal(t, backends[1], p.selectBackend(backends, destConnID, now.Add(3*handshakeAffinityTimeout)))
+	// unavailable backends are not kept
+	backends[1].setState(BackendDown)
+	assert.Equal(t, backends[0], p.selectBackend(backends, destConnID, now.Add(3*handshakeAffinityTimeout)))
+}
+
+func TestPoolSlowStartKeepsHandshakes(t *testing.T) {
+	backends := newTestBackends(t, "127.0.0.1:1", "127.0.0.1:2")
+	now := time.Now()
+	backends[1].startSlowStart(now, 10*time.Second)
+	// a destination connection ID that moves to the backend in slow start as its weight ramps up
+	var destConnID []byte
+	for i := 0; destConnID == nil; i++ {
+		id := binary.BigEndian.AppendUint64(nil, uint64(i))
+		if selectBackend(backends, id, now) == backends[0] && selectBackend(backends, id, now.Add(5*time.Second)) == backends[1] {
+			destConnID = id
+		}
+	}
+	p, err := newPool("test", PoolConfig{Selection: SelectionConsistentHash}, 10*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, backends[0], p.selectBackend(backends, destConnID, now))
+	for at := time.Second; at <= 5*time.Second; at += time.Second {
+		assert.Equal(t, backends[0], p.selectBackend(backends, destConnID, now.Add(at)))
+	}
+	// without the affinity the handshake would have moved
+	assert.Equal(t, backends[1], selectBackend(backends, destConnID, now.Add(5*time.Second)))
+}
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+const (
+	serverKeySecretLen = 32
+	ServerKeyLen       = connIDServerIDLen + connIDServerIDLen + 1 + serverKeySecretLen
+)
+
+// maxCachedServers bounds the per server caches,
+// so random connection IDs cannot exhaust memory.
+// A full cache evicts a random entry, so unknown server IDs cannot keep backends out of it.
+const maxCachedServers = 4096
+
+// ServerKey is the key material of a single backend.
+// It is derived from the router's master secret,
+// so a leaked ServerKey does not compromise other backends.
+type ServerKey struct {
+	ServerID [connIDServerIDLen]byte
+	// ConcealedServerID is the server ID as it appears in connection IDs
+	ConcealedServerID [connIDServerIDLen]byte
+	// CipherSuite is used by the server for connection IDs and extension headers
+	CipherSuite CipherSuite
+	// Secret is used for connection ID and extension header protection
+	Secret [serverKeySecretLen]byte
+}
+
+// DeriveServerKey derives the key of the backend with the given server ID from the master secret.
+func DeriveServerKey(master [32]byte, serverID [connIDServerIDLen]byte, suite CipherSuite) (ServerKey, error) {
+	k := ServerKey{ServerID: serverID, CipherSuite: suite}
+	secret, err := expandLabel(master, serverID[:], labelServerKey, serverKeySecretLen)
+	if err != nil {
+		return ServerKey{}, err
+	}
+	k.Secret = [serverKeySecretLen]byte(secret)
+	mask, err := deriveServerIDMask(master)
+	if err != nil {
+		return ServerKey{}, err
+	}
+	k.ConcealedServerID = concealServerID(serverID, mask)
+	return k, nil
+}
+
+func DeriveServerKeyFromAddr(master [32]byte, serverAddr netip.AddrPort, suite CipherSuite) (ServerKey, error) {
+	return DeriveServerKey(master, addrToServerID(serverAddr), suite)
+}
+
+func deriveServerIDMask(master [32]byte) ([connIDServerIDLen]byte, error) {
+	mask, err := expandLabel(master, nil, labelServerIDMask, connIDServerIDLen)
+	if err != nil {
+		return [connIDServerIDLen]byte{}, err
+	}
+	return [connIDServerIDLen]byte(mask), nil
+}
+
+// concealServerID is its own inverse
+func concealServerID(serverID [connIDServerIDLen]byte, mask [connIDServerIDLen]byte) [connIDServerIDLen]byte {
+	var concealed [connIDServerIDLen]byte
+	for i := range concealed {
+		concealed[i] = serverID[i] ^ mask[i]
+	}
+	return concealed
+}
+
+func (k ServerKey) Addr() netip.AddrPort {
+	return serverIDToAddr(k.ServerID)
+}
+
+func (k ServerKey) Bytes() []byte {
+	b := make([]byte, 0, ServerKeyLen)
+	b = append(b, k.ServerID[:]...)
+	b = append(b, k.ConcealedServerID[:]...)
+	b = append(b, byte(k.CipherSuite))
+	return append(b, k.Secret[:]...)
+}
+
+// String returns the base64 encoding, as accepted by ParseServerKey
+func (k ServerKey) String() string {
+	return base64.StdEncoding.EncodeToString(k.Bytes())
+}
+
+func ServerKeyFromBytes(b []byte) (ServerKey, error) {
+	if len(b) != ServerKeyLen {
+		return ServerKey{}, fmt.Errorf("server key must be %d byte", ServerKeyLen)
+	}
+	var k ServerKey
+	copy(k.ServerID[:], b)
+	copy(k.ConcealedServerID[:], b[connIDServerIDLen:])
+	k.CipherSuite = CipherSuite(b[2*connIDServerIDLen])
+	if !k.CipherSuite.Valid() {
+		return ServerKey{}, fmt.Errorf("unsupported cipher suite %d", k.CipherSuite)
+	}
+	copy(k.Secret[:], b[2*connIDServerIDLen+1:])
+	return k, nil
+}
+
+func ParseServerKey(s string) (ServerKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return ServerKey{}, fmt.Errorf("failed to parse server key: %s", err)
+	}
+	return ServerKeyFromBytes(b)
+}
+
+// perServer lazily creates and caches one value per server ID,
+// because deriving keys for every packet is too expensive.
+type perServer[T any] struct {
+	mu     sync.RWMutex
+	values map[[connIDServerIDLen]byte]T
+	create func(serverID [connIDServerIDLen]byte) (T, error)
+}
+
+func newPerServer[T any](create func(serverID [connIDServerIDLen]byte) (T, error)) *perServer[T] {
+	return &perServer[T]{
+		values: map[[connIDServerIDLen]byte]T{},
+		create: create,
+	}
+}
+
+func (p *perServer[T]) get(serverID [connIDServerIDLen]byte) (T, error) {
+	p.mu.RLock()
+	v, ok := p.values[serverID]
+	p.mu.RUnlock()
+	if ok {
+		return v, nil
+	}
+	v, err := p.create(serverID)
+	if err != nil {
+		return v, err
+	}
+	p.mu.Lock()
+	if len(p.values) >= maxCachedServers {
+		// map iteration order is random
+		for evicted := range p.values {
+			delete(p.values, evicted)
+			break
+		}
+	}
+	p.values[serverID] = v
+	p.mu.Unlock()
+	return v, nil
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+)
+
+func TestServerKey(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	routerProtector, err := NewConnIDProtector(master, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	addr := netip.MustParseAddrPort("127.0.0.1:8292")
+	serverKey, err := DeriveServerKeyFromAddr(master, addr, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	parsedServerKey, err := ParseServerKey(serverKey.String())
+	require.NoError(t, err)
+	assert.Equal(t, serverKey, parsedServerKey)
+	assert.Equal(t, addr, parsedServerKey.Addr())
+
+	serverProtector, err := NewServerConnIDProtector(parsedServerKey)
+	require.NoError(t, err)
+	connID, err := NewConnIDGeneratorFromServerProtector(serverProtector, rand.Reader).GenerateConnectionID()
+	require.NoError(t, err)
+	decodedAddr, err := routerProtector.DecodeAsAddr(connID)
+	assert.NoError(t, err)
+	assert.Equal(t, addr, decodedAddr)
+}
+
+func TestServerKeyCannotForgeOtherServer(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	routerProtector, err := NewConnIDProtector(master, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	key, err := DeriveServerKeyFromAddr(master, netip.MustParseAddrPort("127.0.0.1:1"), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	otherKey, err := DeriveServerKeyFromAddr(master, netip.MustParseAddrPort("127.0.0.1:2"), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	// a server that claims the concealed server ID of another server
+	key.ConcealedServerID = otherKey.ConcealedServerID
+	serverProtector, err := NewServerConnIDProtector(key)
+	require.NoError(t, err)
+	connID := serverProtector.Protect([6]byte{1, 2, 3, 4, 5, 6})
+	_, _, err = routerProtector.Decode(connID[:])
+	assert.Error(t, err)
+}
+
+func TestPerServerEvictsWhenFull(t *testing.T) {
+	p := newPerServer(func(serverID [connIDServerIDLen]byte) (int, error) {
+		return int(binary.BigEndian.Uint32(serverID[:])), nil
+	})
+	for i := 0; i < maxCachedServers+10; i++ {
+		var serverID [connIDServerIDLen]byte
+		binary.BigEndian.PutUint32(serverID[:], uint32(i))
+		v, err := p.get(serverID)
+		require.NoError(t, err)
+		assert.Equal(t, i, v)
+	}
+	assert.Len(t, p.values, maxCachedServers)
+	// the last server is cached although the cache was full
+	var last [connIDServerIDLen]byte
+	binary.BigEndian.PutUint32(last[:], maxCachedServers+9)
+	assert.Contains(t, p.values, last)
+}
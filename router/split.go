@@ -0,0 +1,76 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// SplitRule routes a fraction of the new connections of a pool to a canary pool
+type SplitRule struct {
+	// Pool whose new connections are split
+	Pool string
+	// Canary pool that receives the fraction of the new connections
+	Canary string
+	// Fraction of new connections from 0 to 1, it can be changed by Router.SetSplitFraction
+	Fraction float64
+}
+
+// split is assigned to the pool whose connections are split
+type split struct {
+	canary string
+	// fraction are the bits of a float64
+	fraction atomic.Uint64
+}
+
+func (s *split) Fraction() float64 {
+	return math.Float64frombits(s.fraction.Load())
+}
+
+func (s *split) setFraction(fraction float64) error {
+	if !(fraction >= 0 && fraction <= 1) {
+		return fmt.Errorf("split fraction %v is not between 0 and 1", fraction)
+	}
+	s.fraction.Store(math.Float64bits(fraction))
+	return nil
+}
+
+// toCanary assigns the destination connection ID to the canary pool.
+// The decision is deterministic, so all long header packets of a handshake reach the same pool.
+// Increasing the fraction only moves connections to the canary pool.
+func (s *split) toCanary(destConnID []byte) bool {
+	fraction := s.Fraction()
+	if fraction == 0 {
+		return false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("split"))
+	_, _ = h.Write(destConnID)
+	u := float64(mix64(h.Sum64())>>11) / (1 << 53)
+	return u < fraction
+}
+
+func applySplitRules(rules []SplitRule, pools map[string]*pool) error {
+	for i, rule := range rules {
+		p, ok := pools[rule.Pool]
+		if !ok {
+			return fmt.Errorf("split rule %d: unknown pool %q", i, rule.Pool)
+		}
+		if _, ok := pools[rule.Canary]; !ok {
+			return fmt.Errorf("split rule %d: unknown canary pool %q", i, rule.Canary)
+		}
+		if rule.Pool == rule.Canary {
+			return fmt.Errorf("split rule %d: pool and canary pool are the same", i)
+		}
+		if p.split != nil {
+			return fmt.Errorf("split rule %d: pool %q is already split", i, rule.Pool)
+		}
+		s := &split{canary: rule.Canary}
+		if err := s.setFraction(rule.Fraction); err != nil {
+			return fmt.Errorf("split rule %d: %w", i, err)
+		}
+		p.split = s
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"expvar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	pools := map[string]*pool{DefaultPool: {name: DefaultPool}, "canary": {name: "canary"}}
+	require.NoError(t, applySplitRules([]SplitRule{{Pool: DefaultPool, Canary: "canary", Fraction: 0.01}}, pools))
+	s := pools[DefaultPool].split
+	require.NotNil(t, s)
+	const n = 100000
+	toCanary := make([]bool, n)
+	count := 0
+	for i := 0; i < n; i++ {
+		toCanary[i] = s.toCanary(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		if toCanary[i] {
+			count++
+		}
+	}
+	assert.InDelta(t, 0.01, float64(count)/n, 0.002)
+
+	// increasing the fraction only moves connections to the canary pool
+	require.NoError(t, s.setFraction(0.1))
+	for i := 0; i < n; i++ {
+		if toCanary[i] {
+			assert.True(t, s.toCanary(binary.BigEndian.AppendUint64(nil, uint64(i))))
+		}
+	}
+	require.NoError(t, s.setFraction(0))
+	assert.False(t, s.toCanary([]byte{1, 2, 3, 4}))
+	assert.Error(t, s.setFraction(1.5))
+
+	assert.Error(t, applySplitRules([]SplitRule{{Pool: "canary", Canary: "unknown"}}, pools))
+	assert.Error(t, applySplitRules([]SplitRule{{Pool: DefaultPool, Canary: "canary"}}, pools))
+}
+
+func TestSplitFallsBackWithoutCanaryBackend(t *testing.T) {
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	canaryAddr := netip.MustParseAddrPort("10.0.0.2:4433")
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		DefaultServerAddr: netip.MustParseAddrPort("10.0.0.1:4433"),
+		Config: &Config{
+			Pools:  map[string]PoolConfig{"canary": {}},
+			Splits: []SplitRule{{Pool: DefaultPool, Canary: "canary", Fraction: 1}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, replay.router.AddBackendToPool(canaryAddr, "canary"))
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	decision, err := replay.Route(now, client, routerAddr, initial)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "forwarded to backend 10.0.0.2:4433 of pool canary"), decision)
+
+	// the default pool takes the canary share while the canary pool has no available backend
+	require.NoError(t, replay.router.DrainBackend(canaryAddr, time.Time{}))
+	decision, err = replay.Route(now, client, routerAddr, appendTestInitial(nil, []byte{8, 7, 6, 5, 4, 3, 2, 1}, nil))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(decision, "forwarded to backend 10.0.0.1:4433"), decision)
+	assert.Equal(t, uint64(1), replay.router.pools["canary"].canaryFallbacks.Load())
+	assert.Equal(t, uint64(1), replay.router.pools[DefaultPool].initialPackets.Load())
+	assert.Zero(t, replay.router.pools["canary"].noBackendDrops.Load())
+}
+
+func TestSplitPoolsCountErrorsSeparately(t *testing.T) {
+	secret := [32]byte{1}
+	routerAddr := netip.MustParseAddrPort("203.0.113.1:443")
+	backendAddr := netip.MustParseAddrPort("10.0.0.1:4433")
+	canaryAddr := netip.MustParseAddrPort("10.0.0.2:4433")
+	replay, err := NewReplay(TenantConfig{
+		Listen:            []netip.AddrPort{routerAddr},
+		Secret:            secret,
+		DefaultServerAddr: backendAddr,
+		Config: &Config{
+			Pools:              map[string]PoolConfig{"canary": {}},
+			Splits:             []SplitRule{{Pool: DefaultPool, Canary: "canary", Fraction: 1}},
+			StatelessResetRate: 100,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, replay.router.AddBackendToPool(canaryAddr, "canary"))
+	defaultPool, canaryPool := replay.router.pools[DefaultPool], replay.router.pools["canary"]
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddrPort("192.0.2.1:1234")
+	route := func(at time.Duration, datagram []byte) string {
+		decision, err := replay.Route(now.Add(at), client, routerAddr, datagram)
+		require.NoError(t, err)
+		return decision
+	}
+	shortHdr := func(backend netip.AddrPort) []byte {
+		protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
+		require.NoError(t, err)
+		generator, err := NewConnIDGeneratorFromAddr(protector, backend, rand.Reader)
+		require.NoError(t, err)
+		connID, err := generator.GenerateConnectionID()
+		require.NoError(t, err)
+		return append(append([]byte{0x40}, connID.Bytes()...), make([]byte, 40)...)
+	}
+
+	// the canary pool retransmits an Initial, the Initials of a ClientHello spanning two packets are no retransmission
+	initial := appendTestInitial(nil, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	route(0, initial)
+	route(time.Millisecond, initial)
+	assert.Contains(t, route(time.Second, initial), "of pool canary")
+	assert.Equal(t, uint64(3), canaryPool.initialPackets.Load())
+	assert.Equal(t, uint64(1), canaryPool.retransmittedInitials.Load())
+
+	// the canary backend is down, its clients are reset
+	replay.router.setBackendState(replay.router.backends.getByAddr(canaryAddr), BackendDown)
+	assert.Contains(t, route(time.Second, shortHdr(canaryAddr)), "answered with stateless reset")
+	assert.Equal(t, uint64(1), canaryPool.statelessResets.Load())
+
+	// the connection ID of the default pool does not verify
+	invalid := shortHdr(backendAddr)
+	invalid[connIDLen] ^= 1
+	assert.Contains(t, route(time.Second, invalid), "dropped: invalid connection id")
+	assert.Equal(t, uint64(1), defaultPool.invalidConnIDs.Load())
+
+	// the default backend is past its drain deadline
+	require.NoError(t, replay.router.DrainBackend(backendAddr, now))
+	route(time.Second, shortHdr(backendAddr))
+	assert.Equal(t, uint64(1), defaultPool.drainDeadlineDrops.Load())
+
+	assert.Zero(t, defaultPool.initialPackets.Load())
+	assert.Zero(t, defaultPool.retransmittedInitials.Load())
+	assert.Equal(t, uint64(1), defaultPool.statelessResets.Load())
+	assert.Zero(t, canaryPool.invalidConnIDs.Load())
+	assert.Zero(t, canaryPool.drainDeadlineDrops.Load())
+	pools := replay.router.Metrics().Get("pools").(expvar.Func).Value().(map[string]any)
+	assert.Equal(t, uint64(1), pools["canary"].(map[string]any)["retransmitted_initials"])
+	assert.Equal(t, uint64(1), pools[DefaultPool].(map[string]any)["drain_deadline_drops"])
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	statelessResetTokenLen = 16
+	// minStatelessResetLen is the minimum size of Stateless Reset packets, see RFC 9000 Section 10.3
+	minStatelessResetLen = 21
+	// maxStatelessResetLen is sufficient to look like a short header packet with a connIDLen connection ID
+	maxStatelessResetLen = 1 + connIDLen + 24
+)
+
+// StatelessResetKey returns the key the backend must use as quic.Transport.StatelessResetKey,
+// so the router can send Stateless Resets on behalf of the backend.
+func (k ServerKey) StatelessResetKey() (quic.StatelessResetKey, error) {
+	key, err := expandLabel(k.Secret, nil, labelStatelessReset, len(quic.StatelessResetKey{}))
+	if err != nil {
+		return quic.StatelessResetKey{}, err
+	}
+	return quic.StatelessResetKey(key), nil
+}
+
+// statelessResetToken is compatible with the token derivation of quic-go
+func statelessResetToken(key quic.StatelessResetKey, connID []byte) [statelessResetTokenLen]byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(connID)
+	var token [statelessResetTokenLen]byte
+	copy(token[:], h.Sum(nil))
+	return token
+}
+
+// appendStatelessReset appends a Stateless Reset packet that is smaller than the triggering packet,
+// so it cannot be used for amplification or loops.
+// Returns false if the triggering packet is too small.
+func appendStatelessReset(b []byte, token [statelessResetTokenLen]byte, triggerLen int) ([]byte, bool) {
+	l := min(triggerLen-1, maxStatelessResetLen)
+	if l < minStatelessResetLen {
+		return b, false
+	}
+	start := len(b)
+	b = append(b, make([]byte, l-statelessResetTokenLen)...)
+	_, _ = rand.Read(b[start:])
+	b[start] = b[start]&0x3f | 0x40 // short header
+	return append(b, token[:]...), true
+}
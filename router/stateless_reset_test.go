@@ -0,0 +1,45 @@
+package router
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStatelessReset(t *testing.T) {
+	var master [32]byte
+	_, err := rand.Read(master[:])
+	require.NoError(t, err)
+	serverKey, err := DeriveServerKeyFromAddr(master, netip.MustParseAddrPort("127.0.0.1:8292"), CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	resetKey, err := serverKey.StatelessResetKey()
+	require.NoError(t, err)
+	connID := []byte{1, 2, 3, 4}
+	token := statelessResetToken(resetKey, connID)
+	assert.Equal(t, token, statelessResetToken(resetKey, connID))
+
+	reset, ok := appendStatelessReset(nil, token, 30)
+	require.True(t, ok)
+	assert.Len(t, reset, 29)
+	assert.True(t, isQUICPacket(reset[0]))
+	assert.False(t, isLongHeaderPacket(reset[0]))
+	assert.Equal(t, token[:], reset[len(reset)-statelessResetTokenLen:])
+	reset, ok = appendStatelessReset(nil, token, 1200)
+	require.True(t, ok)
+	assert.Len(t, reset, maxStatelessResetLen)
+	_, ok = appendStatelessReset(nil, token, minStatelessResetLen)
+	assert.False(t, ok)
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	now := time.Now()
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+	assert.True(t, b.allow(now.Add(time.Second)))
+	assert.False(t, b.allow(now.Add(time.Second)))
+}
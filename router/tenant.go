@@ -0,0 +1,270 @@
+package router
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// TenantConfig configures a tenant of a process that serves several tenants
+type TenantConfig struct {
+	// Listen are the addresses of the tenant, e.g. one per virtual IP address
+	Listen []netip.AddrPort
+	// Secret of the tenant, the key material of its backends is derived from it
+	Secret            [32]byte
+	DefaultServerAddr netip.AddrPort
+	// Config of the tenant's router, Config.Name names the tenant
+	Config *Config
+}
+
+// Tenants are the routers of several tenants sharing a process.
+// Tenants share no listeners and no backends,
+// so the packets of a backend are always unwrapped with the key of its tenant.
+type Tenants struct {
+	mu      sync.Mutex
+	routers []*Router
+	// listeners by configured listen address
+	listeners map[netip.AddrPort]*listener
+	// generation is incremented by every Reload
+	generation int
+	// stopping tenants are not reloaded anymore
+	stopping bool
+	metrics  *expvar.Map
+	closed   chan struct{}
+}
+
+func NewTenants(configs []TenantConfig) (*Tenants, error) {
+	t := &Tenants{
+		listeners: map[netip.AddrPort]*listener{},
+		metrics:   new(expvar.Map).Init(),
+		closed:    make(chan struct{}),
+	}
+	routers, err := t.newRouters(configs, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.routers = routers
+	for _, r := range routers {
+		r.start()
+		t.metrics.Set(r.config.Name, r.Metrics())
+	}
+	go t.watch(t.routers, t.generation)
+	return t, nil
+}
+
+// newRouters creates the routers of the configs, that are not started yet.
+// The routers take over the listeners and backends of the previous routers of the same tenant.
+// On error, listeners that are not used by the previous routers are closed.
+func (t *Tenants) newRouters(configs []TenantConfig, previous map[string]*Router) ([]*Router, error) {
+	if err := validateTenants(configs); err != nil {
+		return nil, err
+	}
+	opened := map[netip.AddrPort]*listener{}
+	closeOpened := func() {
+		for _, l := range opened {
+			_ = l.conn.Close()
+		}
+	}
+	var routers []*Router
+	for _, c := range configs {
+		if len(c.Listen) == 0 {
+			closeOpened()
+			return nil, fmt.Errorf("tenant %q: no listener", c.Config.Name)
+		}
+		var listeners []*listener
+		for _, addr := range c.Listen {
+			l, ok := t.listeners[addr]
+			if !ok {
+				conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+				if err != nil {
+					closeOpened()
+					return nil, fmt.Errorf("tenant %q: %w", c.Config.Name, err)
+				}
+				l = newListener(conn)
+				opened[addr] = l
+			}
+			listeners = append(listeners, l)
+		}
+		r, err := newRouter(listeners, c.Secret, c.DefaultServerAddr, c.Config, previous[c.Config.Name])
+		if err != nil {
+			closeOpened()
+			return nil, fmt.Errorf("tenant %q: %w", c.Config.Name, err)
+		}
+		routers = append(routers, r)
+	}
+	for addr, l := range opened {
+		t.listeners[addr] = l
+	}
+	return routers, nil
+}
+
+// validateTenants checks that the names are unique and no listener or backend is shared
+func validateTenants(configs []TenantConfig) error {
+	names := map[string]struct{}{}
+	listeners := map[netip.AddrPort]string{}
+	backends := map[netip.AddrPort]string{}
+	for _, c := range configs {
+		if c.Config == nil {
+			return fmt.Errorf("tenant without config")
+		}
+		name := c.Config.Name
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("duplicate tenant %q", name)
+		}
+		names[name] = struct{}{}
+		for _, addr := range c.Listen {
+			if other, ok := listeners[addr]; ok && other == name {
+				return fmt.Errorf("duplicate listener %s of tenant %q", addr, name)
+			} else if ok {
+				return fmt.Errorf("listener %s of tenant %q is shared with tenant %q", addr, name, other)
+			}
+			listeners[addr] = name
+		}
+		for _, addr := range c.backends() {
+			if other, ok := backends[addr]; ok && other != name {
+				return fmt.Errorf("backend %s of tenant %q is shared with tenant %q", addr, name, other)
+			}
+			backends[addr] = name
+		}
+	}
+	return nil
+}
+
+// backends returns the backends of all pools of the tenant
+func (c *TenantConfig) backends() []netip.AddrPort {
+	var addrs []netip.AddrPort
+	if c.DefaultServerAddr.IsValid() {
+		addrs = append(addrs, c.DefaultServerAddr)
+	}
+	addrs = append(addrs, c.Config.Backends...)
+	for _, p := range c.Config.Pools {
+		addrs = append(addrs, p.Backends...)
+	}
+	return addrs
+}
+
+// Reload applies new configs of the tenants.
+// If a config is invalid, an error is returned and the previous configs remain in use.
+// Otherwise the routers of the previous configs hand over their sockets to the new routers,
+// packets that arrive meanwhile are queued by the sockets.
+// Connections of a tenant continue if its secret and backends do not change.
+func (t *Tenants) Reload(configs []TenantConfig) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopping {
+		return fmt.Errorf("tenants are stopping")
+	}
+	previous := map[string]*Router{}
+	for _, r := range t.routers {
+		previous[r.config.Name] = r
+	}
+	routers, err := t.newRouters(configs, previous)
+	if err != nil {
+		return err
+	}
+	t.generation++
+	for _, r := range t.routers {
+		r.handOver()
+	}
+	used := map[*listener]struct{}{}
+	for _, r := range routers {
+		if p, ok := previous[r.config.Name]; ok {
+			r.takeOver(p)
+			delete(previous, r.config.Name)
+		}
+		for _, l := range r.listeners {
+			used[l] = struct{}{}
+		}
+		r.start()
+		t.metrics.Set(r.config.Name, r.Metrics())
+	}
+	for name, r := range previous {
+		t.metrics.Delete(name)
+		r.logf("removed tenant %q\n", name)
+	}
+	for addr, l := range t.listeners {
+		if _, ok := used[l]; !ok {
+			_ = l.conn.Close()
+			delete(t.listeners, addr)
+		}
+	}
+	t.routers = routers
+	go t.watch(routers, t.generation)
+	return nil
+}
+
+// watch closes Closed when the routers of the generation are closed,
+// unless they were replaced by Reload
+func (t *Tenants) watch(routers []*Router, generation int) {
+	for _, r := range routers {
+		<-r.Closed()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation != generation {
+		return
+	}
+	t.stopping = true
+	close(t.closed)
+}
+
+// Router returns the current router of the tenant, or nil if the tenant is unknown
+func (t *Tenants) Router(name string) *Router {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.routers {
+		if r.config.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// Routers returns the current routers
+func (t *Tenants) Routers() []*Router {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.routers
+}
+
+// Metrics returns the metrics of all tenants by name, they can be published using expvar.Publish.
+// The map is updated by Reload.
+func (t *Tenants) Metrics() *expvar.Map {
+	return t.metrics
+}
+
+// Stop stops the routers of all tenants
+func (t *Tenants) Stop(err error) {
+	for _, r := range t.stop() {
+		r.Stop(err)
+	}
+}
+
+// stop prevents further reloads and returns the current routers
+func (t *Tenants) stop() []*Router {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopping = true
+	return t.routers
+}
+
+// Shutdown shuts the routers of all tenants down, see Router.Shutdown
+func (t *Tenants) Shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range t.stop() {
+		wg.Add(1)
+		go func(r *Router) {
+			defer wg.Done()
+			r.Shutdown(ctx)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// Closed is closed when the routers of all tenants are closed
+func (t *Tenants) Closed() <-chan struct{} {
+	return t.closed
+}
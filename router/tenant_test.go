@@ -0,0 +1,170 @@
+package router
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestTenant listens on an ephemeral port of every address
+func newTestTenant(t *testing.T, name string, listenAddrs ...string) (TenantConfig, *net.UDPConn) {
+	var secret [32]byte
+	_, err := rand.Read(secret[:])
+	require.NoError(t, err)
+	backend := listenLoopback(t)
+	c := TenantConfig{
+		Secret:            secret,
+		DefaultServerAddr: backend.LocalAddr().(*net.UDPAddr).AddrPort(),
+		Config:            &Config{Name: name},
+	}
+	for _, addr := range listenAddrs {
+		c.Listen = append(c.Listen, netip.AddrPortFrom(netip.MustParseAddr(addr), 0))
+	}
+	return c, backend
+}
+
+// sendShortHeaderPacket sends a packet with a connection ID of the backend
+func sendShortHeaderPacket(t *testing.T, client *net.UDPConn, secret [32]byte, backendAddr netip.AddrPort, routerAddr netip.AddrPort) []byte {
+	protector, err := NewConnIDProtector(secret, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	generator, err := NewConnIDGeneratorFromAddr(protector, backendAddr, rand.Reader)
+	require.NoError(t, err)
+	connID, err := generator.GenerateConnectionID()
+	require.NoError(t, err)
+	shortHdr := append([]byte{0x40}, connID.Bytes()...)
+	shortHdr = append(shortHdr, make([]byte, 20)...)
+	_, err = client.WriteToUDPAddrPort(shortHdr, routerAddr)
+	require.NoError(t, err)
+	return shortHdr
+}
+
+// receiveDatagram returns the source of the next datagram, that must end with the payload
+func receiveDatagram(t *testing.T, conn *net.UDPConn, payload []byte) netip.AddrPort {
+	buf := make([]byte, MTU)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, from, err := conn.ReadFromUDPAddrPort(buf)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, n, len(payload))
+	assert.Equal(t, payload, buf[n-len(payload):n])
+	return from
+}
+
+func TestTenants(t *testing.T) {
+	configA, backendA := newTestTenant(t, "a", "127.0.0.1", "127.0.0.2")
+	configB, backendB := newTestTenant(t, "b", "127.0.0.3")
+	tenants, err := NewTenants([]TenantConfig{configA, configB})
+	require.NoError(t, err)
+	t.Cleanup(func() { tenants.Stop(nil) })
+	require.NotNil(t, tenants.Router("b"))
+	assert.Nil(t, tenants.Router("c"))
+	client := listenLoopback(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	vip := tenants.Router("a").listeners[1].localAddr
+
+	// the packet is forwarded from the listener the client sent to
+	shortHdr := sendShortHeaderPacket(t, client, configA.Secret, configA.DefaultServerAddr, vip)
+	assert.Equal(t, vip, receiveDatagram(t, backendA, shortHdr))
+
+	// the reply reaches the client from the same listener
+	packerA := newTestPacker(t, configA.Secret, configA.DefaultServerAddr)
+	datagramA, err := packerA.AddHdr(shortHdr, clientAddr)
+	require.NoError(t, err)
+	_, err = backendA.WriteToUDPAddrPort(datagramA, vip)
+	require.NoError(t, err)
+	assert.Equal(t, vip, receiveDatagram(t, client, shortHdr))
+
+	// the key of another tenant is not accepted
+	packerB := newTestPacker(t, configB.Secret, configB.DefaultServerAddr)
+	datagramB, err := packerB.AddHdr(shortHdr, clientAddr)
+	require.NoError(t, err)
+	_, err = backendB.WriteToUDPAddrPort(datagramB, vip)
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = client.Read(make([]byte, MTU))
+	assert.Error(t, err)
+
+	tenants.Stop(nil)
+	select {
+	case <-tenants.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("tenants not closed")
+	}
+}
+
+func TestTenantsValidation(t *testing.T) {
+	configA, _ := newTestTenant(t, "a", "127.0.0.1")
+	configB, _ := newTestTenant(t, "a", "127.0.0.2")
+	_, err := NewTenants([]TenantConfig{configA, configB})
+	assert.ErrorContains(t, err, "duplicate tenant")
+
+	configB.Config.Name = "b"
+	configB.Config.Backends = []netip.AddrPort{configA.DefaultServerAddr}
+	_, err = NewTenants([]TenantConfig{configA, configB})
+	assert.ErrorContains(t, err, "backend "+configA.DefaultServerAddr.String()+" of tenant \"b\" is shared")
+
+	configB.Config.Backends = nil
+	configB.Listen = configA.Listen
+	_, err = NewTenants([]TenantConfig{configA, configB})
+	assert.ErrorContains(t, err, "listener 127.0.0.1:0 of tenant \"b\" is shared")
+}
+
+func TestTenantsReload(t *testing.T) {
+	configA, backendA := newTestTenant(t, "a", "127.0.0.1")
+	configB, _ := newTestTenant(t, "b", "127.0.0.2")
+	tenants, err := NewTenants([]TenantConfig{configA, configB})
+	require.NoError(t, err)
+	t.Cleanup(func() { tenants.Stop(nil) })
+	client := listenLoopback(t)
+	vip := tenants.Router("a").listeners[0].localAddr
+	shortHdr := sendShortHeaderPacket(t, client, configA.Secret, configA.DefaultServerAddr, vip)
+	receiveDatagram(t, backendA, shortHdr)
+	previous := tenants.Router("a")
+	require.NoError(t, previous.DrainBackend(configA.DefaultServerAddr, time.Time{}))
+
+	// invalid configs are rejected
+	other := listenLoopback(t).LocalAddr().(*net.UDPAddr).AddrPort()
+	invalid := *configA.Config
+	invalid.Splits = []SplitRule{{Pool: DefaultPool, Canary: "unknown", Fraction: 1}}
+	err = tenants.Reload([]TenantConfig{{Listen: configA.Listen, Secret: configA.Secret, DefaultServerAddr: configA.DefaultServerAddr, Config: &invalid}})
+	assert.Error(t, err)
+	assert.Same(t, previous, tenants.Router("a"))
+
+	// the listener and the state of the backend are taken over, tenant b is removed
+	reloaded := *configA.Config
+	reloaded.Backends = []netip.AddrPort{other}
+	reloaded.BackendWeights = map[netip.AddrPort]uint32{other: 3}
+	require.NoError(t, tenants.Reload([]TenantConfig{{Listen: configA.Listen, Secret: configA.Secret, DefaultServerAddr: configA.DefaultServerAddr, Config: &reloaded}}))
+	r := tenants.Router("a")
+	assert.NotSame(t, previous, r)
+	assert.Nil(t, tenants.Router("b"))
+	assert.Nil(t, tenants.Metrics().Get("b"))
+	assert.Equal(t, vip, r.listeners[0].localAddr)
+	require.Len(t, r.Backends(), 2)
+	b := r.backends.getByAddr(configA.DefaultServerAddr)
+	assert.Same(t, previous.backends.getByAddr(configA.DefaultServerAddr), b)
+	assert.True(t, b.Draining())
+	assert.Equal(t, uint64(1), b.packetsForwarded.Load())
+	assert.Equal(t, uint32(3), r.backends.getByAddr(other).Weight())
+
+	// established connections continue
+	shortHdr = sendShortHeaderPacket(t, client, configA.Secret, configA.DefaultServerAddr, vip)
+	assert.Equal(t, vip, receiveDatagram(t, backendA, shortHdr))
+
+	select {
+	case <-tenants.Closed():
+		t.Fatal("tenants closed by reload")
+	default:
+	}
+}
+
+func newTestPacker(t *testing.T, secret [32]byte, serverAddr netip.AddrPort) NonQuicPrefixClientIDExtHdrPacker {
+	serverKey, err := DeriveServerKeyFromAddr(secret, serverAddr, CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	packer, err := NewNonQuicPrefixClientIDExtHdrPacker(serverKey.Secret, serverKey.CipherSuite)
+	require.NoError(t, err)
+	return packer
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// packetTrace records how the run loop handled a datagram, for debug logging and captures.
+// The methods do nothing if the trace is nil, so tracing costs nothing if it is disabled.
+type packetTrace struct {
+	received time.Time
+	listener *listener
+	from     netip.AddrPort
+	datagram []byte
+	// class of the datagram, e.g. Initial or backend packet
+	class string
+	// client is the source of client packets, or the address extracted from the extension header of backend packets
+	client netip.AddrPort
+	// serverID is decoded from the connection ID, or the ID of the selected or sending backend
+	serverID    [connIDServerIDLen]byte
+	hasServerID bool
+	// decision is empty if the datagram was dropped without reason
+	decision string
+	dropped  bool
+	// sent datagrams are only recorded for captures
+	keepSent bool
+	sent     []sentDatagram
+}
+
+type sentDatagram struct {
+	to       netip.AddrPort
+	datagram []byte
+}
+
+func (t *packetTrace) classify(class string) {
+	if t == nil {
+		return
+	}
+	t.class = class
+}
+
+func (t *packetTrace) setClient(client netip.AddrPort) {
+	if t == nil {
+		return
+	}
+	t.client = client
+}
+
+func (t *packetTrace) setServerID(serverID [connIDServerIDLen]byte) {
+	if t == nil {
+		return
+	}
+	t.serverID = serverID
+	t.hasServerID = true
+}
+
+// forwarded records the backend the datagram was forwarded to
+func (t *packetTrace) forwarded(backend *Backend) {
+	if t == nil {
+		return
+	}
+	t.setServerID(backend.serverID)
+	t.decision = "forwarded to backend " + backend.addr.String()
+	if backend.pool != DefaultPool {
+		t.decision += " of pool " + backend.pool
+	}
+}
+
+// mirrored records the shadow backend a copy of the datagram was sent to
+func (t *packetTrace) mirrored(shadow netip.AddrPort) {
+	if t == nil {
+		return
+	}
+	t.decision += ", mirrored to " + shadow.String()
+}
+
+// decide records what the router did with a datagram that was not forwarded to a backend
+func (t *packetTrace) decide(decision string) {
+	if t == nil {
+		return
+	}
+	t.decision = decision
+}
+
+func (t *packetTrace) drop(reason string) {
+	if t == nil {
+		return
+	}
+	t.decision = reason
+	t.dropped = true
+}
+
+// send records a sent datagram, the buffer may be reused
+func (t *packetTrace) send(to netip.AddrPort, datagram []byte) {
+	if t == nil || !t.keepSent {
+		return
+	}
+	t.sent = append(t.sent, sentDatagram{to: to, datagram: slices.Clone(datagram)})
+}
+
+// String describes the decision of the router, e.g. for debug logging and capture comments
+func (t *packetTrace) String() string {
+	var b strings.Builder
+	b.WriteString(t.class)
+	b.WriteString(" from ")
+	b.WriteString(t.from.String())
+	if t.client.IsValid() && t.client != t.from {
+		b.WriteString(", client ")
+		b.WriteString(t.client.String())
+	}
+	if t.hasServerID {
+		b.WriteString(", server id ")
+		b.WriteString(hex.EncodeToString(t.serverID[:]))
+		b.WriteString(" (")
+		b.WriteString(serverIDToAddr(t.serverID).String())
+		b.WriteString(")")
+	}
+	switch {
+	case t.dropped:
+		b.WriteString(", dropped: ")
+		b.WriteString(t.decision)
+	case t.decision == "":
+		b.WriteString(", dropped")
+	default:
+		b.WriteString(", ")
+		b.WriteString(t.decision)
+	}
+	return b.String()
+}
+
+// now is the receive time of the datagram the run loop handles.
+// While replaying, it is the capture time of the last replayed datagram,
+// also for changes between datagrams, e.g. of backends.
+func (r *Router) now() time.Time {
+	if r.replaying && !r.replayed.IsZero() {
+		return r.replayed
+	}
+	return time.Now()
+}
+
+// writeTo sends a datagram from the listener, that is recorded by the trace of the current datagram.
+// Listeners of a Replay have no socket, their datagrams are only recorded.
+func (r *Router) writeTo(l *listener, datagram []byte, addr netip.AddrPort) error {
+	r.trace.send(addr, datagram)
+	if l.conn == nil {
+		return nil
+	}
+	_, err := l.conn.WriteToUDPAddrPort(datagram, addr)
+	return err
+}
@@ -1,5 +1,8 @@
 package router
 
+// isQUICPacket says if the fixed bit is set.
+// Clients using grease_quic_bit (RFC 9287) may clear it,
+// so packets without fixed bit are not necessarily non-QUIC packets.
 func isQUICPacket(firstByte byte) bool {
 	return firstByte&0x40 > 0
 }
@@ -0,0 +1,46 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"slices"
+)
+
+// MinInitialDatagramLen is the minimum size of UDP datagrams carrying Initial packets.
+// Smaller datagrams with unknown versions are not answered, see RFC 9000 Section 6.1.
+const MinInitialDatagramLen = 1200
+
+func isSupportedVersion(supportedVersions []uint32, version uint32) bool {
+	return slices.Contains(supportedVersions, version)
+}
+
+// greaseVersion returns a random reserved version of the form 0x?a?a?a?a, see RFC 9000 Section 15
+func greaseVersion() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])&0xf0f0f0f0 | 0x0a0a0a0a
+}
+
+// appendVersionNegotiationPacket appends a Version Negotiation packet, see RFC 9000 Section 17.2.1.
+// destConnID and srcConnID are the connection IDs of the client's packet, they are swapped.
+// A greased version is added to the supported versions.
+func appendVersionNegotiationPacket(b []byte, destConnID []byte, srcConnID []byte, supportedVersions []uint32) []byte {
+	var unused [1]byte
+	_, _ = rand.Read(unused[:])
+	b = append(b, 0x80|unused[0])
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, byte(len(srcConnID)))
+	b = append(b, srcConnID...)
+	b = append(b, byte(len(destConnID)))
+	b = append(b, destConnID...)
+	versions := append(slices.Clone(supportedVersions), greaseVersion())
+	// the position of the greased version should not be predictable
+	var pos [1]byte
+	_, _ = rand.Read(pos[:])
+	i := int(pos[0]) % len(versions)
+	versions[i], versions[len(versions)-1] = versions[len(versions)-1], versions[i]
+	for _, v := range versions {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
@@ -0,0 +1,34 @@
+package router
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestVersionNegotiationPacket(t *testing.T) {
+	packet := appendVersionNegotiationPacket(nil, []byte{1, 2, 3}, []byte{4, 5}, []uint32{Version1})
+	hdr, err := parseLongHeader(packet)
+	require.NoError(t, err)
+	assert.Equal(t, versionNegotiation, hdr.version)
+	assert.Equal(t, []byte{4, 5}, hdr.destConnID)
+	assert.Equal(t, []byte{1, 2, 3}, hdr.srcConnID)
+	versions := packet[7+len(hdr.destConnID)+len(hdr.srcConnID):]
+	require.Len(t, versions, 8)
+	var greased int
+	for i := 0; i < len(versions); i += 4 {
+		v := binary.BigEndian.Uint32(versions[i:])
+		if v&0x0f0f0f0f == 0x0a0a0a0a {
+			greased++
+		} else {
+			assert.Equal(t, Version1, v)
+		}
+	}
+	assert.Equal(t, 1, greased)
+}
+
+func TestIsSupportedVersion(t *testing.T) {
+	assert.True(t, isSupportedVersion([]uint32{Version1}, Version1))
+	assert.False(t, isSupportedVersion([]uint32{Version1}, greaseVersion()))
+}
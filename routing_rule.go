@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// parseRoutingRule parses space separated key=value pairs, e.g.
+// "source=192.0.2.0/24 source=2001:db8::/32 sni=*.example.com alpn=h3 action=pool pool=web".
+// The keys are source, destination, version, sni, alpn, action and pool.
+// source and version may be repeated.
+// The action defaults to pool.
+func parseRoutingRule(s string) (router.RoutingRule, error) {
+	var rule router.RoutingRule
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return router.RoutingRule{}, fmt.Errorf("failed to parse rule: expected key=value, got %q", field)
+		}
+		switch key {
+		case "source":
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return router.RoutingRule{}, fmt.Errorf("failed to parse rule: %s", err)
+			}
+			rule.SourcePrefixes = append(rule.SourcePrefixes, prefix)
+		case "destination":
+			dest, err := netip.ParseAddrPort(value)
+			if err != nil {
+				return router.RoutingRule{}, fmt.Errorf("failed to parse rule: %s", err)
+			}
+			rule.Destination = dest
+		case "version":
+			version, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return router.RoutingRule{}, fmt.Errorf("failed to parse rule: %s", err)
+			}
+			rule.Versions = append(rule.Versions, uint32(version))
+		case "sni":
+			rule.ServerName = value
+		case "alpn":
+			rule.ALPN = value
+		case "action":
+			action, err := router.ParseRoutingAction(value)
+			if err != nil {
+				return router.RoutingRule{}, err
+			}
+			rule.Action = action
+		case "pool":
+			rule.Pool = value
+		default:
+			return router.RoutingRule{}, fmt.Errorf("failed to parse rule: unknown key %q", key)
+		}
+	}
+	return rule, nil
+}
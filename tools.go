@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/urfave/cli/v2"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+func cipherSuiteFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:  "cipher-suite",
+		Usage: "cipher suite of the backends; one of aes-256-gcm, aes-128-gcm, chacha20-poly1305",
+		Value: router.CipherSuiteAES256GCM.String(),
+	}
+}
+
+// keyringEntry is the JSON export of a master key and the key material of its backends
+type keyringEntry struct {
+	MasterKey string `json:"master_key"`
+	// RetryTokenKey is shared by all backends, see router.DeriveRetryTokenKey
+	RetryTokenKey string          `json:"retry_token_key"`
+	Servers       []serverKeyInfo `json:"servers,omitempty"`
+}
+
+type serverKeyInfo struct {
+	Addr      netip.AddrPort `json:"addr"`
+	ServerKey string         `json:"server_key"`
+}
+
+var keygenCommand = &cli.Command{
+	Name:  "keygen",
+	Usage: "generate master keys, or derive the keys of backends from a master key",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "master key; value must be 32 byte and base64 encoded; if not set random keys are generated",
+		},
+		&cli.UintFlag{
+			Name:  "count",
+			Usage: "number of master keys to generate, e.g. the current key and the keys of the next rotations",
+			Value: 1,
+		},
+		cipherSuiteFlag(),
+		&cli.StringSliceFlag{
+			Name:  "server",
+			Usage: "address of a backend to derive the key for, e.g. 192.168.0.2:4433; can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "output format; one of text, json",
+			Value: "text",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		var masters []*[32]byte
+		if ctx.IsSet("key") {
+			if ctx.IsSet("count") {
+				return fmt.Errorf("--count requires generated keys")
+			}
+			master, err := parseKey(ctx.String("key"))
+			if err != nil {
+				return err
+			}
+			masters = append(masters, master)
+		} else {
+			for i := uint(0); i < ctx.Uint("count"); i++ {
+				masters = append(masters, generateKey())
+			}
+		}
+		var serverAddrs []netip.AddrPort
+		for _, s := range ctx.StringSlice("server") {
+			serverAddr, err := netip.ParseAddrPort(s)
+			if err != nil {
+				return fmt.Errorf("failed to parse server address: %s", err)
+			}
+			serverAddrs = append(serverAddrs, serverAddr)
+		}
+		suite, err := router.ParseCipherSuite(ctx.String("cipher-suite"))
+		if err != nil {
+			return err
+		}
+		var keyring []keyringEntry
+		for _, master := range masters {
+			retryTokenKey, err := router.DeriveRetryTokenKey(*master)
+			if err != nil {
+				return err
+			}
+			entry := keyringEntry{
+				MasterKey:     base64.StdEncoding.EncodeToString(master[:]),
+				RetryTokenKey: base64.StdEncoding.EncodeToString(retryTokenKey[:]),
+			}
+			for _, serverAddr := range serverAddrs {
+				serverKey, err := router.DeriveServerKeyFromAddr(*master, serverAddr, suite)
+				if err != nil {
+					return err
+				}
+				entry.Servers = append(entry.Servers, serverKeyInfo{Addr: serverAddr, ServerKey: serverKey.String()})
+			}
+			keyring = append(keyring, entry)
+		}
+		switch ctx.String("format") {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(keyring)
+		case "text":
+			for _, entry := range keyring {
+				if !ctx.IsSet("key") {
+					fmt.Printf("master key: %s\n", entry.MasterKey)
+				}
+				for _, s := range entry.Servers {
+					fmt.Printf("server key of %s: %s\n", s.Addr, s.ServerKey)
+				}
+				if len(entry.Servers) != 0 {
+					fmt.Printf("retry token key: %s\n", entry.RetryTokenKey)
+					fmt.Printf("note: the retry token key is shared by all backends, a leaked key lets spoofed clients pass as validated until the master key is rotated\n")
+				}
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown format %q", ctx.String("format"))
+		}
+	},
+}
+
+// parseHex accepts hex with optional 0x prefix, spaces and colons, e.g. as copied from Wireshark
+func parseHex(s string) ([]byte, error) {
+	s = strings.NewReplacer(" ", "", ":", "", "\n", "").Replace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hex: %s", err)
+	}
+	return b, nil
+}
+
+// connIDProtectorFromFlags returns the protector of the master key, or nil if --key is not set
+func connIDProtectorFromFlags(ctx *cli.Context) (*router.ConnIDProtector, error) {
+	if !ctx.IsSet("key") {
+		return nil, nil
+	}
+	master, err := parseKey(ctx.String("key"))
+	if err != nil {
+		return nil, err
+	}
+	suite, err := router.ParseCipherSuite(ctx.String("cipher-suite"))
+	if err != nil {
+		return nil, err
+	}
+	return router.NewConnIDProtector(*master, suite)
+}
+
+// serverKeyFromFlags returns the key of --server-key, or derives it from --key and --server.
+// Returns nil if neither is set.
+func serverKeyFromFlags(ctx *cli.Context) (*router.ServerKey, error) {
+	if ctx.IsSet("server-key") {
+		serverKey, err := router.ParseServerKey(ctx.String("server-key"))
+		if err != nil {
+			return nil, err
+		}
+		return &serverKey, nil
+	}
+	if !ctx.IsSet("key") || !ctx.IsSet("server") {
+		return nil, nil
+	}
+	master, err := parseKey(ctx.String("key"))
+	if err != nil {
+		return nil, err
+	}
+	serverAddr, err := netip.ParseAddrPort(ctx.String("server"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server address: %s", err)
+	}
+	suite, err := router.ParseCipherSuite(ctx.String("cipher-suite"))
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := router.DeriveServerKeyFromAddr(*master, serverAddr, suite)
+	if err != nil {
+		return nil, err
+	}
+	return &serverKey, nil
+}
+
+var cidCommand = &cli.Command{
+	Name:  "cid",
+	Usage: "generate and decode connection IDs of backends",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "generate",
+			Usage: "generate connection IDs of a backend",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "master key of the router; base64 encoded",
+				},
+				&cli.StringFlag{
+					Name:  "server",
+					Usage: "address of the backend, e.g. 192.168.0.2:4433",
+				},
+				&cli.StringFlag{
+					Name:  "server-key",
+					Usage: "key of the backend, as printed by keygen; replaces --key and --server",
+				},
+				cipherSuiteFlag(),
+				&cli.UintFlag{
+					Name:  "count",
+					Usage: "number of connection IDs",
+					Value: 1,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				serverKey, err := serverKeyFromFlags(ctx)
+				if err != nil {
+					return err
+				}
+				if serverKey == nil {
+					return fmt.Errorf("--server-key or --key and --server are required")
+				}
+				protector, err := router.NewServerConnIDProtector(*serverKey)
+				if err != nil {
+					return err
+				}
+				generator := router.NewConnIDGeneratorFromServerProtector(protector, rand.Reader)
+				for i := uint(0); i < ctx.Uint("count"); i++ {
+					connID, err := generator.GenerateConnectionID()
+					if err != nil {
+						return err
+					}
+					fmt.Println(hex.EncodeToString(connID.Bytes()))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "decode",
+			Usage:     "show the backend of a connection ID and whether its MAC verifies",
+			ArgsUsage: "HEX",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "key",
+					Usage:    "master key of the router; base64 encoded",
+					Required: true,
+				},
+				cipherSuiteFlag(),
+			},
+			Action: func(ctx *cli.Context) error {
+				if ctx.NArg() != 1 {
+					return fmt.Errorf("expected connection ID")
+				}
+				connID, err := parseHex(ctx.Args().First())
+				if err != nil {
+					return err
+				}
+				if len(connID) != router.ConnIDLen {
+					return fmt.Errorf("connection ID must be %d byte", router.ConnIDLen)
+				}
+				protector, err := connIDProtectorFromFlags(ctx)
+				if err != nil {
+					return err
+				}
+				printConnID(protector, connID)
+				return nil
+			},
+		},
+	},
+}
+
+// printConnID prints the server ID of the connection ID, even if the MAC does not verify
+func printConnID(protector *router.ConnIDProtector, connID []byte) {
+	serverID, nonce, err := protector.Decode(connID)
+	if err != nil {
+		serverID = protector.UnverifiedServerID(connID)
+	}
+	fmt.Printf("server id: %s\n", hex.EncodeToString(serverID[:]))
+	fmt.Printf("server address: %s\n", router.ServerKey{ServerID: serverID}.Addr())
+	if err != nil {
+		fmt.Printf("verified: false (%s)\n", err)
+		return
+	}
+	fmt.Printf("nonce: %s\n", hex.EncodeToString(nonce[:]))
+	fmt.Printf("verified: true\n")
+}
+
+var exthdrCommand = &cli.Command{
+	Name:  "exthdr",
+	Usage: "decode extension headers of datagrams between router and backends",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "decode",
+			Usage:     "unwrap the extension header of a captured UDP payload and show the client address",
+			ArgsUsage: "HEX",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "master key of the router; base64 encoded; if --server is not set, the backend is found by the connection ID of short header packets",
+				},
+				&cli.StringFlag{
+					Name:  "server",
+					Usage: "address of the backend, e.g. 192.168.0.2:4433",
+				},
+				&cli.StringFlag{
+					Name:  "server-key",
+					Usage: "key of the backend, as printed by keygen; replaces --key and --server",
+				},
+				cipherSuiteFlag(),
+				&cli.BoolFlag{
+					Name:  "ipv6",
+					Usage: "the client address is an IPv6 address",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if ctx.NArg() != 1 {
+					return fmt.Errorf("expected UDP payload")
+				}
+				datagram, err := parseHex(ctx.Args().First())
+				if err != nil {
+					return err
+				}
+				if len(datagram) == 0 {
+					return router.ErrorZeroLengthUDP
+				}
+				hdrType, suite := router.SplitExtHdrType(datagram[0])
+				switch hdrType {
+				case router.ClientAddrExtHdrType:
+					fmt.Printf("type: client address\n")
+				case router.ValidatedClientAddrExtHdrType:
+					fmt.Printf("type: validated client address\n")
+				default:
+					return fmt.Errorf("no extension header, first byte %#02x", datagram[0])
+				}
+				fmt.Printf("cipher suite: %s\n", suite)
+				protector, err := connIDProtectorFromFlags(ctx)
+				if err != nil {
+					return err
+				}
+				serverKey, err := serverKeyFromFlags(ctx)
+				if err != nil {
+					return err
+				}
+				if serverKey == nil && protector != nil {
+					serverKey, err = serverKeyOfPacket(ctx, protector, datagram)
+					if err != nil {
+						return err
+					}
+				}
+				if serverKey == nil {
+					return fmt.Errorf("--server-key, or --key of a short header packet, or --key and --server are required")
+				}
+				packer, err := router.NewNonQuicPrefixClientIDExtHdrPacker(serverKey.Secret, serverKey.CipherSuite)
+				if err != nil {
+					return err
+				}
+				clientAddr, quicPacket, err := packer.RemoveHdr(datagram, !ctx.Bool("ipv6"))
+				if err != nil {
+					return fmt.Errorf("failed to remove extension header of backend %s: %s", serverKey.Addr(), err)
+				}
+				fmt.Printf("backend: %s\n", serverKey.Addr())
+				fmt.Printf("client address: %s\n", clientAddr)
+				if len(quicPacket) != 0 && quicPacket[0]&0x80 != 0 {
+					fmt.Printf("quic packet: long header, %d byte\n", len(quicPacket))
+				} else {
+					fmt.Printf("quic packet: short header, %d byte\n", len(quicPacket))
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// serverKeyOfPacket derives the key of the backend of the connection ID of the short header packet
+// following the extension header. Returns nil if the packet is no short header packet.
+func serverKeyOfPacket(ctx *cli.Context, protector *router.ConnIDProtector, datagram []byte) (*router.ServerKey, error) {
+	master, err := parseKey(ctx.String("key"))
+	if err != nil {
+		return nil, err
+	}
+	_, suite := router.SplitExtHdrType(datagram[0])
+	// the length of the extension header only depends on the cipher suite
+	packer, err := router.NewNonQuicPrefixClientIDExtHdrPacker([32]byte{}, suite)
+	if err != nil {
+		return nil, err
+	}
+	quicPacket := datagram[min(packer.Len(), len(datagram)):]
+	if len(quicPacket) < 1+router.ConnIDLen || quicPacket[0]&0x80 != 0 {
+		return nil, nil
+	}
+	serverID, _, err := protector.Decode(quicPacket[1 : 1+router.ConnIDLen])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode connection ID: %s", err)
+	}
+	serverKey, err := router.DeriveServerKey(*master, serverID, suite)
+	if err != nil {
+		return nil, err
+	}
+	return &serverKey, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/birneee/quic-router-go/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+// runTool runs the subcommand and returns what it prints
+func runTool(t *testing.T, args ...string) (string, error) {
+	app := &cli.App{Name: "quic-router-go", Commands: []*cli.Command{keygenCommand, cidCommand, exthdrCommand}}
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	err = app.Run(append([]string{"quic-router-go"}, args...))
+	os.Stdout = stdout
+	require.NoError(t, w.Close())
+	out, readErr := io.ReadAll(r)
+	require.NoError(t, readErr)
+	return string(out), err
+}
+
+// testServerKey derives the key of the backend with keygen
+func testServerKey(t *testing.T, server string) string {
+	out, err := runTool(t, "keygen", "--key", testKey, "--server", server, "--format", "json")
+	require.NoError(t, err)
+	var keyring []keyringEntry
+	require.NoError(t, json.Unmarshal([]byte(out), &keyring))
+	require.Len(t, keyring, 1)
+	assert.Equal(t, testKey, keyring[0].MasterKey)
+	require.Len(t, keyring[0].Servers, 1)
+	return keyring[0].Servers[0].ServerKey
+}
+
+func TestToolsKeygenText(t *testing.T) {
+	out, err := runTool(t, "keygen", "--key", testKey, "--server", "192.168.0.2:4433")
+	require.NoError(t, err)
+	assert.Contains(t, out, "server key of 192.168.0.2:4433: "+testServerKey(t, "192.168.0.2:4433")+"\n")
+	assert.Contains(t, out, "retry token key: ")
+	// the tradeoff of the shared retry token key is explained
+	assert.Contains(t, out, "shared by all backends")
+}
+
+func TestToolsConnIDRoundTrip(t *testing.T) {
+	serverKey := testServerKey(t, "192.168.0.2:4433")
+	for _, args := range [][]string{
+		{"--key", testKey, "--server", "192.168.0.2:4433"},
+		{"--server-key", serverKey},
+	} {
+		out, err := runTool(t, append([]string{"cid", "generate", "--count", "3"}, args...)...)
+		require.NoError(t, err)
+		connIDs := strings.Fields(out)
+		require.Len(t, connIDs, 3)
+		for _, connID := range connIDs {
+			out, err = runTool(t, "cid", "decode", "--key", testKey, connID)
+			require.NoError(t, err)
+			assert.Contains(t, out, "server address: 192.168.0.2:4433\n")
+			assert.Contains(t, out, "verified: true\n")
+		}
+	}
+
+	out, err := runTool(t, "cid", "generate", "--server-key", serverKey)
+	require.NoError(t, err)
+	connID, err := hex.DecodeString(strings.TrimSpace(out))
+	require.NoError(t, err)
+	connID[len(connID)-1] ^= 1
+	out, err = runTool(t, "cid", "decode", "--key", testKey, "0x"+hex.EncodeToString(connID))
+	require.NoError(t, err)
+	assert.Contains(t, out, "server address: 192.168.0.2:4433\n")
+	assert.Contains(t, out, "verified: false")
+
+	_, err = runTool(t, "cid", "decode", "--key", testKey, "0102")
+	assert.Error(t, err)
+	_, err = runTool(t, "cid", "generate", "--key", testKey)
+	assert.Error(t, err)
+}
+
+func TestToolsExtHdrDecodeRoundTrip(t *testing.T) {
+	backendAddr := netip.MustParseAddrPort("192.168.0.2:4433")
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:1234")
+	master, err := parseKey(testKey)
+	require.NoError(t, err)
+	serverKey, err := router.DeriveServerKeyFromAddr(*master, backendAddr, router.CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	protector, err := router.NewServerConnIDProtector(serverKey)
+	require.NoError(t, err)
+	connID, err := router.NewConnIDGeneratorFromServerProtector(protector, rand.Reader).GenerateConnectionID()
+	require.NoError(t, err)
+	shortHdr := append([]byte{0x40}, connID.Bytes()...)
+	shortHdr = append(shortHdr, make([]byte, 20)...)
+	packer, err := router.NewNonQuicPrefixClientIDExtHdrPacker(serverKey.Secret, serverKey.CipherSuite)
+	require.NoError(t, err)
+	packed, err := packer.AddHdr(shortHdr, clientAddr)
+	require.NoError(t, err)
+	datagram := hex.EncodeToString(packed)
+
+	for _, args := range [][]string{
+		// the backend is found by the connection ID
+		{"--key", testKey},
+		{"--key", testKey, "--server", backendAddr.String()},
+		{"--server-key", serverKey.String()},
+	} {
+		out, err := runTool(t, append(append([]string{"exthdr", "decode"}, args...), datagram)...)
+		require.NoError(t, err, args)
+		assert.Contains(t, out, "type: client address\n")
+		assert.Contains(t, out, "backend: 192.168.0.2:4433\n")
+		assert.Contains(t, out, "client address: 192.0.2.1:1234\n")
+		assert.Contains(t, out, fmt.Sprintf("quic packet: short header, %d byte\n", len(shortHdr)))
+	}
+
+	otherKey, err := router.DeriveServerKeyFromAddr(*master, netip.MustParseAddrPort("192.168.0.3:4433"), router.CipherSuiteAES256GCM)
+	require.NoError(t, err)
+	_, err = runTool(t, "exthdr", "decode", "--server-key", otherKey.String(), datagram)
+	assert.ErrorContains(t, err, "failed to remove extension header of backend 192.168.0.3:4433")
+	_, err = runTool(t, "exthdr", "decode", "--key", testKey, hex.EncodeToString(shortHdr))
+	assert.ErrorContains(t, err, "no extension header")
+}